@@ -0,0 +1,151 @@
+// Package discovery lets Flotilla daemons register themselves with labels,
+// such as their zone or role, so clients can select the daemons to run peers
+// on by label instead of listing their addresses.
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Registration describes a daemon registered with a Backend.
+type Registration struct {
+	// Addr is the host and port clients dial the daemon at.
+	Addr string `json:"addr"`
+
+	// Labels describe the daemon, such as "zone" or "role".
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Daemon is the daemon's release.
+	Daemon string `json:"daemon,omitempty"`
+
+	// Expires is when the registration lapses unless it's renewed. If zero,
+	// it never does.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the registration has lapsed.
+func (r *Registration) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && now.After(r.Expires)
+}
+
+// Backend stores the registrations of daemons.
+type Backend interface {
+	// Register adds or renews the registration, which lapses after ttl
+	// unless it's renewed. A zero ttl never lapses.
+	Register(r *Registration, ttl time.Duration) error
+
+	// Deregister removes the registration of the daemon at addr.
+	Deregister(addr string) error
+
+	// List returns the current registrations.
+	List() ([]*Registration, error)
+}
+
+// Open returns the backend at the given URL, which is either
+// file:///path/to/dir, a directory with a file per daemon, or
+// etcd://host:2379,host:2379/prefix, an etcd cluster's v2 keys API with the
+// registrations under the prefix, DefaultPrefix if it's empty.
+func Open(rawurl string) (Backend, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFileBackend(u.Path)
+	case "etcd", "etcds":
+		if u.Host == "" {
+			return nil, errors.New("Etcd discovery requires an endpoint")
+		}
+		scheme := "http"
+		if u.Scheme == "etcds" {
+			scheme = "https"
+		}
+		endpoints := strings.Split(u.Host, ",")
+		for i, endpoint := range endpoints {
+			endpoints[i] = scheme + "://" + endpoint
+		}
+		return NewEtcdBackend(endpoints, u.Path)
+	default:
+		return nil, fmt.Errorf("Invalid discovery backend %s, expected file:// or etcd://", rawurl)
+	}
+}
+
+// Selector matches daemons whose labels have each of its values.
+type Selector map[string]string
+
+// ParseSelector parses a selector of the form role=worker,zone=a. An empty
+// selector matches every daemon.
+func ParseSelector(s string) (Selector, error) {
+	labels, err := ParseLabels(s)
+	return Selector(labels), err
+}
+
+// Matches returns true if the labels have each of the selector's values.
+func (s Selector) Matches(labels map[string]string) bool {
+	for key, value := range s {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the selector in the form ParseSelector accepts.
+func (s Selector) String() string {
+	pairs := make([]string, 0, len(s))
+	for key, value := range s {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// ParseLabels parses labels of the form role=worker,zone=a.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid label %s, expected key=value", pair)
+		}
+		if _, ok := labels[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate label %s", parts[0])
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// Select returns the sorted addresses of the daemons registered with the
+// backend which match the selector. It returns an error if none do.
+func Select(b Backend, selector Selector) ([]string, error) {
+	registrations, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, r := range registrations {
+		if selector.Matches(r.Labels) {
+			addrs = append(addrs, r.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		if len(selector) == 0 {
+			return nil, errors.New("No daemons are registered")
+		}
+		return nil, fmt.Errorf("No registered daemons match %s", selector)
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSelector(t *testing.T) {
+	valid := map[string]Selector{
+		"":                     {},
+		"role=worker":          {"role": "worker"},
+		"role=worker,zone=a":   {"role": "worker", "zone": "a"},
+		"zone=":                {"zone": ""},
+		"url=http://a/?b=c":    {"url": "http://a/?b=c"},
+		"instance=m4.large,x=": {"instance": "m4.large", "x": ""},
+	}
+	invalid := []string{
+		"role",
+		"=worker",
+		"role=worker,",
+		",role=worker",
+		"role=worker,,zone=a",
+		"role=worker,role=broker",
+	}
+
+	for s, expected := range valid {
+		selector, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("Expected %q to be valid, got %s", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(selector, expected) {
+			t.Errorf("Expected %q to parse to %v, got %v", s, expected, selector)
+		}
+		if selector.String() != canonical(s) {
+			t.Errorf("Expected %q to print as %q, got %q", s, canonical(s), selector.String())
+		}
+	}
+	for _, s := range invalid {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+// canonical returns the selector with its pairs sorted.
+func canonical(s string) string {
+	if s == "" {
+		return ""
+	}
+	pairs := strings.Split(s, ",")
+	for i := 1; i < len(pairs); i++ {
+		for j := i; j > 0 && pairs[j] < pairs[j-1]; j-- {
+			pairs[j], pairs[j-1] = pairs[j-1], pairs[j]
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"role": "worker", "zone": "a", "empty": ""}
+	tests := []struct {
+		selector Selector
+		matches  bool
+	}{
+		{Selector{}, true},
+		{Selector{"role": "worker"}, true},
+		{Selector{"role": "worker", "zone": "a"}, true},
+		{Selector{"empty": ""}, true},
+		{Selector{"missing": ""}, true},
+		{Selector{"role": "broker"}, false},
+		{Selector{"role": "worker", "zone": "b"}, false},
+		{Selector{"missing": "x"}, false},
+		{Selector{"role": "Worker"}, false},
+	}
+
+	for _, test := range tests {
+		if matches := test.selector.Matches(labels); matches != test.matches {
+			t.Errorf("Expected %v matching %v to be %t", test.selector, labels, test.matches)
+		}
+	}
+	if !(Selector{}).Matches(nil) || (Selector{"role": "worker"}).Matches(nil) {
+		t.Error("Expected only the empty selector to match a daemon without labels")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	b := newFileBackend(t)
+	if _, err := Select(b, Selector{}); err == nil || err.Error() != "No daemons are registered" {
+		t.Fatalf("Expected no daemons error, got %v", err)
+	}
+
+	for _, r := range []*Registration{
+		{Addr: "10.0.0.3:9500", Labels: map[string]string{"role": "worker", "zone": "b"}},
+		{Addr: "10.0.0.1:9500", Labels: map[string]string{"role": "worker", "zone": "a"}},
+		{Addr: "10.0.0.2:9500", Labels: map[string]string{"role": "broker", "zone": "a"}},
+		{Addr: "10.0.0.4:9500"},
+	} {
+		if err := b.Register(r, 0); err != nil {
+			t.Fatalf("Register failed: %s", err)
+		}
+	}
+
+	tests := []struct {
+		selector Selector
+		addrs    []string
+	}{
+		{Selector{}, []string{"10.0.0.1:9500", "10.0.0.2:9500", "10.0.0.3:9500", "10.0.0.4:9500"}},
+		{Selector{"role": "worker"}, []string{"10.0.0.1:9500", "10.0.0.3:9500"}},
+		{Selector{"zone": "a"}, []string{"10.0.0.1:9500", "10.0.0.2:9500"}},
+		{Selector{"role": "worker", "zone": "a"}, []string{"10.0.0.1:9500"}},
+	}
+	for _, test := range tests {
+		addrs, err := Select(b, test.selector)
+		if err != nil {
+			t.Errorf("Select %v failed: %s", test.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, test.addrs) {
+			t.Errorf("Expected %v to select %v, got %v", test.selector, test.addrs, addrs)
+		}
+	}
+
+	_, err := Select(b, Selector{"role": "broker", "zone": "b"})
+	if err == nil || err.Error() != "No registered daemons match role=broker,zone=b" {
+		t.Fatalf("Expected no matching daemons error, got %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir := tempDir(t)
+	b, err := Open("file://" + dir)
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	if f, ok := b.(*FileBackend); !ok || f.dir != dir {
+		t.Fatalf("Expected a file backend for %s, got %#v", dir, b)
+	}
+
+	for _, rawurl := range []string{"", "file://", "consul://localhost:8500", "etcd://"} {
+		if _, err := Open(rawurl); err == nil {
+			t.Errorf("Expected %q to be invalid", rawurl)
+		}
+	}
+}
+
+func TestRegistrationExpired(t *testing.T) {
+	now := time.Now()
+	if (&Registration{}).expired(now) {
+		t.Error("Expected a registration without expiry not to expire")
+	}
+	if (&Registration{Expires: now.Add(time.Second)}).expired(now) {
+		t.Error("Expected a registration expiring later not to have expired")
+	}
+	if !(&Registration{Expires: now.Add(-time.Second)}).expired(now) {
+		t.Error("Expected a registration expiring earlier to have expired")
+	}
+}
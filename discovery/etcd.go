@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+)
+
+// DefaultPrefix is the etcd directory registrations are kept in if none is
+// given.
+const DefaultPrefix = "/flotilla/daemons"
+
+// etcdTimeout bounds each request to etcd.
+const etcdTimeout = 5 * time.Second
+
+// EtcdBackend keeps each registration under its own key in an etcd
+// directory, using the v2 keys API. Registrations expire with their key's TTL.
+type EtcdBackend struct {
+	keys   client.KeysAPI
+	prefix string
+}
+
+// NewEtcdBackend returns an EtcdBackend for the cluster at the given
+// endpoints, such as http://127.0.0.1:2379, with the registrations under the
+// prefix, DefaultPrefix if it's empty or "/".
+func NewEtcdBackend(endpoints []string, prefix string) (*EtcdBackend, error) {
+	if len(endpoints) == 0 || endpoints[0] == "" {
+		return nil, errors.New("Etcd discovery requires an endpoint")
+	}
+	if prefix == "" || prefix == "/" {
+		prefix = DefaultPrefix
+	}
+
+	c, err := client.New(client.Config{
+		Endpoints:               endpoints,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: etcdTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdBackend{keys: client.NewKeysAPI(c), prefix: prefix}, nil
+}
+
+// Register sets the daemon's key to the registration with the TTL.
+func (e *EtcdBackend) Register(r *Registration, ttl time.Duration) error {
+	registration := *r
+	if ttl > 0 {
+		registration.Expires = time.Now().Add(ttl)
+	}
+	registrationJSON, err := json.Marshal(&registration)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err = e.keys.Set(ctx, e.key(r.Addr), string(registrationJSON), &client.SetOptions{TTL: ttl})
+	return err
+}
+
+// Deregister deletes the daemon's key.
+func (e *EtcdBackend) Deregister(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	_, err := e.keys.Delete(ctx, e.key(addr), nil)
+	if client.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List reads every registration under the prefix. Keys which aren't
+// registrations are skipped.
+func (e *EtcdBackend) List() ([]*Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := e.keys.Get(ctx, e.prefix, &client.GetOptions{Recursive: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var registrations []*Registration
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+		var r Registration
+		if err := json.Unmarshal([]byte(node.Value), &r); err != nil || r.Addr == "" {
+			continue
+		}
+		registrations = append(registrations, &r)
+	}
+	return registrations, nil
+}
+
+// key returns the key the daemon at addr is registered under.
+func (e *EtcdBackend) key(addr string) string {
+	return path.Join(e.prefix, keyFor(addr))
+}
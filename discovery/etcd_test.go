@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/embed"
+	"golang.org/x/net/context"
+)
+
+const (
+	etcdClientURL = "http://127.0.0.1:23790"
+	etcdPeerURL   = "http://127.0.0.1:23800"
+)
+
+// startEtcd starts a single-member etcd server in a temporary directory,
+// which it returns along with the server.
+func startEtcd(t *testing.T) (*embed.Etcd, string) {
+	clientURL, _ := url.Parse(etcdClientURL)
+	peerURL, _ := url.Parse(etcdPeerURL)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = tempDir(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.Name + "=" + etcdPeerURL
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(cfg.Dir)
+		t.Fatalf("StartEtcd failed: %s", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		os.RemoveAll(cfg.Dir)
+		t.Fatal("Etcd didn't become ready")
+	}
+	return e, cfg.Dir
+}
+
+func stopEtcd(e *embed.Etcd, dir string) {
+	e.Close()
+	os.RemoveAll(dir)
+}
+
+func TestEtcdBackend(t *testing.T) {
+	e, dir := startEtcd(t)
+	defer stopEtcd(e, dir)
+
+	b, err := Open("etcd://127.0.0.1:23790/flotilla-test")
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	etcd := b.(*EtcdBackend)
+	if etcd.prefix != "/flotilla-test" {
+		t.Fatalf("Expected the prefix /flotilla-test, got %s", etcd.prefix)
+	}
+
+	// Nothing has been registered under the prefix yet.
+	if registrations := list(t, b); len(registrations) != 0 {
+		t.Fatalf("Expected no registrations, got %v", registrations)
+	}
+
+	worker := &Registration{
+		Addr:   "10.0.0.1:9500",
+		Labels: map[string]string{"role": "worker", "zone": "a"},
+		Daemon: "1.0.0",
+	}
+	broker := &Registration{
+		Addr:   "10.0.0.2:9500",
+		Labels: map[string]string{"role": "broker", "zone": "a"},
+	}
+	for _, r := range []*Registration{worker, broker} {
+		if err := b.Register(r, time.Minute); err != nil {
+			t.Fatalf("Register failed: %s", err)
+		}
+	}
+
+	registrations := list(t, b)
+	if len(registrations) != 2 {
+		t.Fatalf("Expected two registrations, got %v", registrations)
+	}
+	got := registrations[worker.Addr]
+	if got == nil || !reflect.DeepEqual(got.Labels, worker.Labels) || got.Daemon != worker.Daemon {
+		t.Fatalf("Expected %+v, got %+v", worker, got)
+	}
+	if got.Expires.Before(time.Now()) || got.Expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the registration to expire in a minute, got %s", got.Expires)
+	}
+
+	addrs, err := Select(b, Selector{"role": "worker"})
+	if err != nil {
+		t.Fatalf("Select failed: %s", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{worker.Addr}) {
+		t.Fatalf("Expected the worker to be selected, got %v", addrs)
+	}
+	if addrs, err = Select(b, Selector{"zone": "a"}); err != nil || len(addrs) != 2 {
+		t.Fatalf("Expected both daemons in zone a, got %v, %v", addrs, err)
+	}
+
+	// Keys which aren't registrations are skipped.
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	if _, err := etcd.keys.Set(ctx, "/flotilla-test/invalid", "{", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := etcd.keys.Set(ctx, "/flotilla-test/dir", "", &client.SetOptions{Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	if registrations := list(t, b); len(registrations) != 2 {
+		t.Fatalf("Expected only the registrations, got %v", registrations)
+	}
+
+	if err := b.Deregister(broker.Addr); err != nil {
+		t.Fatalf("Deregister failed: %s", err)
+	}
+	if err := b.Deregister(broker.Addr); err != nil {
+		t.Fatalf("Expected deregistering twice to succeed, got %s", err)
+	}
+	registrations = list(t, b)
+	if len(registrations) != 1 || registrations[worker.Addr] == nil {
+		t.Fatalf("Expected only the worker, got %v", registrations)
+	}
+}
+
+func TestEtcdBackendExpiry(t *testing.T) {
+	e, dir := startEtcd(t)
+	defer stopEtcd(e, dir)
+
+	b, err := NewEtcdBackend([]string{etcdClientURL}, "")
+	if err != nil {
+		t.Fatalf("NewEtcdBackend failed: %s", err)
+	}
+	if b.prefix != DefaultPrefix {
+		t.Fatalf("Expected the default prefix, got %s", b.prefix)
+	}
+
+	if err := b.Register(&Registration{Addr: "short:9500"}, time.Second); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := b.Register(&Registration{Addr: "long:9500"}, time.Hour); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if registrations := list(t, b); len(registrations) != 2 {
+		t.Fatalf("Expected both registrations, got %v", registrations)
+	}
+
+	// Etcd expires keys within a second or so of their TTL.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		registrations := list(t, b)
+		if len(registrations) == 1 && registrations["long:9500"] != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the short registration to expire, got %v", registrations)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// Renewing a registration before it expires keeps it.
+	for i := 0; i < 3; i++ {
+		if err := b.Register(&Registration{Addr: "renewed:9500"}, 2*time.Second); err != nil {
+			t.Fatalf("Register failed: %s", err)
+		}
+		time.Sleep(time.Second)
+	}
+	if list(t, b)["renewed:9500"] == nil {
+		t.Fatal("Expected the renewed registration to be kept")
+	}
+}
+
+func TestNewEtcdBackend(t *testing.T) {
+	for _, endpoints := range [][]string{nil, {""}} {
+		if _, err := NewEtcdBackend(endpoints, ""); err == nil {
+			t.Errorf("Expected endpoints %q to be invalid", endpoints)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const registrationExt = ".json"
+
+// FileBackend keeps each registration in its own JSON file in a directory,
+// which daemons on different hosts can share over a network filesystem.
+// Registrations can also be written by hand, with no expiry.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend returns a FileBackend for the directory, which is created if
+// it doesn't exist.
+func NewFileBackend(dir string) (*FileBackend, error) {
+	if dir == "" {
+		return nil, errors.New("File discovery requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBackend{dir: dir}, nil
+}
+
+// Register writes the registration to its file. The file is replaced
+// atomically so it's never read half-written.
+func (f *FileBackend) Register(r *Registration, ttl time.Duration) error {
+	registration := *r
+	if ttl > 0 {
+		registration.Expires = time.Now().Add(ttl)
+	}
+	registrationJSON, err := json.MarshalIndent(&registration, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(f.dir, ".flotilla-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(registrationJSON); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(r.Addr))
+}
+
+// Deregister removes the daemon's file.
+func (f *FileBackend) Deregister(addr string) error {
+	err := os.Remove(f.path(addr))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List reads every registration in the directory. Expired registrations are
+// skipped, as are files which can't be read, since another daemon may be
+// replacing them.
+func (f *FileBackend) List() ([]*Registration, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		registrations []*Registration
+		now           = time.Now()
+	)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") ||
+			filepath.Ext(file.Name()) != registrationExt {
+			continue
+		}
+		registrationJSON, err := ioutil.ReadFile(filepath.Join(f.dir, file.Name()))
+		if err != nil {
+			continue
+		}
+		var r Registration
+		if err := json.Unmarshal(registrationJSON, &r); err != nil || r.Addr == "" {
+			continue
+		}
+		if r.expired(now) {
+			continue
+		}
+		registrations = append(registrations, &r)
+	}
+	return registrations, nil
+}
+
+// path returns the file the daemon at addr is registered in.
+func (f *FileBackend) path(addr string) string {
+	return filepath.Join(f.dir, keyFor(addr)+registrationExt)
+}
+
+// keyFor returns a name for the daemon at addr which is safe to use as a file
+// name or key.
+func keyFor(addr string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(addr)
+}
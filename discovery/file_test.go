@@ -0,0 +1,184 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flotilla-discovery-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func newFileBackend(t *testing.T) *FileBackend {
+	b, err := NewFileBackend(tempDir(t))
+	if err != nil {
+		t.Fatalf("NewFileBackend failed: %s", err)
+	}
+	return b
+}
+
+// list returns the registrations keyed by address.
+func list(t *testing.T, b Backend) map[string]*Registration {
+	registrations, err := b.List()
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	byAddr := make(map[string]*Registration)
+	for _, r := range registrations {
+		byAddr[r.Addr] = r
+	}
+	return byAddr
+}
+
+func TestFileBackend(t *testing.T) {
+	b := newFileBackend(t)
+	defer os.RemoveAll(b.dir)
+
+	r := &Registration{
+		Addr:   "10.0.0.1:9500",
+		Labels: map[string]string{"role": "worker", "zone": "a"},
+		Daemon: "1.0.0",
+	}
+	if err := b.Register(r, time.Minute); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if !r.Expires.IsZero() {
+		t.Error("Expected Register to leave the registration unchanged")
+	}
+
+	registrations := list(t, b)
+	got := registrations[r.Addr]
+	if len(registrations) != 1 || got == nil {
+		t.Fatalf("Expected only %s to be registered, got %v", r.Addr, registrations)
+	}
+	if !reflect.DeepEqual(got.Labels, r.Labels) || got.Daemon != r.Daemon {
+		t.Errorf("Expected %+v, got %+v", r, got)
+	}
+	if got.Expires.Before(time.Now()) || got.Expires.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the registration to expire in a minute, got %s", got.Expires)
+	}
+
+	// Registering again renews and replaces the registration.
+	r.Labels["zone"] = "b"
+	if err := b.Register(r, 0); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	got = list(t, b)[r.Addr]
+	if got.Labels["zone"] != "b" || !got.Expires.IsZero() {
+		t.Errorf("Expected the renewed registration, got %+v", got)
+	}
+
+	if err := b.Deregister(r.Addr); err != nil {
+		t.Fatalf("Deregister failed: %s", err)
+	}
+	if registrations := list(t, b); len(registrations) != 0 {
+		t.Fatalf("Expected no registrations, got %v", registrations)
+	}
+	if err := b.Deregister(r.Addr); err != nil {
+		t.Fatalf("Expected deregistering twice to succeed, got %s", err)
+	}
+
+	// Nothing but the registrations' files was left in the directory.
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected an empty directory, got %d files", len(files))
+	}
+}
+
+func TestFileBackendExpiry(t *testing.T) {
+	b := newFileBackend(t)
+	defer os.RemoveAll(b.dir)
+
+	if err := b.Register(&Registration{Addr: "short:9500"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := b.Register(&Registration{Addr: "long:9500"}, time.Hour); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if registrations := list(t, b); len(registrations) != 2 {
+		t.Fatalf("Expected both registrations, got %v", registrations)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	registrations := list(t, b)
+	if len(registrations) != 1 || registrations["long:9500"] == nil {
+		t.Fatalf("Expected only the unexpired registration, got %v", registrations)
+	}
+}
+
+func TestFileBackendSkipsOtherFiles(t *testing.T) {
+	b := newFileBackend(t)
+	defer os.RemoveAll(b.dir)
+
+	files := map[string]string{
+		// Written by hand, with no expiry.
+		"manual.json": `{"addr": "10.0.0.9:9500", "labels": {"role": "worker"}}`,
+		// Being written by another daemon.
+		".flotilla-123": `{"addr": "10.0.0.1:9500"}`,
+		"notes.txt":     `{"addr": "10.0.0.2:9500"}`,
+		"invalid.json":  `{"addr": `,
+		"noaddr.json":   `{"labels": {"role": "worker"}}`,
+		"expired.json":  `{"addr": "10.0.0.3:9500", "expires": "2000-01-01T00:00:00Z"}`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(b.dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(b.dir, "dir.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	registrations := list(t, b)
+	if len(registrations) != 1 || registrations["10.0.0.9:9500"] == nil {
+		t.Fatalf("Expected only the hand-written registration, got %v", registrations)
+	}
+}
+
+func TestFileBackendKeys(t *testing.T) {
+	b := newFileBackend(t)
+	defer os.RemoveAll(b.dir)
+
+	// Addresses which would escape the directory or collide are kept apart.
+	addrs := []string{"[::1]:9500", "a/../../etc/passwd:9500", "host:9500"}
+	for _, addr := range addrs {
+		if err := b.Register(&Registration{Addr: addr}, 0); err != nil {
+			t.Fatalf("Register %s failed: %s", addr, err)
+		}
+	}
+	registrations := list(t, b)
+	for _, addr := range addrs {
+		if registrations[addr] == nil {
+			t.Errorf("Expected %s to be registered, got %v", addr, registrations)
+		}
+		if dir := filepath.Dir(b.path(addr)); dir != b.dir {
+			t.Errorf("Expected %s to be registered in %s, got %s", addr, b.dir, dir)
+		}
+	}
+}
+
+func TestNewFileBackend(t *testing.T) {
+	if _, err := NewFileBackend(""); err == nil {
+		t.Fatal("Expected a directory to be required")
+	}
+
+	dir := filepath.Join(tempDir(t), "nested", "daemons")
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(dir)))
+	if _, err := NewFileBackend(dir); err != nil {
+		t.Fatalf("NewFileBackend failed: %s", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("Expected %s to be created", dir)
+	}
+}
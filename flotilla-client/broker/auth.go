@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const authKey = "auth"
+
+// Credentials authenticate requests to daemons which require them.
+type Credentials struct {
+	// Token is the name of the token configured on the daemons.
+	Token string
+
+	// Secret is the token's secret, which requests are signed with.
+	Secret string `json:"-"`
+}
+
+type auth struct {
+	Token     string `json:"token"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// sign returns the request JSON with an auth block. The signature is the
+// HMAC-SHA256 of the timestamp, a newline and the request JSON with its keys
+// sorted, which daemons verify the same way.
+func (c *Credentials) sign(requestJSON []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(requestJSON, &fields); err != nil {
+		return nil, err
+	}
+	signed, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().Unix()
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "\n"))
+	mac.Write(signed)
+
+	authJSON, err := json.Marshal(&auth{
+		Token:     c.Token,
+		Timestamp: timestamp,
+		Signature: hex.EncodeToString(mac.Sum(nil)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields[authKey] = authJSON
+	return json.Marshal(fields)
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+const (
+	resultsFile = "results.json"
+	logsDir     = "logs"
+)
+
+// bundle is the contents of results.json in a result bundle.
+type bundle struct {
+	Benchmark   *Benchmark                            `json:"benchmark"`
+	Broker      *BrokerInfo                           `json:"broker,omitempty"`
+	RunStarted  time.Time                             `json:"run_started"`
+	Results     []*ResultContainer                    `json:"results,omitempty"`
+	BrokerUsage map[string]map[string]*protocol.Usage `json:"broker_usage,omitempty"`
+
+	// ExcludedPeers contains why each peer missing from Results was
+	// excluded, keyed by host.
+	ExcludedPeers map[string]string `json:"excluded_peers,omitempty"`
+
+	Err string `json:"error,omitempty"`
+}
+
+// WriteBundle writes a result bundle to the given directory, creating it if
+// necessary. The bundle contains the Benchmark and its results, or the error
+// which caused it to fail, in results.json along with the broker and daemon
+// logs under logs/. It should be called after Teardown so that the logs have
+// been collected.
+func (c *Client) WriteBundle(dir string, results []*ResultContainer, runErr error) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b := &bundle{
+		Benchmark:     c.Benchmark,
+		Broker:        c.Broker,
+		RunStarted:    c.RunStarted,
+		Results:       results,
+		BrokerUsage:   c.BrokerUsage,
+		ExcludedPeers: c.ExcludedPeers,
+	}
+	if runErr != nil {
+		b.Err = runErr.Error()
+	}
+
+	resultsJSON, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, resultsFile), resultsJSON, 0644); err != nil {
+		return err
+	}
+
+	for path, output := range c.Logs {
+		path = filepath.Join(dir, logsDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(output), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logPath returns the path in a result bundle's logs directory for the named
+// output of the daemon on the given host, such as
+// logs/10.0.0.1_9500/daemon.log.
+func logPath(host, name string) string {
+	return filepath.Join(sanitize(host), sanitize(name)+".log")
+}
+
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', ' ':
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -1,87 +1,281 @@
 package broker
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/req"
 	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
-type operation string
 type daemon string
 
 const (
-	minNumMessages             = 100
-	minMessageSize             = 9
-	start            operation = "start"
-	stop             operation = "stop"
-	sub              operation = "subscribers"
-	pub              operation = "publishers"
-	run              operation = "run"
-	results          operation = "results"
-	teardown         operation = "teardown"
-	resultsSleep               = time.Second
-	sendRecvDeadline           = 5 * time.Second
+	minNumMessages   = 100
+	minMessageSize   = 9
+	hello            = protocol.Hello
+	start            = protocol.Start
+	stop             = protocol.Stop
+	sub              = protocol.Subscribers
+	pub              = protocol.Publishers
+	run              = protocol.Run
+	results          = protocol.Results
+	teardown         = protocol.Teardown
+	faults           = protocol.Faults
+	impair           = protocol.Impair
+	logs             = protocol.Logs
+	sessions         = protocol.Sessions
+	heartbeat        = protocol.Heartbeat
+	status           = protocol.Status
+	resultsSleep     = time.Second
+	sendRecvDeadline = 5 * time.Second
 )
 
+// request is a request to a daemon. The payloads specific to some operations
+// are added to the shared fields.
 type request struct {
-	Operation   operation `json:"operation"`
-	Broker      string    `json:"broker"`
-	Port        string    `json:"port"`
-	NumMessages uint      `json:"num_messages"`
-	MessageSize uint64    `json:"message_size"`
-	Count       uint      `json:"count"`
-	Host        string    `json:"host"`
+	protocol.Request
+
+	Options    *protocol.BrokerOptions `json:"options,omitempty"`
+	Faults     []*protocol.Fault       `json:"faults,omitempty"`
+	Impairment *protocol.Impairment    `json:"impairment,omitempty"`
+	Security   *protocol.Security      `json:"security,omitempty"`
 }
 
 type response struct {
-	Success    bool        `json:"success"`
-	Message    string      `json:"message"`
-	Result     interface{} `json:"result"`
-	PubResults []*Result   `json:"pub_results,omitempty"`
-	SubResults []*Result   `json:"sub_results,omitempty"`
+	protocol.Response
+	Result     json.RawMessage            `json:"result"`
+	PubResults []*protocol.Result         `json:"pub_results,omitempty"`
+	SubResults []*protocol.Result         `json:"sub_results,omitempty"`
+	Usage      map[string]*protocol.Usage `json:"usage,omitempty"`
+}
+
+type startResult struct {
+	Broker      json.RawMessage `json:"broker"`
+	TimeToReady float32         `json:"time_to_ready"`
+}
+
+// BrokerContainer describes a container running the broker.
+type BrokerContainer struct {
+	ID     string `json:"id"`
+	Image  string `json:"image"`
+	Digest string `json:"digest"`
+}
+
+// BrokerInfo contains details about the broker started for the benchmark.
+type BrokerInfo struct {
+	TimeToReady time.Duration
+	Containers  []*BrokerContainer
 }
 
 // Benchmark contains configuration settings for broker tests.
 type Benchmark struct {
-	BrokerdHost   string
-	BrokerName    string
-	BrokerHost    string
-	BrokerPort    string
-	PeerHosts     []string
-	NumMessages   uint
-	MessageSize   uint64
-	Publishers    uint
-	Subscribers   uint
-	StartupSleep  uint
-	DaemonTimeout uint
+	// BrokerdHosts contains the broker daemons which start the broker. If
+	// there are several, the broker is started as a cluster with one node
+	// per daemon, each on its daemon's host.
+	BrokerdHosts []string
+
+	BrokerName     string
+	BrokerHost     string
+	BrokerPort     string
+	PeerHosts      []string
+	NumMessages    uint
+	MessageSize    uint64
+	Publishers     uint
+	Subscribers    uint
+	StartupTimeout uint
+	DaemonTimeout  uint
+
+	// BrokerImage overrides the broker's image. This can be a full image
+	// reference or just a tag, such as ":0.7.2".
+	BrokerImage string
+
+	// BrokerEnv contains extra environment variables for the broker.
+	BrokerEnv map[string]string
+
+	// BrokerConfig contains broker configuration keys and values, such as
+	// Kafka's num.io.threads.
+	BrokerConfig map[string]string
+
+	// ExternalBrokers contains the addresses of an existing broker to
+	// benchmark. If set, the broker daemon is not used and the broker is
+	// neither started nor stopped.
+	ExternalBrokers []string
+
+	// Faults contains actions to take against broker nodes while the
+	// benchmark runs.
+	Faults []*Fault
+
+	// IdleTimeout is the number of seconds subscribers wait for a message
+	// before completing with the messages they have received. Zero waits
+	// forever, which can hang the benchmark if messages are lost.
+	IdleTimeout uint
+
+	// PeerImpairment contains network conditions to emulate on the peer
+	// hosts.
+	PeerImpairment *Impairment
+
+	// BrokerImpairment contains network conditions to emulate on each broker
+	// node.
+	BrokerImpairment *Impairment
+
+	// BrokerResources limits the host resources available to each broker
+	// node's container. If nil, the broker is unconstrained.
+	BrokerResources *protocol.Resources
+
+	// Session identifies the benchmark's broker and peers on the daemons,
+	// which keeps them isolated from other benchmarks sharing the daemons.
+	// If empty, a random session is used.
+	Session string
+
+	// TLS configures TLS for the connections to the daemons. If nil, they're
+	// plaintext.
+	TLS *TLS
+
+	// Credentials sign requests to daemons which require authentication. If
+	// nil, requests aren't signed.
+	Credentials *Credentials
+
+	// BrokerSecurity configures TLS and authentication between the peers
+	// and the broker. If nil, peers connect in plaintext without
+	// credentials.
+	BrokerSecurity *BrokerSecurity
+
+	// Progress shows live progress while the benchmark runs, for peer
+	// daemons which publish it.
+	Progress bool
+
+	// HeartbeatTimeout is the number of seconds a daemon can go without
+	// answering heartbeats while the benchmark runs before it's declared
+	// dead. Dead peers are excluded from the results. Zero disables
+	// heartbeats.
+	HeartbeatTimeout uint
 }
 
-func (b *Benchmark) validate() error {
-	if b.BrokerdHost == "" {
-		return errors.New("Invalid broker daemon host")
+// Impairment describes network conditions to emulate, such as a WAN link.
+// It's applied with tc netem, which requires the daemons to run as root.
+type Impairment struct {
+	// Delay is the latency added to outgoing packets.
+	Delay time.Duration
+
+	// Jitter is the random variation of the added delay.
+	Jitter time.Duration
+
+	// Loss is the percentage of outgoing packets dropped.
+	Loss float64
+
+	// Rate caps the outgoing bandwidth in kbit/s.
+	Rate uint
+
+	// Device is the network interface to impair, eth0 if empty.
+	Device string
+}
+
+func (i *Impairment) request() *protocol.Impairment {
+	return &protocol.Impairment{
+		Delay:  int64(i.Delay / time.Millisecond),
+		Jitter: int64(i.Jitter / time.Millisecond),
+		Loss:   i.Loss,
+		Rate:   int(i.Rate),
+		Device: i.Device,
 	}
+}
+
+// These are the supported fault actions.
+const (
+	Kill    = protocol.FaultKill
+	Restart = protocol.FaultRestart
+)
+
+// Fault is an action taken against a broker node while the benchmark runs.
+type Fault struct {
+	// At is when to take the action, relative to the start of the run.
+	At time.Duration
+
+	// Node is the index of the broker node, which corresponds to its broker
+	// daemon in BrokerdHosts.
+	Node int
 
+	// Action is either Kill, which kills the node, or Restart, which restarts
+	// it whether it's running or not.
+	Action string
+}
+
+func (b *Benchmark) validate() error {
 	if b.BrokerName == "" {
 		return errors.New("Invalid broker name")
 	}
 
-	if b.BrokerHost == "" {
-		return errors.New("Invalid broker host")
-	}
+	if len(b.ExternalBrokers) > 0 {
+		for _, addr := range b.ExternalBrokers {
+			if addr == "" {
+				return errors.New("Invalid external broker address")
+			}
+		}
+	} else {
+		if len(b.BrokerdHosts) == 0 {
+			return errors.New("Must provide at least one broker daemon host")
+		}
+
+		for _, host := range b.BrokerdHosts {
+			if host == "" {
+				return errors.New("Invalid broker daemon host")
+			}
+		}
+
+		if b.BrokerHost == "" {
+			return errors.New("Invalid broker host")
+		}
 
-	if b.BrokerPort == "" {
-		return errors.New("Invalid broker port")
+		if b.BrokerPort == "" {
+			return errors.New("Invalid broker port")
+		}
 	}
 
 	if len(b.PeerHosts) == 0 {
 		return errors.New("Must provide at least one peer host")
 	}
 
+	if b.BrokerImpairment != nil && b.External() {
+		return errors.New("Network impairment cannot be applied to an external broker")
+	}
+
+	if err := b.BrokerSecurity.validate(); err != nil {
+		return err
+	}
+
+	if b.BrokerSecurity.Started() && b.External() {
+		return errors.New("An external broker cannot be started with TLS")
+	}
+
+	for _, f := range b.Faults {
+		if b.External() {
+			return errors.New("Faults cannot be injected into an external broker")
+		}
+
+		if f.Action != Kill && f.Action != Restart {
+			return fmt.Errorf("Invalid fault action %s", f.Action)
+		}
+
+		if f.Node < 0 || f.Node >= len(b.BrokerdHosts) {
+			return fmt.Errorf("Invalid fault node %d", f.Node)
+		}
+
+		if f.At < 0 {
+			return fmt.Errorf("Invalid fault time %s", f.At)
+		}
+	}
+
 	if b.NumMessages < minNumMessages {
 		return fmt.Errorf("Number of messages must be at least %d", minNumMessages)
 	}
@@ -101,37 +295,106 @@ func (b *Benchmark) validate() error {
 	return nil
 }
 
-// Result contains test result data for a single peer.
-type Result struct {
-	Duration   float32        `json:"duration,omitempty"`
-	Throughput float32        `json:"throughput,omitempty"`
-	Latency    LatencyResults `json:"latency,omitempty"`
-	Err        string         `json:"error"`
+// External indicates if the Benchmark runs against an existing broker rather
+// than one started by the broker daemon.
+func (b *Benchmark) External() bool {
+	return len(b.ExternalBrokers) > 0
+}
+
+// Clustered indicates if the broker is started as a multi-node cluster.
+func (b *Benchmark) Clustered() bool {
+	return !b.External() && len(b.BrokerdHosts) > 1
+}
+
+// BrokerNodes returns the host of each broker node. A single node runs on
+// BrokerHost, while clustered nodes run on their broker daemon's host.
+func (b *Benchmark) BrokerNodes() []string {
+	if !b.Clustered() {
+		return []string{b.BrokerHost}
+	}
+
+	nodes := make([]string, len(b.BrokerdHosts))
+	for i, brokerd := range b.BrokerdHosts {
+		host, _, err := net.SplitHostPort(brokerd)
+		if err != nil {
+			host = brokerd
+		}
+		nodes[i] = host
+	}
+	return nodes
+}
+
+// BrokerAddrs returns the comma-separated addresses peers use to connect to
+// the broker.
+func (b *Benchmark) BrokerAddrs() string {
+	if b.External() {
+		return strings.Join(b.ExternalBrokers, ",")
+	}
+
+	nodes := b.BrokerNodes()
+	addrs := make([]string, len(nodes))
+	for i, node := range nodes {
+		addrs[i] = fmt.Sprintf("%s:%s", node, b.BrokerPort)
+	}
+	return strings.Join(addrs, ",")
 }
 
 // ResultContainer contains the Results for a single node.
 type ResultContainer struct {
 	Peer              string
-	PublisherResults  []*Result
-	SubscriberResults []*Result
-}
+	PublisherResults  []*protocol.Result
+	SubscriberResults []*protocol.Result
 
-// LatencyResults contains the latency result data for a single peer.
-type LatencyResults struct {
-	Min    int64   `json:"min"`
-	Q1     int64   `json:"q1"`
-	Q2     int64   `json:"q2"`
-	Q3     int64   `json:"q3"`
-	Max    int64   `json:"max"`
-	Mean   float64 `json:"mean"`
-	StdDev float64 `json:"std_dev"`
+	// Usage contains the resource usage of the peer's host during the run,
+	// and of the broker's containers if the peer also ran the broker, keyed
+	// by source.
+	Usage map[string]*protocol.Usage
 }
 
 // Client provides an API for interacting with Flotilla.
 type Client struct {
-	brokerd   mangos.Socket
+	brokerd   []mangos.Socket
 	peerd     map[string]mangos.Socket
 	Benchmark *Benchmark
+
+	// daemons contains what each daemon supports, keyed by host. It's nil
+	// for daemons which predate the hello handshake.
+	daemons map[string]*protocol.HelloResult
+
+	// dead contains the peer daemons which stopped answering heartbeats,
+	// which are skipped on Teardown.
+	dead map[string]bool
+
+	// tlsConfig is the TLS configuration daemons are connected to with, or
+	// nil if TLS isn't configured.
+	tlsConfig *tls.Config
+
+	// security and serverSecurity are the broker security settings sent to
+	// the peer and broker daemons.
+	security       *protocol.Security
+	serverSecurity *protocol.ServerSecurity
+
+	// Broker contains details about the started broker. It's nil until the
+	// broker has been started.
+	Broker *BrokerInfo
+
+	// RunStarted is when the benchmark run began, which faults are relative
+	// to.
+	RunStarted time.Time
+
+	// ExcludedPeers contains the reason each peer daemon whose results
+	// couldn't be collected was excluded from the results, keyed by host.
+	ExcludedPeers map[string]string
+
+	// BrokerUsage contains the resource usage of each broker daemon's host
+	// and broker containers during the run, keyed by broker daemon. Broker
+	// daemons which also run peers report usage with their results instead.
+	BrokerUsage map[string]map[string]*protocol.Usage
+
+	// Logs contains the output of the broker containers and of each daemon
+	// during the benchmark, keyed by a relative file path. Daemon output is
+	// collected on Teardown.
+	Logs map[string]string
 }
 
 // NewClient creates and returns a new Client from the provided Benchmark
@@ -142,53 +405,85 @@ func NewClient(b *Benchmark) (*Client, error) {
 		return nil, err
 	}
 
-	brokerd, err := req.NewSocket()
+	if b.Session == "" {
+		session, err := generateSession()
+		if err != nil {
+			return nil, err
+		}
+		b.Session = session
+	}
+
+	tlsConfig, err := b.TLS.load()
 	if err != nil {
 		return nil, err
 	}
 
-	brokerd.AddTransport(tcp.NewTransport())
-	brokerd.SetOption(mangos.OptionSendDeadline, time.Duration(b.DaemonTimeout)*time.Second)
-	brokerd.SetOption(mangos.OptionRecvDeadline, time.Duration(b.DaemonTimeout)*time.Second)
-
-	if err := brokerd.Dial(fmt.Sprintf("tcp://%s", b.BrokerdHost)); err != nil {
+	security, serverSecurity, err := b.BrokerSecurity.load()
+	if err != nil {
 		return nil, err
 	}
 
+	var (
+		brokerd []mangos.Socket
+		daemons = make(map[string]*protocol.HelloResult)
+	)
+	if !b.External() {
+		brokerd = make([]mangos.Socket, 0, len(b.BrokerdHosts))
+		for _, host := range b.BrokerdHosts {
+			s, err := dial(host, b.DaemonTimeout, tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			if daemons[host], err = b.negotiate(s, host, true, false); err != nil {
+				return nil, err
+			}
+			brokerd = append(brokerd, s)
+		}
+	}
+
 	peerd := make(map[string]mangos.Socket, len(b.PeerHosts))
 	for _, peer := range b.PeerHosts {
-		s, err := req.NewSocket()
+		s, err := dial(peer, b.DaemonTimeout, tlsConfig)
 		if err != nil {
 			return nil, err
 		}
-
-		s.AddTransport(tcp.NewTransport())
-		s.SetOption(mangos.OptionSendDeadline, time.Duration(b.DaemonTimeout)*time.Second)
-		s.SetOption(mangos.OptionRecvDeadline, time.Duration(b.DaemonTimeout)*time.Second)
-
-		if err := s.Dial(fmt.Sprintf("tcp://%s", peer)); err != nil {
+		if daemons[peer], err = b.negotiate(s, peer, false, true); err != nil {
 			return nil, err
 		}
-
 		peerd[peer] = s
 	}
 
 	return &Client{
-		brokerd:   brokerd,
-		peerd:     peerd,
-		Benchmark: b,
+		brokerd:        brokerd,
+		peerd:          peerd,
+		Benchmark:      b,
+		Logs:           make(map[string]string),
+		daemons:        daemons,
+		dead:           make(map[string]bool),
+		ExcludedPeers:  make(map[string]string),
+		tlsConfig:      tlsConfig,
+		security:       security,
+		serverSecurity: serverSecurity,
 	}, nil
 }
 
 // Start begins the broker test.
 func (c *Client) Start() ([]*ResultContainer, error) {
-	fmt.Println("Starting broker - if the image hasn't been pulled yet, this may take a while...")
-	if err := c.startBroker(); err != nil {
-		return nil, fmt.Errorf("Failed to start broker: %s", err.Error())
+	if c.Benchmark.External() {
+		fmt.Printf("Using external broker at %s\n", c.Benchmark.BrokerAddrs())
+	} else {
+		fmt.Println("Starting broker - if the image hasn't been pulled yet, this may take a while...")
+		broker, err := c.startBroker()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start broker: %s", err.Error())
+		}
+		c.Broker = broker
+		fmt.Printf("Broker ready after %s\n", broker.TimeToReady)
 	}
 
-	// Allow some time for broker startup.
-	time.Sleep(time.Duration(c.Benchmark.StartupSleep) * time.Second)
+	if err := c.impairNetwork(); err != nil {
+		return nil, fmt.Errorf("Failed to impair network: %s", err.Error())
+	}
 
 	fmt.Println("Preparing producers")
 	if err := c.startPublishers(); err != nil {
@@ -200,42 +495,154 @@ func (c *Client) Start() ([]*ResultContainer, error) {
 		return nil, fmt.Errorf("Failed to start consumers %s:", err.Error())
 	}
 
+	if len(c.Benchmark.Faults) > 0 {
+		fmt.Println("Scheduling faults")
+		if err := c.scheduleFaults(); err != nil {
+			return nil, fmt.Errorf("Failed to schedule faults: %s", err.Error())
+		}
+	}
+
 	fmt.Println("Running benchmark")
+	stopProgress := func() {}
+	if c.Benchmark.Progress {
+		stopProgress = c.watchProgress()
+	}
+	heartbeats := c.startHeartbeats()
+	c.RunStarted = time.Now()
 	if err := c.runBenchmark(); err != nil {
+		heartbeats.stop()
+		stopProgress()
 		return nil, fmt.Errorf("Failed to run benchmark %s:", err.Error())
 	}
 
-	return <-c.collectResults(), nil
+	results, ok := <-c.collectResults(heartbeats.deadPeers())
+	heartbeats.stop()
+	stopProgress()
+	if !ok {
+		return nil, errors.New("Failed to collect results")
+	}
+
+	c.collectBrokerUsage()
+	return results, nil
 }
 
-func (c *Client) startBroker() error {
-	resp, err := sendRequest(c.brokerd, request{
-		Operation: start,
-		Broker:    c.Benchmark.BrokerName,
-		Host:      c.Benchmark.BrokerHost,
-		Port:      c.Benchmark.BrokerPort,
+// startBroker starts each broker node in order, since clustered nodes join
+// the first one.
+func (c *Client) startBroker() (*BrokerInfo, error) {
+	var (
+		nodes  = c.Benchmark.BrokerNodes()
+		broker = &BrokerInfo{}
+		spec   *protocol.Cluster
+	)
+	if c.Benchmark.Clustered() {
+		secret, err := generateSecret()
+		if err != nil {
+			return nil, err
+		}
+		spec = &protocol.Cluster{Nodes: nodes, Secret: secret}
+	}
+
+	for i, brokerd := range c.brokerd {
+		var nodeSpec *protocol.Cluster
+		if spec != nil {
+			nodeSpec = &protocol.Cluster{Nodes: spec.Nodes, Node: i, Secret: spec.Secret}
+		}
+
+		result, err := c.startNode(brokerd, c.Benchmark.BrokerdHosts[i], nodes[i], nodeSpec)
+		if err != nil {
+			if spec != nil {
+				return nil, fmt.Errorf("Node %d: %s", i, err.Error())
+			}
+			return nil, err
+		}
+
+		broker.TimeToReady += time.Duration(result.TimeToReady * float32(time.Millisecond))
+
+		// Brokers which don't run in containers, such as Cloud Pub/Sub, don't
+		// report any.
+		var containers []*BrokerContainer
+		json.Unmarshal(result.Broker, &containers)
+		broker.Containers = append(broker.Containers, containers...)
+	}
+
+	return broker, nil
+}
+
+func (c *Client) startNode(brokerd mangos.Socket, brokerdHost, host string, spec *protocol.Cluster) (*startResult, error) {
+	// The daemon doesn't respond until the broker is ready, so wait for the
+	// startup timeout in addition to the usual daemon timeout.
+	timeout := time.Duration(c.Benchmark.StartupTimeout+c.Benchmark.DaemonTimeout) * time.Second
+	brokerd.SetOption(mangos.OptionRecvDeadline, timeout)
+	defer brokerd.SetOption(mangos.OptionRecvDeadline,
+		time.Duration(c.Benchmark.DaemonTimeout)*time.Second)
+
+	resp, err := c.sendRequest(brokerd, request{
+		Request: protocol.Request{
+			Operation:      start,
+			Broker:         c.Benchmark.BrokerName,
+			Host:           host,
+			Port:           c.Benchmark.BrokerPort,
+			StartupTimeout: int(c.Benchmark.StartupTimeout),
+		},
+		Options: &protocol.BrokerOptions{
+			Image:     c.Benchmark.BrokerImage,
+			Env:       c.Benchmark.BrokerEnv,
+			Config:    c.Benchmark.BrokerConfig,
+			Cluster:   spec,
+			Resources: c.Benchmark.BrokerResources,
+			Security:  c.serverSecurity,
+		},
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// Container output is returned if the broker failed to become ready.
+	c.addLogs(brokerdHost, resp.Logs)
 	if !resp.Success {
-		return errors.New(resp.Message)
+		return nil, errors.New(resp.Message)
 	}
 
-	return nil
+	var result startResult
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// generateSecret returns a random secret shared by the nodes of a cluster.
+func generateSecret() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// generateSession returns a random session ID for the benchmark.
+func generateSession() (string, error) {
+	session := make([]byte, 4)
+	if _, err := rand.Read(session); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(session), nil
 }
 
 func (c *Client) startSubscribers() error {
 	for _, peerd := range c.peerd {
-		resp, err := sendRequest(peerd, request{
-			Operation:   sub,
-			Broker:      c.Benchmark.BrokerName,
-			Host:        fmt.Sprintf("%s:%s", c.Benchmark.BrokerHost, c.Benchmark.BrokerPort),
-			Count:       c.Benchmark.Subscribers,
-			NumMessages: c.Benchmark.NumMessages,
-			MessageSize: c.Benchmark.MessageSize,
+		resp, err := c.sendRequest(peerd, request{
+			Request: protocol.Request{
+				Operation:   sub,
+				Broker:      c.Benchmark.BrokerName,
+				Host:        c.Benchmark.BrokerAddrs(),
+				Count:       int(c.Benchmark.Subscribers),
+				NumMessages: int(c.Benchmark.NumMessages),
+				MessageSize: int64(c.Benchmark.MessageSize),
+				IdleTimeout: int(c.Benchmark.IdleTimeout),
+			},
+			Security: c.security,
 		})
 
 		if err != nil {
@@ -251,13 +658,16 @@ func (c *Client) startSubscribers() error {
 
 func (c *Client) startPublishers() error {
 	for _, peerd := range c.peerd {
-		resp, err := sendRequest(peerd, request{
-			Operation:   pub,
-			Broker:      c.Benchmark.BrokerName,
-			Host:        fmt.Sprintf("%s:%s", c.Benchmark.BrokerHost, c.Benchmark.BrokerPort),
-			Count:       c.Benchmark.Publishers,
-			NumMessages: c.Benchmark.NumMessages,
-			MessageSize: c.Benchmark.MessageSize,
+		resp, err := c.sendRequest(peerd, request{
+			Request: protocol.Request{
+				Operation:   pub,
+				Broker:      c.Benchmark.BrokerName,
+				Host:        c.Benchmark.BrokerAddrs(),
+				Count:       int(c.Benchmark.Publishers),
+				NumMessages: int(c.Benchmark.NumMessages),
+				MessageSize: int64(c.Benchmark.MessageSize),
+			},
+			Security: c.security,
 		})
 
 		if err != nil {
@@ -271,9 +681,86 @@ func (c *Client) startPublishers() error {
 	return nil
 }
 
+// impairNetwork applies the network impairments to the broker nodes and peer
+// hosts. The peer impairments are reverted on teardown and the broker
+// impairments when the broker is stopped.
+func (c *Client) impairNetwork() error {
+	if i := c.Benchmark.BrokerImpairment; i != nil {
+		fmt.Println("Impairing broker network")
+		for _, brokerd := range c.brokerd {
+			if err := c.sendImpairment(brokerd, i, "broker"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if i := c.Benchmark.PeerImpairment; i != nil {
+		fmt.Println("Impairing peer network")
+		for _, peerd := range c.peerd {
+			if err := c.sendImpairment(peerd, i, "host"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Client) sendImpairment(s mangos.Socket, i *Impairment, target string) error {
+	resp, err := c.sendRequest(s, request{
+		Request: protocol.Request{
+			Operation: impair,
+			Broker:    c.Benchmark.BrokerName,
+			Target:    target,
+		},
+		Impairment: i.request(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if !resp.Success {
+		return errors.New(resp.Message)
+	}
+	return nil
+}
+
+// scheduleFaults sends each broker daemon the faults for its node. They're
+// scheduled relative to when they're received, which is just before the run
+// begins.
+func (c *Client) scheduleFaults() error {
+	nodeFaults := make([][]*protocol.Fault, len(c.brokerd))
+	for _, f := range c.Benchmark.Faults {
+		nodeFaults[f.Node] = append(nodeFaults[f.Node], &protocol.Fault{
+			After:  int64(f.At / time.Millisecond),
+			Action: f.Action,
+		})
+	}
+
+	for i, brokerd := range c.brokerd {
+		if len(nodeFaults[i]) == 0 {
+			continue
+		}
+
+		resp, err := c.sendRequest(brokerd, request{
+			Request: protocol.Request{Operation: faults, Broker: c.Benchmark.BrokerName},
+			Faults:  nodeFaults[i],
+		})
+		if err != nil {
+			return err
+		}
+
+		if !resp.Success {
+			return errors.New(resp.Message)
+		}
+	}
+	return nil
+}
+
 func (c *Client) runBenchmark() error {
-	for _, peerd := range c.peerd {
-		resp, err := sendRequest(peerd, request{Operation: run})
+	// Broker daemons which don't run peers are also told to run so they
+	// sample their resource usage.
+	for _, daemon := range c.runners() {
+		resp, err := c.sendRequest(daemon, newRequest(run))
 		if err != nil {
 			return err
 		}
@@ -285,75 +772,269 @@ func (c *Client) runBenchmark() error {
 	return nil
 }
 
-func (c *Client) collectResults() <-chan []*ResultContainer {
+// runners returns every peer daemon and every broker daemon which isn't also
+// a peer daemon.
+func (c *Client) runners() []mangos.Socket {
+	daemons := make([]mangos.Socket, 0, len(c.peerd)+len(c.brokerd))
+	for _, peerd := range c.peerd {
+		daemons = append(daemons, peerd)
+	}
+	for _, brokerd := range c.brokerdOnly() {
+		daemons = append(daemons, brokerd)
+	}
+	return daemons
+}
+
+// brokerdOnly returns the broker daemons which don't also run peers, keyed by
+// host.
+func (c *Client) brokerdOnly() map[string]mangos.Socket {
+	daemons := make(map[string]mangos.Socket, len(c.brokerd))
+	for i, brokerd := range c.brokerd {
+		host := c.Benchmark.BrokerdHosts[i]
+		if _, ok := c.peerd[host]; !ok {
+			daemons[host] = brokerd
+		}
+	}
+	return daemons
+}
+
+// collectBrokerUsage collects the resource usage sampled by broker daemons
+// which don't run peers. Failures are reported but aren't fatal since the
+// benchmark results are already available.
+func (c *Client) collectBrokerUsage() {
+	c.BrokerUsage = make(map[string]map[string]*protocol.Usage)
+	for host, brokerd := range c.brokerdOnly() {
+		resp, err := c.sendRequest(brokerd, newRequest(results))
+		if err == nil && !resp.Success {
+			err = errors.New(resp.Message)
+		}
+		if err != nil {
+			fmt.Printf("Failed to collect resource usage from %s: %s\n", host, err.Error())
+			continue
+		}
+		c.BrokerUsage[host] = resp.Usage
+	}
+}
+
+// peerResults is the outcome of collecting a peer daemon's results.
+type peerResults struct {
+	host    string
+	results *ResultContainer
+	err     error
+}
+
+// collectResults collects the results of every peer daemon. Peers whose
+// results can't be collected, or which are sent on dead, are reported and
+// excluded so the others' results are still returned. The channel is closed
+// without results if every peer was excluded.
+func (c *Client) collectResults(dead <-chan string) <-chan []*ResultContainer {
 	resultsChan := make(chan []*ResultContainer, 1)
 
-	go func(chan<- []*ResultContainer) {
-		results := make([]*ResultContainer, 0, len(c.peerd))
-		subResults := make(chan *ResultContainer, len(c.peerd))
-		complete := 0
+	go func() {
+		var (
+			results   = make([]*ResultContainer, 0, len(c.peerd))
+			collected = make(chan *peerResults, len(c.peerd))
+			pending   = make(map[string]bool, len(c.peerd))
+			done      = make(chan struct{})
+		)
+		defer close(done)
 
 		for host, peerd := range c.peerd {
-			go collectResultsFromPeer(host, peerd, subResults)
+			pending[host] = true
+			go c.collectResultsFromPeer(host, peerd, collected, done)
 		}
 
-		for {
+		for len(pending) > 0 {
 			select {
-			case subResult, ok := <-subResults:
-				if !ok {
-					return
+			case r := <-collected:
+				if !pending[r.host] {
+					// The peer was already declared dead.
+					continue
 				}
-				results = append(results, subResult)
-				complete++
+				delete(pending, r.host)
+				if r.err != nil {
+					c.excludePeer(r.host, fmt.Sprintf("Failed to collect results: %s", r.err.Error()))
+					continue
+				}
+				results = append(results, r.results)
+			case host := <-dead:
+				if !pending[host] {
+					continue
+				}
+				delete(pending, host)
+				c.dead[host] = true
+				c.excludePeer(host, fmt.Sprintf("Stopped answering heartbeats for %d seconds",
+					c.Benchmark.HeartbeatTimeout))
 			}
+		}
 
-			if complete == len(c.peerd) {
-				resultsChan <- results
-				return
-			}
+		if len(results) == 0 {
+			close(resultsChan)
+			return
 		}
-	}(resultsChan)
+		resultsChan <- results
+	}()
 
 	return resultsChan
 }
 
+// excludePeer records why the peer daemon at the given host was excluded from
+// the results and reports it.
+func (c *Client) excludePeer(host, reason string) {
+	c.ExcludedPeers[host] = reason
+	fmt.Printf("\nExcluding peer %s from the results: %s\n", host, reason)
+}
+
 // Teardown performs any necessary cleanup logic, including stopping the
 // broker and tearing down peers.
 func (c *Client) Teardown() {
 	fmt.Println("Tearing down peers")
-	for _, peerd := range c.peerd {
-		_, err := sendRequest(peerd, request{Operation: teardown})
+	for host, peerd := range c.peerd {
+		if c.dead[host] {
+			fmt.Printf("Skipping teardown of dead peer %s\n", host)
+			continue
+		}
+		resp, err := c.sendRequest(peerd, newRequest(teardown))
 		if err != nil {
 			fmt.Printf("Failed to teardown peer: %s\n", err.Error())
+			continue
+		}
+		c.addLogs(host, resp.Logs)
+	}
+
+	if !c.Benchmark.External() {
+		fmt.Println("Stopping broker")
+		if err := c.stopBroker(); err != nil {
+			fmt.Printf("Failed to stop broker: %s\n", err.Error())
+		}
+	}
+
+	c.collectDaemonLogs()
+}
+
+// collectDaemonLogs fetches the output of every daemon involved in the
+// benchmark which didn't return it when its peers were torn down or its broker
+// stopped.
+func (c *Client) collectDaemonLogs() {
+	daemons := make(map[string]mangos.Socket, len(c.peerd)+len(c.brokerd))
+	for host, peerd := range c.peerd {
+		daemons[host] = peerd
+	}
+	for host, brokerd := range c.brokerdOnly() {
+		daemons[host] = brokerd
+	}
+
+	for host, daemon := range daemons {
+		if c.dead[host] || !c.supports(host, protocol.FeatureLogs) {
+			continue
+		}
+		if hello := c.daemons[host]; hello != nil && hello.Supports(protocol.FeatureSessionLogs) {
+			continue
+		}
+		resp, err := c.sendRequest(daemon, newRequest(logs))
+		if err == nil && !resp.Success {
+			err = errors.New(resp.Message)
 		}
+		if err != nil {
+			fmt.Printf("Failed to collect logs from %s: %s\n", host, err.Error())
+			continue
+		}
+		c.addLogs(host, resp.Logs)
 	}
+}
 
-	fmt.Println("Stopping broker")
-	if err := c.stopBroker(); err != nil {
-		fmt.Printf("Failed to stop broker: %s\n", err.Error())
+// addLogs adds the output returned by the daemon on the given host to Logs.
+func (c *Client) addLogs(host string, logs map[string]string) {
+	for name, output := range logs {
+		// A daemon's output is returned in parts, when its peers are torn
+		// down and when its broker is stopped, so the parts are joined.
+		if output != "" {
+			c.Logs[logPath(host, name)] += output
+		}
 	}
 }
 
+// stopBroker stops each broker node in the reverse order they were started.
+// It returns the first error encountered.
 func (c *Client) stopBroker() error {
-	resp, err := sendRequest(c.brokerd, request{Operation: stop})
+	var err error
+	for i := len(c.brokerd) - 1; i >= 0; i-- {
+		resp, e := c.sendRequest(c.brokerd[i], newRequest(stop))
+		if e == nil {
+			c.addLogs(c.Benchmark.BrokerdHosts[i], resp.Logs)
+			if !resp.Success {
+				e = errors.New(resp.Message)
+			}
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// dial connects to the daemon on the given host, waiting up to timeout
+// seconds to send each request and receive its response. The connection uses
+// TLS if tlsConfig isn't nil.
+func dial(host string, timeout uint, tlsConfig *tls.Config) (mangos.Socket, error) {
+	s, err := req.NewSocket()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !resp.Success {
-		return errors.New(resp.Message)
+	s.SetOption(mangos.OptionSendDeadline, time.Duration(timeout)*time.Second)
+	s.SetOption(mangos.OptionRecvDeadline, time.Duration(timeout)*time.Second)
+
+	if err := connect(s, host, tlsConfig); err != nil {
+		return nil, err
 	}
+	return s, nil
+}
 
-	return nil
+// connect dials the given address with the socket, over TLS if there's a
+// configuration for it.
+func connect(s mangos.Socket, addr string, tlsConfig *tls.Config) error {
+	scheme := tcpScheme
+	if tlsConfig != nil {
+		scheme = tlsScheme
+		s.AddTransport(tlstcp.NewTransport())
+		if err := s.SetOption(mangos.OptionTLSConfig, forHost(tlsConfig, addr)); err != nil {
+			return err
+		}
+	} else {
+		s.AddTransport(tcp.NewTransport())
+	}
+	return s.Dial(scheme + addr)
 }
 
-func sendRequest(s mangos.Socket, request request) (*response, error) {
+// newRequest returns a request for the operation with no other fields.
+func newRequest(op protocol.Operation) request {
+	return request{Request: protocol.Request{Operation: op}}
+}
+
+// sendRequest sends the request to the daemon as part of the benchmark's
+// session.
+func (c *Client) sendRequest(s mangos.Socket, request request) (*response, error) {
+	request.Session = c.Benchmark.Session
+	return sendRequest(s, request, c.Benchmark.Credentials)
+}
+
+// sendRequest sends the request to the daemon, signed with the credentials if
+// they aren't nil, and returns its response.
+func sendRequest(s mangos.Socket, request request, creds *Credentials) (*response, error) {
+	request.Version = protocol.Version
 	requestJSON, err := json.Marshal(request)
 	if err != nil {
 		// This is not recoverable.
 		panic(err)
 	}
 
+	if creds != nil {
+		if requestJSON, err = creds.sign(requestJSON); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := s.Send(requestJSON); err != nil {
 		return nil, err
 	}
@@ -371,30 +1052,35 @@ func sendRequest(s mangos.Socket, request request) (*response, error) {
 	return &resp, nil
 }
 
-func collectResultsFromPeer(host string, peerd mangos.Socket, subResults chan *ResultContainer) {
+// collectResultsFromPeer polls the peer daemon at the given host until its
+// results are ready, an error occurs or done is closed, and sends the outcome
+// on collected.
+func (c *Client) collectResultsFromPeer(host string, peerd mangos.Socket, collected chan<- *peerResults, done <-chan struct{}) {
 	for {
-		resp, err := sendRequest(peerd, request{Operation: results})
+		resp, err := c.sendRequest(peerd, newRequest(results))
+		if err == nil && !resp.Success {
+			err = errors.New(resp.Message)
+		}
 		if err != nil {
-			fmt.Println("Failed to collect results from peer:", err.Error())
-			close(subResults)
+			collected <- &peerResults{host: host, err: err}
 			return
 		}
 
-		if !resp.Success {
-			fmt.Printf("Failed to collect results from peer: %s", resp.Message)
-			subResults <- nil
-		}
-
 		if resp.Message == "Results not ready" {
-			time.Sleep(resultsSleep)
+			select {
+			case <-done:
+				return
+			case <-time.After(resultsSleep):
+			}
 			continue
 		}
 
-		subResults <- &ResultContainer{
+		collected <- &peerResults{host: host, results: &ResultContainer{
 			Peer:              host,
 			PublisherResults:  resp.PubResults,
 			SubscriberResults: resp.SubResults,
-		}
-		break
+			Usage:             resp.Usage,
+		}}
+		return
 	}
 }
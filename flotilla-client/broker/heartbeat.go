@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// heartbeatInterval is how often each daemon is sent a heartbeat. It also
+// bounds how long a heartbeat waits for its response.
+const heartbeatInterval = time.Second
+
+// heartbeats monitors the liveness of the daemons while the benchmark runs.
+// Each daemon gets its own socket, since requests on the benchmark's sockets
+// can block for much longer than a heartbeat and REQ sockets only handle one
+// request at a time.
+type heartbeats struct {
+	timeout time.Duration
+	sockets map[string]mangos.Socket
+	peers   map[string]bool
+
+	// dead receives the peer daemons which stopped answering heartbeats.
+	dead chan string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// startHeartbeats sends heartbeats to every daemon which supports them until
+// the returned heartbeats are stopped. A daemon is declared dead once it
+// hasn't answered for the benchmark's HeartbeatTimeout. Dead peer daemons are
+// sent on dead, and dead broker daemons are only reported. The result is nil
+// if heartbeats are disabled.
+func (c *Client) startHeartbeats() *heartbeats {
+	if c.Benchmark.HeartbeatTimeout == 0 {
+		return nil
+	}
+
+	h := &heartbeats{
+		timeout: time.Duration(c.Benchmark.HeartbeatTimeout) * time.Second,
+		sockets: make(map[string]mangos.Socket),
+		peers:   make(map[string]bool, len(c.peerd)),
+		dead:    make(chan string, len(c.peerd)),
+		done:    make(chan struct{}),
+	}
+	hosts := make([]string, 0, len(c.peerd)+len(c.brokerd))
+	for host := range c.peerd {
+		h.peers[host] = true
+		hosts = append(hosts, host)
+	}
+	for host := range c.brokerdOnly() {
+		hosts = append(hosts, host)
+	}
+
+	for _, host := range hosts {
+		hello := c.daemons[host]
+		if hello == nil || !hello.SupportsOperation(protocol.Heartbeat) {
+			continue
+		}
+		s, err := dial(host, 0, c.tlsConfig)
+		if err != nil {
+			fmt.Printf("Failed to monitor %s: %s\n", host, err.Error())
+			continue
+		}
+		s.SetOption(mangos.OptionSendDeadline, heartbeatInterval)
+		s.SetOption(mangos.OptionRecvDeadline, heartbeatInterval)
+		h.sockets[host] = s
+		h.wg.Add(1)
+		go c.beat(h, host, s)
+	}
+	return h
+}
+
+// beat sends heartbeats to the daemon at the given host until the heartbeats
+// are stopped or the daemon is declared dead.
+func (c *Client) beat(h *heartbeats, host string, s mangos.Socket) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	lastSeen := time.Now()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := c.sendRequest(s, newRequest(heartbeat))
+		if err == nil && resp.Success {
+			lastSeen = time.Now()
+			continue
+		}
+		if time.Since(lastSeen) < h.timeout {
+			continue
+		}
+
+		if h.peers[host] {
+			h.dead <- host
+		} else {
+			fmt.Printf("\nBroker daemon %s hasn't answered heartbeats for %s\n", host, h.timeout)
+		}
+		return
+	}
+}
+
+// stop stops sending heartbeats and closes the heartbeat sockets.
+func (h *heartbeats) stop() {
+	if h == nil {
+		return
+	}
+	close(h.done)
+	h.wg.Wait()
+	for _, s := range h.sockets {
+		s.Close()
+	}
+}
+
+// deadPeers returns the channel dead peer daemons are sent on, which is nil,
+// and so never ready, if heartbeats are disabled.
+func (h *heartbeats) deadPeers() <-chan string {
+	if h == nil {
+		return nil
+	}
+	return h.dead
+}
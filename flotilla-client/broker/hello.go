@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-mangos/mangos"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// legacyMessage prefixes the response of daemons which predate the hello
+// operation.
+const legacyMessage = "Invalid operation"
+
+// sendHello performs the hello handshake with the daemon and returns what it
+// supports. The result is nil if the daemon predates the handshake.
+func sendHello(s mangos.Socket, creds *Credentials) (*protocol.HelloResult, error) {
+	resp, err := sendRequest(s, newRequest(hello), creds)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		if strings.HasPrefix(resp.Message, legacyMessage) {
+			return nil, nil
+		}
+		return nil, errors.New(resp.Message)
+	}
+
+	var result protocol.HelloResult
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// negotiate performs the hello handshake with the daemon and checks that it
+// can take part in the benchmark, either running the broker or peers. It
+// refuses daemons which speak a different protocol version or lack a feature
+// the benchmark needs. Daemons which predate the handshake are used anyway,
+// with a warning, since what they support can't be checked.
+func (b *Benchmark) negotiate(s mangos.Socket, host string, brokerd, peerd bool) (*protocol.HelloResult, error) {
+	hello, err := sendHello(s, b.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("Hello to daemon %s failed: %s", host, err.Error())
+	}
+	if hello == nil {
+		fmt.Printf("Daemon %s predates protocol version %d, so its compatibility can't be checked\n",
+			host, protocol.Version)
+		return nil, nil
+	}
+	if hello.Version != protocol.Version {
+		return nil, fmt.Errorf("Daemon %s (%s) speaks protocol version %d, but the client speaks version %d",
+			host, hello.Daemon, hello.Version, protocol.Version)
+	}
+
+	var required []string
+	if brokerd {
+		if !hello.SupportsBroker(b.BrokerName) {
+			return nil, fmt.Errorf("Daemon %s can't start %s", host, b.BrokerName)
+		}
+		if len(b.Faults) > 0 {
+			required = append(required, protocol.FeatureFaults)
+		}
+		if b.BrokerImpairment != nil {
+			required = append(required, protocol.FeatureImpairment)
+		}
+		if b.BrokerSecurity.Started() {
+			required = append(required, protocol.FeatureBrokerSecurity)
+		}
+	}
+	if peerd {
+		if b.PeerImpairment != nil {
+			required = append(required, protocol.FeatureImpairment)
+		}
+		if b.BrokerSecurity != nil {
+			required = append(required, protocol.FeatureBrokerSecurity)
+		}
+	}
+	for _, feature := range required {
+		if !hello.Supports(feature) {
+			return nil, fmt.Errorf("Daemon %s (%s) doesn't support %s", host, hello.Daemon, feature)
+		}
+	}
+
+	if !hello.Supports(protocol.FeatureSessions) {
+		fmt.Printf("Daemon %s doesn't support sessions, so the benchmark isn't isolated from others sharing it\n", host)
+	}
+	return hello, nil
+}
+
+// supports returns true if the daemon at the given host has the feature, or
+// predates the handshake and might.
+func (c *Client) supports(host, feature string) bool {
+	hello := c.daemons[host]
+	return hello == nil || hello.Supports(feature)
+}
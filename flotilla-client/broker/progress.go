@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	subsocket "github.com/go-mangos/mangos/protocol/sub"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// progressInterval is how often the progress view is redrawn. progressPoll
+// bounds how long a progress socket blocks, so watching stops promptly.
+const (
+	progressInterval = time.Second
+	progressPoll     = 500 * time.Millisecond
+)
+
+// progressView shows the benchmark's progress, which is aggregated from the
+// latest update published by each peer daemon.
+type progressView struct {
+	benchmark *Benchmark
+	peers     int
+	sockets   []mangos.Socket
+	updates   map[string]*protocol.Progress
+	started   time.Time
+	mu        sync.Mutex
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// watchProgress subscribes to the session's progress on every peer daemon
+// which publishes it and shows a live view until the returned function is
+// called. Daemons which don't publish progress are left out of the view.
+func (c *Client) watchProgress() func() {
+	view := &progressView{
+		benchmark: c.Benchmark,
+		peers:     len(c.peerd),
+		updates:   make(map[string]*protocol.Progress),
+		started:   time.Now(),
+		done:      make(chan struct{}),
+	}
+
+	for host := range c.peerd {
+		hello := c.daemons[host]
+		if hello == nil || !hello.Supports(protocol.FeatureProgress) {
+			continue
+		}
+		s, err := dialProgress(progressAddr(host, hello.ProgressPort), c.Benchmark.Session, c.tlsConfig)
+		if err != nil {
+			fmt.Printf("Failed to watch progress on %s: %s\n", host, err.Error())
+			continue
+		}
+		view.sockets = append(view.sockets, s)
+		view.wg.Add(1)
+		go view.receive(host, s)
+	}
+
+	if len(view.sockets) == 0 {
+		return func() {}
+	}
+	view.wg.Add(1)
+	go view.draw()
+
+	return func() {
+		close(view.done)
+		view.wg.Wait()
+		for _, s := range view.sockets {
+			s.Close()
+		}
+		fmt.Println()
+	}
+}
+
+// progressAddr returns the address of the progress socket of the daemon at
+// the given host.
+func progressAddr(host string, port int) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// dialProgress subscribes to the session's progress at the given address.
+func dialProgress(addr, session string, tlsConfig *tls.Config) (mangos.Socket, error) {
+	s, err := subsocket.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	s.SetOption(mangos.OptionRecvDeadline, progressPoll)
+
+	if err := s.SetOption(mangos.OptionSubscribe, protocol.ProgressTopic(session)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := connect(s, addr, tlsConfig); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// receive records the progress published by the daemon at the given host
+// until the view is done.
+func (v *progressView) receive(host string, s mangos.Socket) {
+	defer v.wg.Done()
+	for {
+		select {
+		case <-v.done:
+			return
+		default:
+		}
+
+		msg, err := s.Recv()
+		if err != nil {
+			continue
+		}
+		p, err := protocol.DecodeProgress(msg)
+		if err != nil {
+			continue
+		}
+		v.mu.Lock()
+		v.updates[host] = p
+		v.mu.Unlock()
+	}
+}
+
+// draw redraws the view until it's done.
+func (v *progressView) draw() {
+	defer v.wg.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.done:
+			return
+		case <-ticker.C:
+			v.mu.Lock()
+			line := v.String()
+			v.mu.Unlock()
+			// Pad the line to clear a longer previous one.
+			fmt.Printf("\r%-100s", line)
+		}
+	}
+}
+
+// String summarizes the progress reported so far. The ETA is based on the
+// current receive rate, since the run completes once every subscriber has
+// received its messages.
+func (v *progressView) String() string {
+	var total protocol.Progress
+	for _, p := range v.updates {
+		total.Published += p.Published
+		total.Received += p.Received
+		total.PublishRate += p.PublishRate
+		total.ReceiveRate += p.ReceiveRate
+		total.Errors += p.Errors
+	}
+
+	var (
+		b         = v.benchmark
+		reporting = int64(len(v.updates))
+		published = reporting * int64(b.Publishers) * int64(b.NumMessages)
+		received  = reporting * int64(b.Subscribers) * int64(b.NumMessages)
+		eta       = "unknown"
+	)
+	if total.ReceiveRate > 0 && received > total.Received {
+		remaining := float64(received-total.Received) / total.ReceiveRate
+		eta = (time.Duration(remaining) * time.Second).String()
+	}
+
+	parts := []string{
+		fmt.Sprintf("%s elapsed", time.Since(v.started)/time.Second*time.Second),
+		fmt.Sprintf("sent %d/%d (%s)", total.Published, published, percent(total.Published, published)),
+		fmt.Sprintf("received %d/%d (%s)", total.Received, received, percent(total.Received, received)),
+		fmt.Sprintf("%.0f msg/s", total.ReceiveRate),
+		fmt.Sprintf("%d errors", total.Errors),
+		"ETA " + eta,
+	}
+	if int(reporting) < v.peers {
+		parts = append(parts, fmt.Sprintf("%d of %d peer hosts reporting", reporting, v.peers))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func percent(n, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// BrokerSecurity configures TLS and authentication between the peers and the
+// broker. Certificates and keys are PEM-encoded files, which are read by the
+// client and sent to the daemons.
+type BrokerSecurity struct {
+	// TLS has the peers connect to the broker over TLS. The broker's
+	// certificate is verified with CA, or the system's roots if it's empty,
+	// unless InsecureSkipVerify is set.
+	TLS                bool
+	CA                 string
+	InsecureSkipVerify bool
+
+	// Cert and Key are the client certificate peers present to brokers
+	// which require one.
+	Cert string
+	Key  string
+
+	// Username and Password are the credentials peers authenticate with.
+	// Mechanism is the SASL mechanism for brokers which support several. If
+	// empty, the broker's default is used.
+	Username  string
+	Password  string
+	Mechanism string
+
+	// ServerCert and ServerKey are the certificate and key the broker
+	// daemons start the broker with, which enables TLS on brokers that
+	// support it. If ServerCA is set, the broker requires peers to present
+	// a certificate signed by it. A started broker also requires Username
+	// and Password, if set.
+	ServerCert string
+	ServerKey  string
+	ServerCA   string
+}
+
+// Started returns true if the broker should be started with TLS.
+func (s *BrokerSecurity) Started() bool {
+	return s != nil && s.ServerCert != ""
+}
+
+func (s *BrokerSecurity) validate() error {
+	if s == nil {
+		return nil
+	}
+	if (s.Cert == "") != (s.Key == "") {
+		return errors.New("Broker client certificate requires both a certificate and a key")
+	}
+	if (s.ServerCert == "") != (s.ServerKey == "") {
+		return errors.New("Broker server certificate requires both a certificate and a key")
+	}
+	if s.ServerCA != "" && s.ServerCert == "" {
+		return errors.New("Broker server CA requires a server certificate")
+	}
+	if s.Started() && !s.TLS {
+		return errors.New("Broker server certificate requires peers to use TLS")
+	}
+	return nil
+}
+
+// load reads the certificate and key files and returns the security settings
+// sent with the publisher and subscriber requests and, if the broker should
+// be started with TLS, those sent with the start requests.
+func (s *BrokerSecurity) load() (*protocol.Security, *protocol.ServerSecurity, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+
+	peer := &protocol.Security{
+		TLS:                s.TLS,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		Username:           s.Username,
+		Password:           s.Password,
+		Mechanism:          s.Mechanism,
+	}
+	for _, err := range []error{
+		readFile(s.CA, &peer.CA),
+		readFile(s.Cert, &peer.Cert),
+		readFile(s.Key, &peer.Key),
+	} {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !s.Started() {
+		return peer, nil, nil
+	}
+
+	server := &protocol.ServerSecurity{Username: s.Username, Password: s.Password}
+	for _, err := range []error{
+		readFile(s.ServerCert, &server.Cert),
+		readFile(s.ServerKey, &server.Key),
+		readFile(s.ServerCA, &server.CA),
+	} {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return peer, server, nil
+}
+
+// readFile reads the file into contents, unless file is empty.
+func readFile(file string, contents *string) error {
+	if file == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	*contents = string(pem)
+	return nil
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// killTimeout is the number of seconds added to the daemon timeout when
+// killing a session, since its broker has to be stopped.
+const killTimeout = 30
+
+// Session describes a benchmark session on a daemon.
+type Session struct {
+	ID          string    `json:"id"`
+	Broker      string    `json:"broker,omitempty"`
+	Containers  []string  `json:"containers,omitempty"`
+	Publishers  int       `json:"publishers"`
+	Subscribers int       `json:"subscribers"`
+	Created     time.Time `json:"created"`
+	Active      time.Time `json:"active"`
+}
+
+// Sessions returns the sessions on the daemon at the given host, waiting up
+// to timeout seconds for it to respond. The connection uses TLS if t isn't
+// nil, and requests are signed with the credentials if they aren't nil.
+func Sessions(host string, timeout uint, t *TLS, creds *Credentials) ([]*Session, error) {
+	return sendSessions(host, timeout, t, creds, newRequest(sessions))
+}
+
+// KillSession tears down the peers and stops the broker of a session on the
+// daemon at the given host. It returns the daemon's remaining sessions.
+func KillSession(host, id string, timeout uint, t *TLS, creds *Credentials) ([]*Session, error) {
+	return sendSessions(host, timeout+killTimeout, t, creds, request{
+		Request: protocol.Request{Operation: sessions, Kill: id},
+	})
+}
+
+func sendSessions(host string, timeout uint, t *TLS, creds *Credentials, r request) ([]*Session, error) {
+	resp, err := sendOnce(host, timeout, t, creds, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Session
+	if err := json.Unmarshal(resp.Result, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// sendOnce connects to the daemon at the given host, sends it the request and
+// returns its response, or an error if the operation failed.
+func sendOnce(host string, timeout uint, t *TLS, creds *Credentials, r request) (*response, error) {
+	tlsConfig, err := t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := dial(host, timeout, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	resp, err := sendRequest(s, r, creds)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, errors.New(resp.Message)
+	}
+	return resp, nil
+}
@@ -0,0 +1,28 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// Status returns what the daemon at the given host is doing, waiting up to
+// timeout seconds for it to respond. The connection uses TLS if t isn't nil,
+// and requests are signed with the credentials if they aren't nil.
+func Status(host string, timeout uint, t *TLS, creds *Credentials) (*protocol.StatusResult, error) {
+	resp, err := sendOnce(host, timeout, t, creds, newRequest(status))
+	if err != nil {
+		if strings.HasPrefix(err.Error(), legacyMessage) {
+			return nil, fmt.Errorf("Daemon predates the status operation: %s", err.Error())
+		}
+		return nil, err
+	}
+
+	var result protocol.StatusResult
+	if err := json.Unmarshal(resp.Result, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
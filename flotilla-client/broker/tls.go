@@ -0,0 +1,71 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// These are the schemes of the transports used to connect to daemons.
+const (
+	tcpScheme = "tcp://"
+	tlsScheme = "tls+tcp://"
+)
+
+// TLS configures TLS for the connections to the daemons.
+type TLS struct {
+	// CA is a PEM-encoded CA certificate file daemons' certificates are
+	// verified with. If empty, the system's roots are used.
+	CA string
+
+	// Cert and Key are the PEM-encoded certificate and key files presented
+	// to daemons which require mutual TLS. They're optional.
+	Cert string
+	Key  string
+}
+
+// load returns the TLS configuration shared by connections to every daemon,
+// or nil if TLS isn't configured.
+func (t *TLS) load() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, errors.New("TLS client certificate requires both a certificate and a key")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", t.CA)
+		}
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// forHost returns a copy of the TLS configuration which verifies the
+// daemon's certificate against the given host.
+func forHost(config *tls.Config, host string) *tls.Config {
+	config = config.Clone()
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		config.ServerName = name
+	} else {
+		config.ServerName = host
+	}
+	return config
+}
@@ -1,30 +1,35 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/olekukonko/tablewriter"
+	"github.com/tylertreat/Flotilla/discovery"
 	"github.com/tylertreat/Flotilla/flotilla-client/broker"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
 const (
-	defaultDaemonPort    = "9500"
-	defaultBrokerPort    = "5000"
-	defaultNumMessages   = 500000
-	defaultMessageSize   = 1000
-	defaultNumProducers  = 1
-	defaultNumConsumers  = 1
-	defaultStartupSleep  = 8
-	defaultDaemonTimeout = 5
-	defaultHost          = "localhost"
-	defaultDaemonHost    = defaultHost + ":" + defaultDaemonPort
+	defaultDaemonPort       = "9500"
+	defaultBrokerPort       = "5000"
+	defaultNumMessages      = 500000
+	defaultMessageSize      = 1000
+	defaultNumProducers     = 1
+	defaultNumConsumers     = 1
+	defaultStartupTimeout   = 120
+	defaultDaemonTimeout    = 5
+	defaultHeartbeatTimeout = 10
+	defaultHost             = "localhost"
+	defaultDaemonHost       = defaultHost + ":" + defaultDaemonPort
 )
 
 var brokers = []string{
@@ -36,38 +41,175 @@ var brokers = []string{
 	"rabbitmq",
 	"nsq",
 	"pubsub",
+	"inmem",
 }
 
 func main() {
 	var (
-		brokerName    = flag.String("broker", brokers[0], brokerList())
-		brokerPort    = flag.String("broker-port", defaultBrokerPort, "host machine broker port")
-		dockerHost    = flag.String("docker-host", defaultHost, "host machine (or VM) running Docker")
-		brokerdHost   = flag.String("host", defaultDaemonHost, "machine running broker daemon")
-		peerHosts     = flag.String("peer-hosts", defaultDaemonHost, "comma-separated list of machines to run peers")
-		producers     = flag.Uint("producers", defaultNumProducers, "number of producers per host")
-		consumers     = flag.Uint("consumers", defaultNumConsumers, "number of consumers per host")
-		numMessages   = flag.Uint("num-messages", defaultNumMessages, "number of messages to send from each producer")
-		messageSize   = flag.Uint64("message-size", defaultMessageSize, "size of each message in bytes")
-		startupSleep  = flag.Uint("startup-sleep", defaultStartupSleep, "seconds to wait after broker start before benchmarking")
-		daemonTimeout = flag.Uint("daemon-timeout", defaultDaemonTimeout, "seconds to wait for daemon before timing out")
+		brokerName     = flag.String("broker", brokers[0], brokerList())
+		brokerPort     = flag.String("broker-port", defaultBrokerPort, "host machine broker port")
+		dockerHost     = flag.String("docker-host", defaultHost, "host machine (or VM) running Docker")
+		brokerdHosts   = flag.String("host", defaultDaemonHost, "comma-separated list of machines running broker daemons, one per cluster node")
+		peerHosts      = flag.String("peer-hosts", defaultDaemonHost, "comma-separated list of machines to run peers")
+		producers      = flag.Uint("producers", defaultNumProducers, "number of producers per host")
+		consumers      = flag.Uint("consumers", defaultNumConsumers, "number of consumers per host")
+		numMessages    = flag.Uint("num-messages", defaultNumMessages, "number of messages to send from each producer")
+		messageSize    = flag.Uint64("message-size", defaultMessageSize, "size of each message in bytes")
+		startupTimeout = flag.Uint("startup-timeout", defaultStartupTimeout, "seconds to wait for the broker to become ready")
+		daemonTimeout  = flag.Uint("daemon-timeout", defaultDaemonTimeout, "seconds to wait for daemon before timing out")
+		brokerImage    = flag.String("broker-image", "", "broker image, or :tag to run a different version of the default image")
+		brokerEnv      = keyValues{}
+		brokerConfig   = keyValues{}
+		externalBroker = flag.String("external-broker", "", "comma-separated addresses of an existing broker to benchmark instead of starting one")
+		idleTimeout    = flag.Uint("idle-timeout", 0, "seconds consumers wait for a message before completing, 0 waits forever")
+		brokerFaults   = faults{}
+		peerNetem      = flag.String("peer-netem", "", "network impairment for peer hosts, e.g. delay=100ms,jitter=10ms,loss=1,rate=10000")
+		brokerNetem    = flag.String("broker-netem", "", "network impairment for broker nodes, in the same form as --peer-netem")
+		brokerCPUs     = flag.String("broker-cpuset", "", "CPUs the broker can run on, e.g. 0-3")
+		brokerMemory   = flag.String("broker-memory", "", "broker memory limit, e.g. 512m or 4g")
+		brokerBlkio    = flag.Uint("broker-blkio-weight", 0, "broker relative block IO weight (10-1000)")
+		outputDir      = flag.String("output-dir", "", "directory to write the results and broker and daemon logs to")
+		session        = flag.String("session", "", "session isolating the benchmark from others sharing the daemons (defaults to a random one)")
+		listSessions   = flag.Bool("list-sessions", false, "list the sessions on the broker and peer daemons and exit")
+		killSession    = flag.String("kill-session", "", "tear down the session's peers and stop its broker on every daemon, then exit")
+		useTLS         = flag.Bool("tls", false, "connect to the daemons with TLS (implied by the other --tls flags)")
+		tlsCA          = flag.String("tls-ca", "", "PEM CA certificate file to verify the daemons with (defaults to the system's roots)")
+		tlsCert        = flag.String("tls-cert", "", "PEM client certificate file for daemons which require mutual TLS (requires --tls-key)")
+		tlsKey         = flag.String("tls-key", "", "PEM key file for --tls-cert")
+		authToken      = flag.String("auth-token", "", "token to sign requests with for daemons which require authentication")
+		authSecret     = flag.String("auth-secret", os.Getenv("FLOTILLA_AUTH_SECRET"), "secret of --auth-token (defaults to $FLOTILLA_AUTH_SECRET)")
+		brokerTLS      = flag.Bool("broker-tls", false, "connect peers to the broker with TLS (implied by --broker-ca, --broker-cert and --broker-server-cert)")
+		brokerCA       = flag.String("broker-ca", "", "PEM CA certificate file to verify the broker with (defaults to the system's roots)")
+		brokerInsecure = flag.Bool("broker-insecure-skip-verify", false, "don't verify the broker's certificate")
+		brokerCert     = flag.String("broker-cert", "", "PEM client certificate file peers present to the broker (requires --broker-key)")
+		brokerKey      = flag.String("broker-key", "", "PEM key file for --broker-cert")
+		brokerUser     = flag.String("broker-user", "", "username peers authenticate to the broker with")
+		brokerPassword = flag.String("broker-password", os.Getenv("FLOTILLA_BROKER_PASSWORD"), "password of --broker-user (defaults to $FLOTILLA_BROKER_PASSWORD)")
+		brokerSASL     = flag.String("broker-sasl-mechanism", "", "SASL mechanism for brokers which support several, e.g. PLAIN or AMQPLAIN")
+		serverCert     = flag.String("broker-server-cert", "", "PEM certificate file to start the broker with TLS (requires --broker-server-key)")
+		serverKey      = flag.String("broker-server-key", "", "PEM key file for --broker-server-cert")
+		serverCA       = flag.String("broker-server-ca", "", "PEM CA certificate file the started broker verifies peers' certificates with")
+		progress       = flag.Bool("progress", true, "show live progress while the benchmark runs")
+		heartbeat      = flag.Uint("heartbeat-timeout", defaultHeartbeatTimeout, "seconds a daemon can miss heartbeats during the run before it's declared dead, 0 disables heartbeats")
+		discoveryURL   = flag.String("discovery", "", "backend daemons register with, file:///dir or etcd://host:2379[,host:2379][/prefix]")
+		peerSelector   = flag.String("peers", "", "run peers on the registered daemons with these labels, e.g. role=worker,zone=a, instead of --peer-hosts (requires --discovery)")
 	)
+	flag.Var(brokerEnv, "broker-env", "broker environment variable as KEY=value (can be repeated)")
+	flag.Var(brokerConfig, "broker-config", "broker configuration as key=value, e.g. num.io.threads=8 (can be repeated)")
+	flag.Var(&brokerFaults, "fault", "broker fault as action[:node]@time, e.g. kill:2@30s or restart:2@60s (can be repeated)")
+
+	// The status command takes the same flags as a benchmark.
+	statusCommand := len(os.Args) > 1 && os.Args[1] == "status"
+	if statusCommand {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
+	brokerds := strings.Split(*brokerdHosts, ",")
 	peers := strings.Split(*peerHosts, ",")
+	if *peerSelector != "" {
+		var err error
+		if peers, err = discoverPeers(*discoveryURL, *peerSelector); err != nil {
+			fmt.Println("Failed to discover peers:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Discovered peers: %s\n", strings.Join(peers, ","))
+	}
+	var tls *broker.TLS
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		tls = &broker.TLS{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey}
+	}
+	var creds *broker.Credentials
+	if *authToken != "" {
+		creds = &broker.Credentials{Token: *authToken, Secret: *authSecret}
+	}
+	var brokerSecurity *broker.BrokerSecurity
+	if *brokerTLS || *brokerCA != "" || *brokerCert != "" || *brokerUser != "" || *serverCert != "" {
+		brokerSecurity = &broker.BrokerSecurity{
+			TLS:                *brokerTLS || *brokerCA != "" || *brokerCert != "" || *serverCert != "",
+			CA:                 *brokerCA,
+			InsecureSkipVerify: *brokerInsecure,
+			Cert:               *brokerCert,
+			Key:                *brokerKey,
+			Username:           *brokerUser,
+			Password:           *brokerPassword,
+			Mechanism:          *brokerSASL,
+			ServerCert:         *serverCert,
+			ServerKey:          *serverKey,
+			ServerCA:           *serverCA,
+		}
+	}
+	if *listSessions || *killSession != "" {
+		manageSessions(append(brokerds, peers...), *killSession, *daemonTimeout, tls, creds)
+		return
+	}
+	if statusCommand {
+		// Peers are only inspected if they were asked for, since
+		// --peer-hosts defaults to the same daemon as --host.
+		hosts := brokerds
+		if *peerSelector != "" || flagSet("peer-hosts") {
+			hosts = append(hosts, peers...)
+		}
+		showStatus(hosts, *daemonTimeout, tls, creds)
+		return
+	}
+
+	peerImpairment, err := parseImpairment(*peerNetem)
+	if err != nil {
+		fmt.Println("Invalid --peer-netem:", err)
+		os.Exit(1)
+	}
+	brokerImpairment, err := parseImpairment(*brokerNetem)
+	if err != nil {
+		fmt.Println("Invalid --broker-netem:", err)
+		os.Exit(1)
+	}
+	var brokerResources *protocol.Resources
+	if *brokerCPUs != "" || *brokerMemory != "" || *brokerBlkio != 0 {
+		memory, err := parseBytes(*brokerMemory)
+		if err != nil {
+			fmt.Println("Invalid --broker-memory:", err)
+			os.Exit(1)
+		}
+		brokerResources = &protocol.Resources{
+			CpusetCpus:  *brokerCPUs,
+			Memory:      memory,
+			BlkioWeight: uint16(*brokerBlkio),
+		}
+	}
+
+	var externalBrokers []string
+	if *externalBroker != "" {
+		externalBrokers = strings.Split(*externalBroker, ",")
+	}
 
 	client, err := broker.NewClient(&broker.Benchmark{
-		BrokerdHost:   *brokerdHost,
-		BrokerName:    *brokerName,
-		BrokerHost:    *dockerHost,
-		BrokerPort:    *brokerPort,
-		PeerHosts:     peers,
-		NumMessages:   *numMessages,
-		MessageSize:   *messageSize,
-		Publishers:    *producers,
-		Subscribers:   *consumers,
-		StartupSleep:  *startupSleep,
-		DaemonTimeout: *daemonTimeout,
+		BrokerdHosts:     brokerds,
+		BrokerName:       *brokerName,
+		BrokerHost:       *dockerHost,
+		BrokerPort:       *brokerPort,
+		PeerHosts:        peers,
+		NumMessages:      *numMessages,
+		MessageSize:      *messageSize,
+		Publishers:       *producers,
+		Subscribers:      *consumers,
+		StartupTimeout:   *startupTimeout,
+		DaemonTimeout:    *daemonTimeout,
+		BrokerImage:      *brokerImage,
+		BrokerEnv:        brokerEnv,
+		BrokerConfig:     brokerConfig,
+		ExternalBrokers:  externalBrokers,
+		Faults:           brokerFaults,
+		IdleTimeout:      *idleTimeout,
+		PeerImpairment:   peerImpairment,
+		BrokerImpairment: brokerImpairment,
+		BrokerResources:  brokerResources,
+		Session:          *session,
+		TLS:              tls,
+		Credentials:      creds,
+		BrokerSecurity:   brokerSecurity,
+		Progress:         *progress,
+		HeartbeatTimeout: *heartbeat,
 	})
 	if err != nil {
 		fmt.Println("Failed to connect to flotilla:", err)
@@ -76,14 +218,43 @@ func main() {
 
 	start := time.Now()
 	results, err := runBenchmark(client)
+	elapsed := time.Since(start)
+	if *outputDir != "" {
+		if err := client.WriteBundle(*outputDir, results, err); err != nil {
+			fmt.Println("Failed to write results:", err)
+		} else {
+			fmt.Println("Results written to", *outputDir)
+		}
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	elapsed := time.Since(start)
 
-	printSummary(client.Benchmark, elapsed)
+	printSummary(client, elapsed)
 	printResults(results)
+	printDelivery(results)
+	printUsage(client, results)
+	if len(brokerFaults) > 0 {
+		printTimeline(client, results)
+	}
+}
+
+// discoverPeers returns the addresses of the daemons registered with the
+// discovery backend which match the label selector.
+func discoverPeers(backendURL, selector string) ([]string, error) {
+	if backendURL == "" {
+		return nil, errors.New("--peers requires --discovery")
+	}
+	backend, err := discovery.Open(backendURL)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := discovery.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return discovery.Select(backend, parsed)
 }
 
 func runBenchmark(client *broker.Client) ([]*broker.ResultContainer, error) {
@@ -100,16 +271,162 @@ func runBenchmark(client *broker.Client) ([]*broker.ResultContainer, error) {
 	return client.Start()
 }
 
-func printSummary(benchmark *broker.Benchmark, elapsed time.Duration) {
-	brokerHost := strings.Split(benchmark.BrokerdHost, ":")[0] + ":" + benchmark.BrokerPort
-	msgSent := int(benchmark.NumMessages) * len(benchmark.PeerHosts) * int(benchmark.Publishers)
-	msgRecv := int(benchmark.NumMessages) * len(benchmark.PeerHosts) * int(benchmark.Subscribers)
+// manageSessions lists the sessions on each of the daemons, killing the given
+// session first if it's not empty.
+func manageSessions(hosts []string, kill string, timeout uint, tls *broker.TLS, creds *broker.Credentials) {
+	seen := make(map[string]bool, len(hosts))
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Daemon", "Session", "Broker", "Producers", "Consumers", "Created", "Last Active"})
+	failed := false
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		var (
+			sessions []*broker.Session
+			err      error
+		)
+		if kill != "" {
+			sessions, err = broker.KillSession(host, kill, timeout, tls, creds)
+		} else {
+			sessions, err = broker.Sessions(host, timeout, tls, creds)
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", host, err.Error())
+			failed = true
+			continue
+		}
+
+		for _, session := range sessions {
+			table.Append([]string{
+				host,
+				session.ID,
+				session.Broker,
+				strconv.Itoa(session.Publishers),
+				strconv.Itoa(session.Subscribers),
+				session.Created.Format(time.RFC3339),
+				session.Active.Format(time.RFC3339),
+			})
+		}
+	}
+
+	table.Render()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// flagSet returns true if the flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// showStatus shows what each of the daemons is doing: its release and uptime,
+// and the broker and peers of each of its sessions.
+func showStatus(hosts []string, timeout uint, tls *broker.TLS, creds *broker.Credentials) {
+	seen := make(map[string]bool, len(hosts))
+	daemons := tablewriter.NewWriter(os.Stdout)
+	daemons.SetHeader([]string{"Daemon", "Release", "Protocol", "Uptime", "Sessions"})
+	peers := tablewriter.NewWriter(os.Stdout)
+	peers.SetHeader([]string{"Daemon", "Session", "Broker", "Containers", "Peer", "State", "Messages", "Error"})
+	failed := false
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		status, err := broker.Status(host, timeout, tls, creds)
+		if err != nil {
+			fmt.Printf("%s: %s\n", host, err.Error())
+			failed = true
+			continue
+		}
+
+		uptime := time.Duration(status.Uptime) * time.Second
+		daemons.Append([]string{
+			host,
+			status.Daemon,
+			strconv.Itoa(status.Version),
+			uptime.String(),
+			strconv.Itoa(len(status.Sessions)),
+		})
+		for _, session := range status.Sessions {
+			containers := make([]string, len(session.Containers))
+			for i, id := range session.Containers {
+				if len(id) > 12 {
+					id = id[:12]
+				}
+				containers[i] = id
+			}
+			brokerName := session.Broker
+			if brokerName == "" {
+				brokerName = "-"
+			}
+			if len(session.Peers) == 0 {
+				peers.Append([]string{host, session.ID, brokerName, strings.Join(containers, ","), "-", "-", "-", ""})
+				continue
+			}
+			for _, peer := range session.Peers {
+				peers.Append([]string{
+					host,
+					session.ID,
+					brokerName,
+					strings.Join(containers, ","),
+					fmt.Sprintf("%s %d", peer.Role, peer.ID),
+					string(peer.State),
+					fmt.Sprintf("%d/%d", peer.Messages, peer.Expected),
+					peer.Err,
+				})
+			}
+		}
+	}
+
+	daemons.Render()
+	fmt.Println()
+	peers.Render()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printSummary(client *broker.Client, elapsed time.Duration) {
+	benchmark := client.Benchmark
+	brokerHost := benchmark.BrokerAddrs()
+	if !benchmark.External() && !benchmark.Clustered() {
+		brokerHost = strings.Split(benchmark.BrokerdHosts[0], ":")[0] + ":" + benchmark.BrokerPort
+	}
+	// Excluded peers didn't contribute any results.
+	peers := len(benchmark.PeerHosts) - len(client.ExcludedPeers)
+	msgSent := int(benchmark.NumMessages) * peers * int(benchmark.Publishers)
+	msgRecv := int(benchmark.NumMessages) * peers * int(benchmark.Subscribers)
 	dataSentKB := (msgSent * int(benchmark.MessageSize)) / 1000
 	dataRecvKB := (msgRecv * int(benchmark.MessageSize)) / 1000
 	fmt.Println("\nTEST SUMMARY\n")
 	fmt.Printf("Time Elapsed:       %s\n", elapsed.String())
 	fmt.Printf("Broker:             %s (%s)\n", benchmark.BrokerName, brokerHost)
+	fmt.Printf("Session:            %s\n", benchmark.Session)
+	if client.Broker != nil {
+		for _, container := range client.Broker.Containers {
+			// Natively launched brokers don't run from an image.
+			if container.Image == "" {
+				continue
+			}
+			fmt.Printf("Broker image:       %s (%s)\n", container.Image, container.Digest)
+		}
+	}
 	fmt.Printf("Nodes:              %s\n", benchmark.PeerHosts)
+	for host, reason := range client.ExcludedPeers {
+		fmt.Printf("Excluded node:      %s (%s)\n", host, reason)
+	}
 	fmt.Printf("Producers per node: %d\n", benchmark.Publishers)
 	fmt.Printf("Consumers per node: %d\n", benchmark.Subscribers)
 	fmt.Printf("Messages produced:  %d\n", msgSent)
@@ -174,30 +491,35 @@ func printResults(results []*broker.ResultContainer) {
 	)
 	for _, peerResults := range results {
 		for _, result := range peerResults.SubscriberResults {
+			latency := result.Latency
+			if latency == nil {
+				// Subscribers which errored don't report latency.
+				latency = &protocol.LatencyResults{}
+			}
 			subDurations += result.Duration
 			subThroughputs += result.Throughput
-			subMins += result.Latency.Min
-			subQ1s += result.Latency.Q1
-			subQ2s += result.Latency.Q2
-			subQ3s += result.Latency.Q3
-			subMaxes += result.Latency.Max
-			subMeans += result.Latency.Mean
-			subIQRs += result.Latency.Q3 - result.Latency.Q1
-			subStdDevs += result.Latency.StdDev
+			subMins += latency.Min
+			subQ1s += latency.Q1
+			subQ2s += latency.Q2
+			subQ3s += latency.Q3
+			subMaxes += latency.Max
+			subMeans += latency.Mean
+			subIQRs += latency.Q3 - latency.Q1
+			subStdDevs += latency.StdDev
 			consumerData = append(consumerData, []string{
 				strconv.Itoa(i),
 				peerResults.Peer,
 				strconv.FormatBool(result.Err != ""),
 				strconv.FormatFloat(float64(result.Duration), 'f', 3, 32),
 				strconv.FormatFloat(float64(result.Throughput), 'f', 3, 32),
-				strconv.FormatInt(result.Latency.Min, 10),
-				strconv.FormatInt(result.Latency.Q1, 10),
-				strconv.FormatInt(result.Latency.Q2, 10),
-				strconv.FormatInt(result.Latency.Q3, 10),
-				strconv.FormatInt(result.Latency.Max, 10),
-				strconv.FormatFloat(result.Latency.Mean, 'f', 3, 64),
-				strconv.FormatInt(result.Latency.Q3-result.Latency.Q1, 10),
-				strconv.FormatFloat(result.Latency.StdDev, 'f', 3, 64),
+				strconv.FormatInt(latency.Min, 10),
+				strconv.FormatInt(latency.Q1, 10),
+				strconv.FormatInt(latency.Q2, 10),
+				strconv.FormatInt(latency.Q3, 10),
+				strconv.FormatInt(latency.Max, 10),
+				strconv.FormatFloat(latency.Mean, 'f', 3, 64),
+				strconv.FormatInt(latency.Q3-latency.Q1, 10),
+				strconv.FormatFloat(latency.StdDev, 'f', 3, 64),
 			})
 			i++
 		}
@@ -247,6 +569,168 @@ func printResults(results []*broker.ResultContainer) {
 	fmt.Println("All units ms unless noted otherwise")
 }
 
+func printDelivery(results []*broker.ResultContainer) {
+	var received, lost, duplicates int
+	for _, peerResults := range results {
+		for _, result := range peerResults.SubscriberResults {
+			received += result.Received
+			lost += result.Lost
+			duplicates += result.Duplicates
+		}
+	}
+	fmt.Printf("\nMessages received:  %d\n", received)
+	fmt.Printf("Messages lost:      %d\n", lost)
+	fmt.Printf("Duplicate messages: %d\n", duplicates)
+}
+
+// printUsage prints the resource usage of each daemon's host and of the broker
+// containers, along with the messages consumed per CPU-second each used.
+func printUsage(client *broker.Client, results []*broker.ResultContainer) {
+	var (
+		daemons  = map[string]map[string]*protocol.Usage{}
+		consumed = 0
+	)
+	for _, peerResults := range results {
+		daemons[peerResults.Peer] = peerResults.Usage
+		for _, result := range peerResults.SubscriberResults {
+			consumed += result.Received
+		}
+	}
+	for host, usage := range client.BrokerUsage {
+		daemons[host] = usage
+	}
+
+	hosts := make([]string, 0, len(daemons))
+	for host := range daemons {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	data := [][]string{}
+	for _, host := range hosts {
+		sources := make([]string, 0, len(daemons[host]))
+		for source := range daemons[host] {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+
+		for _, source := range sources {
+			usage := daemons[host][source]
+			if usage.Err != "" {
+				data = append(data, []string{host, source, "", "", "", "", "", "", "", "", usage.Err})
+				continue
+			}
+
+			var avgCPU, perCPUSecond float64
+			if usage.Duration > 0 {
+				avgCPU = usage.CPUSeconds / usage.Duration
+			}
+			if usage.CPUSeconds > 0 {
+				perCPUSecond = float64(consumed) / usage.CPUSeconds
+			}
+			data = append(data, []string{
+				host,
+				source,
+				strconv.FormatFloat(usage.CPUSeconds, 'f', 3, 64),
+				strconv.FormatFloat(avgCPU, 'f', 3, 64),
+				strconv.FormatFloat(perCPUSecond, 'f', 3, 64),
+				megabytes(usage.MaxMemory),
+				megabytes(usage.NetRx),
+				megabytes(usage.NetTx),
+				megabytes(usage.DiskRead),
+				megabytes(usage.DiskWrite),
+				"",
+			})
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	fmt.Println("")
+	printTable([]string{
+		"Daemon",
+		"Source",
+		"CPU-seconds",
+		"Avg CPUs",
+		"Msg/CPU-second",
+		"Max memory (MB)",
+		"Net in (MB)",
+		"Net out (MB)",
+		"Disk read (MB)",
+		"Disk written (MB)",
+		"Error",
+	}, data)
+}
+
+func megabytes(bytes uint64) string {
+	return strconv.FormatFloat(float64(bytes)/(1<<20), 'f', 3, 64)
+}
+
+// printTimeline prints the messages consumed by all consumers during each
+// second of the run, alongside the faults injected into the broker.
+func printTimeline(client *broker.Client, results []*broker.ResultContainer) {
+	var (
+		start     = client.RunStarted.Unix()
+		intervals = map[int64]*protocol.Interval{}
+		last      = int64(0)
+	)
+	for _, peerResults := range results {
+		for _, result := range peerResults.SubscriberResults {
+			for _, interval := range result.Timeline {
+				second := interval.Time - start
+				total, ok := intervals[second]
+				if !ok {
+					total = &protocol.Interval{Time: second}
+					intervals[second] = total
+				}
+				messages := total.Messages + interval.Messages
+				total.MeanLatency = (total.MeanLatency*float64(total.Messages) +
+					interval.MeanLatency*float64(interval.Messages)) / float64(messages)
+				total.Messages = messages
+				if interval.MaxLatency > total.MaxLatency {
+					total.MaxLatency = interval.MaxLatency
+				}
+				if second > last {
+					last = second
+				}
+			}
+		}
+	}
+
+	faults := map[int64][]string{}
+	for _, f := range client.Benchmark.Faults {
+		second := int64(f.At / time.Second)
+		faults[second] = append(faults[second], fmt.Sprintf("%s node %d", f.Action, f.Node))
+		if second > last {
+			last = second
+		}
+	}
+
+	data := [][]string{}
+	for second := int64(0); second <= last; second++ {
+		total, ok := intervals[second]
+		if !ok {
+			total = &protocol.Interval{}
+		}
+		data = append(data, []string{
+			strconv.FormatInt(second, 10),
+			strconv.Itoa(total.Messages),
+			strconv.FormatFloat(total.MeanLatency, 'f', 3, 64),
+			strconv.FormatInt(total.MaxLatency, 10),
+			strings.Join(faults[second], ", "),
+		})
+	}
+	fmt.Println("")
+	printTable([]string{
+		"Second",
+		"Messages consumed",
+		"Mean latency",
+		"Max latency",
+		"Fault",
+	}, data)
+}
+
 func printTable(headers []string, data [][]string) {
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader(headers)
@@ -268,3 +752,124 @@ func brokerList() string {
 	brokerList = brokerList + "]"
 	return brokerList
 }
+
+// keyValues is a flag.Value which collects repeated key=value flags.
+type keyValues map[string]string
+
+func (k keyValues) String() string {
+	pairs := make([]string, 0, len(k))
+	for key, value := range k {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (k keyValues) Set(value string) error {
+	keyValue := strings.SplitN(value, "=", 2)
+	if len(keyValue) != 2 || keyValue[0] == "" {
+		return fmt.Errorf("expected key=value, got %s", value)
+	}
+	k[keyValue[0]] = keyValue[1]
+	return nil
+}
+
+// faults is a flag.Value which collects repeated broker faults in the form
+// action[:node]@time.
+type faults []*broker.Fault
+
+func (f *faults) String() string {
+	specs := make([]string, len(*f))
+	for i, fault := range *f {
+		specs[i] = fmt.Sprintf("%s:%d@%s", fault.Action, fault.Node, fault.At)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *faults) Set(value string) error {
+	spec := strings.SplitN(value, "@", 2)
+	if len(spec) != 2 {
+		return fmt.Errorf("expected action[:node]@time, got %s", value)
+	}
+
+	at, err := time.ParseDuration(spec[1])
+	if err != nil {
+		return err
+	}
+
+	fault := &broker.Fault{At: at, Action: spec[0]}
+	if actionNode := strings.SplitN(spec[0], ":", 2); len(actionNode) == 2 {
+		fault.Action = actionNode[0]
+		if fault.Node, err = strconv.Atoi(actionNode[1]); err != nil {
+			return fmt.Errorf("invalid node in %s", value)
+		}
+	}
+
+	*f = append(*f, fault)
+	return nil
+}
+
+// parseImpairment parses a network impairment in the form key=value,... where
+// the keys are delay and jitter (durations), loss (percent), rate (kbit/s) and
+// device. It returns nil if the spec is empty.
+func parseImpairment(spec string) (*broker.Impairment, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	impairment := &broker.Impairment{}
+	for _, pair := range strings.Split(spec, ",") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %s", pair)
+		}
+
+		var err error
+		switch value := keyValue[1]; keyValue[0] {
+		case "delay":
+			impairment.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			impairment.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			impairment.Loss, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		case "rate":
+			var rate uint64
+			rate, err = strconv.ParseUint(value, 10, 32)
+			impairment.Rate = uint(rate)
+		case "device":
+			impairment.Device = value
+		default:
+			err = fmt.Errorf("unknown key %s", keyValue[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return impairment, nil
+}
+
+// parseBytes parses a size such as 512m or 4g into bytes. The suffixes k, m
+// and g are powers of 1024. It returns zero if the size is empty.
+func parseBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch strings.ToLower(size[len(size)-1:]) {
+	case "k":
+		multiplier = 1 << 10
+	case "m":
+		multiplier = 1 << 20
+	case "g":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
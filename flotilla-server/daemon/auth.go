@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+const (
+	// authKey is the key of the authentication block in the request JSON.
+	authKey = "auth"
+
+	// authWindow is how far a request's timestamp can be from the daemon's
+	// clock, which limits how long a captured request can be replayed.
+	authWindow = 5 * time.Minute
+
+	// allOperations permits a token to perform every operation.
+	allOperations = "*"
+)
+
+// Token is a credential permitted to perform some of the daemon's operations.
+type Token struct {
+	// Secret is the key requests are signed with.
+	Secret string `json:"secret"`
+
+	// Operations contains the operations the token may perform, such as
+	// "subscribers" or "start", or "*" for all of them.
+	Operations []string `json:"operations"`
+}
+
+// permits returns true if the token may perform the operation. Every token
+// may perform hello, which clients send before anything else, and heartbeat,
+// which clients send while benchmarks run.
+func (t *Token) permits(op protocol.Operation) bool {
+	if op == protocol.Hello || op == protocol.Heartbeat {
+		return true
+	}
+	for _, permitted := range t.Operations {
+		if permitted == allOperations || protocol.Operation(permitted) == op {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadTokens reads tokens from a JSON file mapping token names to their
+// secrets and permitted operations.
+func LoadTokens(file string) (map[string]*Token, error) {
+	tokensJSON, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens map[string]*Token
+	if err := json.Unmarshal(tokensJSON, &tokens); err != nil {
+		return nil, err
+	}
+	for name, token := range tokens {
+		if token == nil || token.Secret == "" {
+			return nil, fmt.Errorf("Token %s has no secret", name)
+		}
+	}
+	return tokens, nil
+}
+
+// auth authenticates a request. Signature is the hex-encoded HMAC-SHA256,
+// keyed with the token's secret, of the Unix timestamp in seconds, a newline
+// and the request JSON without the auth block and with its keys sorted.
+type auth struct {
+	Token     string `json:"token"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// authenticate verifies the signature of the raw request and that its token
+// may perform the operation. Every request is allowed if the daemon has no
+// tokens.
+func (d *Daemon) authenticate(msg []byte, op protocol.Operation) error {
+	if len(d.config.Tokens) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return err
+	}
+	authJSON, ok := fields[authKey]
+	if !ok {
+		return errors.New("Request is not authenticated")
+	}
+	var a auth
+	if err := json.Unmarshal(authJSON, &a); err != nil {
+		return err
+	}
+
+	delete(fields, authKey)
+	signed, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return d.verify(&a, signed, op)
+}
+
+// verify checks that the auth block is a recent signature of the signed data
+// by a known token which may perform the operation.
+func (d *Daemon) verify(a *auth, signed []byte, op protocol.Operation) error {
+	token, ok := d.config.Tokens[a.Token]
+	if !ok {
+		return fmt.Errorf("Unknown token %s", a.Token)
+	}
+
+	skew := time.Since(time.Unix(a.Timestamp, 0))
+	if skew > authWindow || skew < -authWindow {
+		return fmt.Errorf("Request timestamp is %s from the daemon's clock", skew)
+	}
+
+	signature, err := hex.DecodeString(a.Signature)
+	if err != nil || !hmac.Equal(signature, sign(token.Secret, a.Timestamp, signed)) {
+		return fmt.Errorf("Invalid signature for token %s", a.Token)
+	}
+
+	if !token.permits(op) {
+		return fmt.Errorf("Token %s is not permitted to perform %s", a.Token, op)
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 of the timestamp and the request JSON.
+func sign(secret string, timestamp int64, request []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "\n"))
+	mac.Write(request)
+	return mac.Sum(nil)
+}
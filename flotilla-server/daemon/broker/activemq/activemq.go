@@ -1,6 +1,11 @@
 package activemq
 
-import "gopkg.in/stomp.v1"
+import (
+	"crypto/tls"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"gopkg.in/stomp.v1"
+)
 
 const queue = "test"
 
@@ -13,9 +18,29 @@ type Peer struct {
 	done   chan bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with ActiveMQ.
-func NewPeer(host string) (*Peer, error) {
-	conn, err := stomp.Dial("tcp", host, stomp.Options{})
+// NewPeer creates and returns a new Peer for communicating with ActiveMQ. If
+// multiple comma-separated hosts are provided, the first reachable one is used.
+// The security settings are optional.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := security.SASLMechanism("ActiveMQ"); err != nil {
+		return nil, err
+	}
+	var options stomp.Options
+	if security.Credentials() {
+		options.Login = security.Username
+		options.Passcode = security.Password
+	}
+
+	var conn *stomp.Conn
+	for _, addr := range broker.Hosts(host) {
+		if conn, err = dial(addr, tlsConfig, options); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +53,24 @@ func NewPeer(host string) (*Peer, error) {
 	}, nil
 }
 
+// dial connects to the broker, over TLS if there's a configuration for it.
+func dial(addr string, tlsConfig *tls.Config, options stomp.Options) (*stomp.Conn, error) {
+	if tlsConfig == nil {
+		return stomp.Dial("tcp", addr, options)
+	}
+
+	netConn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := stomp.Connect(netConn, options)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
 // Subscribe prepares the peer to consume messages.
 func (a *Peer) Subscribe() error {
 	sub, err := a.conn.Subscribe(queue, stomp.AckAuto)
@@ -3,7 +3,10 @@ package activemq
 import (
 	"fmt"
 	"log"
-	"os/exec"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"gopkg.in/stomp.v1"
 )
 
 const (
@@ -13,32 +16,63 @@ const (
 
 // Broker implements the broker interface for ActiveMQ.
 type Broker struct {
+	Docker      *docker.Client
 	containerID string
+	host        string
+	port        string
 }
 
 // Start will start the message broker and prepare it for testing.
-func (a *Broker) Start(host, port string) (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker run -d -p %s:%s %s", port, internalPort, activeMQ)).Output()
+func (a *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := options.ConfigUnsupported("ActiveMQ"); err != nil {
+		return "", err
+	}
+	if err := options.ClusterUnsupported("ActiveMQ"); err != nil {
+		return "", err
+	}
+	if err := options.SecurityUnsupported("ActiveMQ"); err != nil {
+		return "", err
+	}
+
+	container, err := a.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(activeMQ),
+		Env:       options.EnvList(),
+		Resources: options.Limits(),
+		Ports:     map[string]string{internalPort: port},
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", activeMQ, err.Error())
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", activeMQ, containerID)
-	a.containerID = string(containerID)
-	return string(containerID), nil
+	log.Printf("Started container %s: %s", container.Image, container.ID)
+	a.containerID = container.ID
+	a.host = host
+	a.port = port
+	return []*docker.Container{container}, nil
 }
 
 // Stop will stop the message broker.
 func (a *Broker) Stop() (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker kill %s", a.containerID)).Output()
-	if err != nil {
+	if err := a.Docker.Remove(a.containerID); err != nil {
 		log.Printf("Failed to stop container %s: %s", activeMQ, err.Error())
 		return "", err
 	}
 
 	log.Printf("Stopped container %s: %s", activeMQ, a.containerID)
-	return string(containerID), nil
+	return a.containerID, nil
+}
+
+// Container returns the ID of the container running the broker node.
+func (a *Broker) Container() string {
+	return a.containerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (a *Broker) Ready() error {
+	conn, err := stomp.Dial("tcp", fmt.Sprintf("%s:%s", a.host, a.port), stomp.Options{})
+	if err != nil {
+		return err
+	}
+	return conn.Disconnect()
 }
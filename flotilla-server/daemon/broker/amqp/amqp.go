@@ -1,6 +1,8 @@
 package amqp
 
 import (
+	"strings"
+
 	"github.com/streadway/amqp"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
@@ -21,8 +23,20 @@ type Peer struct {
 }
 
 // NewPeer creates and returns a new Peer for communicating with AMQP brokers.
-func NewPeer(host string) (*Peer, error) {
-	conn, err := amqp.Dial("amqp://" + host)
+// If multiple comma-separated hosts are provided, the first reachable one is
+// used. The security settings are optional.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	config, scheme, err := dialConfig(security)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *amqp.Connection
+	for _, addr := range broker.Hosts(host) {
+		if conn, err = amqp.DialConfig(scheme+addr, config); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -146,3 +160,34 @@ func (a *Peer) Teardown() {
 	a.channel.Close()
 	a.conn.Close()
 }
+
+// dialConfig returns the connection configuration and URL scheme for the
+// security settings. Without credentials, the broker's default guest account
+// is used.
+func dialConfig(security *broker.Security) (amqp.Config, string, error) {
+	var config amqp.Config
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return config, "", err
+	}
+	scheme := "amqp://"
+	if tlsConfig != nil {
+		config.TLSClientConfig = tlsConfig
+		scheme = "amqps://"
+	}
+
+	if !security.Credentials() {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: "guest", Password: "guest"}}
+		return config, scheme, nil
+	}
+	mechanism, err := security.SASLMechanism("AMQP", "PLAIN", "AMQPLAIN")
+	if err != nil {
+		return config, "", err
+	}
+	if strings.EqualFold(mechanism, "AMQPLAIN") {
+		config.SASL = []amqp.Authentication{&amqp.AMQPlainAuth{Username: security.Username, Password: security.Password}}
+	} else {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: security.Username, Password: security.Password}}
+	}
+	return config, scheme, nil
+}
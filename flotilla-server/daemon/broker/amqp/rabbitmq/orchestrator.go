@@ -3,42 +3,205 @@ package rabbitmq
 import (
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/streadway/amqp"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
 const (
 	rabbitMQ     = "dockerfile/rabbitmq"
 	internalPort = "5672"
+	epmdPort     = "4369"
+	distPort     = "25672"
+	nodePrefix   = "flotilla-rabbit-"
+)
+
+var (
+	// configKeyPattern and configValuePattern match the rabbit application
+	// parameters and Erlang terms which can be passed as configuration
+	// overrides. The arguments are split on whitespace by RabbitMQ's scripts,
+	// so values can't contain any, or characters a shell would expand.
+	configKeyPattern   = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
+	configValuePattern = regexp.MustCompile(`^[a-zA-Z0-9_.,:{}\[\]<>"-]+$`)
 )
 
 // Broker implements the Broker interface for RabbitMQ.
 type Broker struct {
+	Docker      *docker.Client
 	containerID string
+	host        string
+	port        string
+	joinNode    string
 }
 
 // Start will start the message broker and prepare it for testing.
-func (r *Broker) Start(host, port string) (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker run -d -p %s:%s %s", port, internalPort, rabbitMQ)).Output()
+func (r *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := r.Validate(options); err != nil {
+		return "", err
+	}
+
+	config := &docker.Config{
+		Image:     options.ImageFor(rabbitMQ),
+		Env:       env(options),
+		Resources: options.Limits(),
+		Ports:     map[string]string{internalPort: port},
+	}
+
+	// Clustered nodes find each other by hostname, so every node's hostname
+	// is mapped to its host, where the Erlang distribution ports are
+	// published.
+	if options.Clustered() {
+		extraHosts, err := clusterHosts(options.Cluster)
+		if err != nil {
+			return "", err
+		}
+		config.Hostname = nodeName(options.Cluster.Node)
+		config.ExtraHosts = extraHosts
+		config.Env = append(config.Env, "RABBITMQ_ERLANG_COOKIE="+options.Cluster.Secret)
+		config.Ports[epmdPort] = epmdPort
+		config.Ports[distPort] = distPort
+		if options.Cluster.Node > 0 {
+			r.joinNode = "rabbit@" + nodeName(0)
+		}
+	}
+
+	container, err := r.Docker.Run(config)
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", rabbitMQ, err.Error())
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", rabbitMQ, containerID)
-	r.containerID = string(containerID)
-	return string(containerID), nil
+	log.Printf("Started container %s: %s", container.Image, container.ID)
+	r.containerID = container.ID
+	r.host = host
+	r.port = port
+	return []*docker.Container{container}, nil
+}
+
+func nodeName(node int) string {
+	return nodePrefix + strconv.Itoa(node)
+}
+
+// clusterHosts returns the /etc/hosts entries mapping each node's hostname to
+// the IP of its host.
+func clusterHosts(cluster *protocol.Cluster) ([]string, error) {
+	hosts := make([]string, len(cluster.Nodes))
+	for i, node := range cluster.Nodes {
+		ip := node
+		if net.ParseIP(node) == nil {
+			addrs, err := net.LookupHost(node)
+			if err != nil {
+				return nil, err
+			}
+			ip = addrs[0]
+		}
+		hosts[i] = nodeName(i) + ":" + ip
+	}
+	return hosts, nil
+}
+
+// Validate returns an error if the broker can't be started with the options.
+func (r *Broker) Validate(options *broker.Options) error {
+	if err := options.SecurityUnsupported("RabbitMQ"); err != nil {
+		return err
+	}
+	if options == nil {
+		return nil
+	}
+	for key, value := range options.Config {
+		if !configKeyPattern.MatchString(key) {
+			return fmt.Errorf("Invalid RabbitMQ config key %q", key)
+		}
+		if !configValuePattern.MatchString(value) {
+			return fmt.Errorf("Invalid RabbitMQ config value %q for %s", value, key)
+		}
+	}
+	return nil
+}
+
+// env returns the environment variables for the RabbitMQ container.
+// Configuration overrides, such as vm_memory_high_watermark, are passed to the
+// rabbit application as additional Erlang arguments.
+func env(options *broker.Options) []string {
+	env := options.EnvList()
+	if options == nil || len(options.Config) == 0 {
+		return env
+	}
+
+	keys := make([]string, 0, len(options.Config))
+	for key := range options.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = fmt.Sprintf("-rabbit %s %s", key, options.Config[key])
+	}
+	return append(env, "RABBITMQ_SERVER_ADDITIONAL_ERL_ARGS="+strings.Join(args, " "))
 }
 
 // Stop will stop the message broker.
 func (r *Broker) Stop() (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker kill %s", r.containerID)).Output()
-	if err != nil {
+	if err := r.Docker.Remove(r.containerID); err != nil {
 		log.Printf("Failed to stop container %s: %s", rabbitMQ, err.Error())
 		return "", err
 	}
 
 	log.Printf("Stopped container %s: %s", rabbitMQ, r.containerID)
-	return string(containerID), nil
+	return r.containerID, nil
+}
+
+// Container returns the ID of the container running the broker node.
+func (r *Broker) Container() string {
+	return r.containerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+// Clustered nodes other than the first join the cluster once they're running.
+func (r *Broker) Ready() error {
+	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s", r.host, r.port))
+	if err != nil {
+		return err
+	}
+	if err := conn.Close(); err != nil {
+		return err
+	}
+
+	if r.joinNode == "" {
+		return nil
+	}
+	if err := r.join(); err != nil {
+		return err
+	}
+	log.Printf("Joined RabbitMQ cluster at %s", r.joinNode)
+	r.joinNode = ""
+	return nil
+}
+
+// join adds the node to the cluster using rabbitmqctl, which requires the
+// rabbit application to be stopped while joining. Once stopped, the
+// application is started again even if the node fails to join, so Ready can
+// retry.
+func (r *Broker) join() (err error) {
+	if _, err := r.Docker.Exec(r.containerID, []string{"rabbitmqctl", "stop_app"}); err != nil {
+		return err
+	}
+	defer func() {
+		if _, startErr := r.Docker.Exec(r.containerID, []string{"rabbitmqctl", "start_app"}); startErr != nil && err == nil {
+			err = startErr
+		}
+	}()
+
+	if _, err := r.Docker.Exec(r.containerID, []string{"rabbitmqctl", "join_cluster", r.joinNode}); err != nil {
+		return fmt.Errorf("Failed to join RabbitMQ cluster at %s: %s", r.joinNode, err.Error())
+	}
+	return nil
 }
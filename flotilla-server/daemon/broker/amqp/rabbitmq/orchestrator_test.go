@@ -0,0 +1,39 @@
+package rabbitmq
+
+import (
+	"testing"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []*broker.Options{
+		nil,
+		{Config: map[string]string{"vm_memory_high_watermark": "0.6"}},
+		{Config: map[string]string{"disk_free_limit": `{mem_relative,1.5}`, "loopback_users": "[]"}},
+		{Config: map[string]string{"default_user": `<<"guest">>`}},
+	}
+	invalid := map[string]map[string]string{
+		"value with space":   {"vm_memory_high_watermark": "0.6 -eval halt()"},
+		"value with tab":     {"vm_memory_high_watermark": "0.6\t-s"},
+		"value with newline": {"vm_memory_high_watermark": "0.6\n"},
+		"empty value":        {"vm_memory_high_watermark": ""},
+		"value with glob":    {"vm_memory_high_watermark": "*"},
+		"value with shell":   {"vm_memory_high_watermark": "$(id)"},
+		"value with quote":   {"vm_memory_high_watermark": "'0.6'"},
+		"key with dash":      {"-eval": "halt()"},
+		"uppercase key":      {"Key": "1"},
+	}
+
+	r := &Broker{}
+	for _, options := range valid {
+		if err := r.Validate(options); err != nil {
+			t.Errorf("Expected %+v to be valid, got %s", options, err)
+		}
+	}
+	for name, config := range invalid {
+		if err := r.Validate(&broker.Options{Config: config}); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
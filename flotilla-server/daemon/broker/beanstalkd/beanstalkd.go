@@ -1,9 +1,11 @@
 package beanstalkd
 
 import (
+	"crypto/tls"
 	"time"
 
 	"github.com/kr/beanstalk"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
 
 // Peer implements the peer interface for Beanstalkd.
@@ -15,9 +17,25 @@ type Peer struct {
 	done     chan bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with Beanstalkd.
-func NewPeer(host string) (*Peer, error) {
-	conn, err := beanstalk.Dial("tcp", host)
+// NewPeer creates and returns a new Peer for communicating with Beanstalkd. If
+// multiple comma-separated hosts are provided, the first reachable one is used.
+// Beanstalkd has no authentication, but it can be reached over TLS through a
+// terminating proxy, so only TLS security settings are supported.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	if err := security.CredentialsUnsupported("Beanstalkd"); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *beanstalk.Conn
+	for _, addr := range broker.Hosts(host) {
+		if conn, err = dial(addr, tlsConfig); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -31,6 +49,19 @@ func NewPeer(host string) (*Peer, error) {
 	}, nil
 }
 
+// dial connects to the broker, over TLS if there's a configuration for it.
+func dial(addr string, tlsConfig *tls.Config) (*beanstalk.Conn, error) {
+	if tlsConfig == nil {
+		return beanstalk.Dial("tcp", addr)
+	}
+
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return beanstalk.NewConn(conn), nil
+}
+
 // Subscribe prepares the peer to consume messages.
 func (b *Peer) Subscribe() error {
 	go func() {
@@ -0,0 +1,76 @@
+package beanstalkd
+
+import (
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/native"
+)
+
+const beanstalkdBinary = "beanstalkd"
+
+// nativeAllowed is empty since beanstalkd has no environment variables or
+// configuration worth overriding.
+var nativeAllowed = &native.Allowed{}
+
+// NativeBroker implements the broker interface for a beanstalkd server run as
+// a process on the daemon's host.
+type NativeBroker struct {
+	Launcher *native.Launcher
+	process  *native.Process
+	host     string
+	port     string
+}
+
+// Start will start the message broker and prepare it for testing.
+func (b *NativeBroker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := b.Validate(options); err != nil {
+		return "", err
+	}
+
+	process, err := b.Launcher.Start(beanstalkdBinary, []string{"-l", "0.0.0.0", "-p", port}, options.EnvList())
+	if err != nil {
+		return "", err
+	}
+
+	b.process = process
+	b.host = host
+	b.port = port
+	return []*native.Process{process}, nil
+}
+
+// Validate returns an error if the broker can't be started natively with the
+// options.
+func (b *NativeBroker) Validate(options *broker.Options) error {
+	if err := options.ConfigUnsupported("beanstalkd"); err != nil {
+		return err
+	}
+	if err := options.ClusterUnsupported("beanstalkd"); err != nil {
+		return err
+	}
+	if err := options.SecurityUnsupported("beanstalkd"); err != nil {
+		return err
+	}
+	return nativeAllowed.Validate("beanstalkd", options)
+}
+
+// Stop will stop the message broker.
+func (b *NativeBroker) Stop() (interface{}, error) {
+	if b.process == nil {
+		return "", nil
+	}
+	pid := b.process.Pid
+	err := b.process.Stop()
+	b.process = nil
+	return pid, err
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (b *NativeBroker) Ready() error {
+	return native.Ready(func() error {
+		return ready(b.host, b.port)
+	}, b.process)
+}
+
+// Logs returns the output of the broker process.
+func (b *NativeBroker) Logs() map[string]string {
+	return native.Logs(b.process)
+}
@@ -3,7 +3,10 @@ package beanstalkd
 import (
 	"fmt"
 	"log"
-	"os/exec"
+
+	"github.com/kr/beanstalk"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
 )
 
 const (
@@ -13,32 +16,72 @@ const (
 
 // Broker implements the broker interface for Beanstalkd.
 type Broker struct {
+	Docker      *docker.Client
 	containerID string
+	host        string
+	port        string
 }
 
 // Start will start the message broker and prepare it for testing.
-func (b *Broker) Start(host, port string) (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker run -d -p %s:%s %s", port, internalPort, beanstalkd)).Output()
+func (b *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := options.ConfigUnsupported("Beanstalkd"); err != nil {
+		return "", err
+	}
+	if err := options.ClusterUnsupported("Beanstalkd"); err != nil {
+		return "", err
+	}
+	if err := options.SecurityUnsupported("Beanstalkd"); err != nil {
+		return "", err
+	}
+
+	container, err := b.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(beanstalkd),
+		Env:       options.EnvList(),
+		Resources: options.Limits(),
+		Ports:     map[string]string{internalPort: port},
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", beanstalkd, err.Error())
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", beanstalkd, containerID)
-	b.containerID = string(containerID)
-	return string(containerID), nil
+	log.Printf("Started container %s: %s", container.Image, container.ID)
+	b.containerID = container.ID
+	b.host = host
+	b.port = port
+	return []*docker.Container{container}, nil
 }
 
 // Stop will stop the message broker.
 func (b *Broker) Stop() (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker kill %s", b.containerID)).Output()
-	if err != nil {
+	if err := b.Docker.Remove(b.containerID); err != nil {
 		log.Printf("Failed to stop container %s: %s", beanstalkd, err.Error())
 		return "", err
 	}
 
 	log.Printf("Stopped container %s: %s", beanstalkd, b.containerID)
-	return string(containerID), nil
+	return b.containerID, nil
+}
+
+// Container returns the ID of the container running the broker node.
+func (b *Broker) Container() string {
+	return b.containerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (b *Broker) Ready() error {
+	return ready(b.host, b.port)
+}
+
+// ready returns an error if the server on the given host and port isn't ready
+// for testing.
+func ready(host, port string) error {
+	conn, err := beanstalk.Dial("tcp", fmt.Sprintf("%s:%s", host, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ListTubes()
+	return err
 }
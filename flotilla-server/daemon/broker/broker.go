@@ -1,6 +1,14 @@
 package broker
 
-import "crypto/rand"
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"github.com/tylertreat/Flotilla/protocol"
+)
 
 // GenerateName returns a randomly generated, 32-byte alphanumeric name. This
 // is useful for cases where multiple clients which need to subscribe to a
@@ -14,3 +22,134 @@ func GenerateName() string {
 	}
 	return string(bytes)
 }
+
+// Hosts splits a comma-separated list of broker addresses. Peers are given a
+// list when a broker has several nodes, such as a cluster or an existing
+// deployment with multiple bootstrap addresses.
+func Hosts(host string) []string {
+	hosts := strings.Split(host, ",")
+	for i, h := range hosts {
+		hosts[i] = strings.TrimSpace(h)
+	}
+	return hosts
+}
+
+// Options contains settings which override a broker's defaults when it's
+// started. It's the protocol's BrokerOptions, with the methods brokers use to
+// apply them.
+type Options protocol.BrokerOptions
+
+// Clustered returns true if the broker should be started as one node of a
+// multi-node cluster.
+func (o *Options) Clustered() bool {
+	return o != nil && o.Cluster != nil && len(o.Cluster.Nodes) > 1
+}
+
+// Node returns the index of the node to start, which is zero for brokers that
+// aren't clustered.
+func (o *Options) Node() int {
+	if !o.Clustered() {
+		return 0
+	}
+	return o.Cluster.Node
+}
+
+// Seed returns the host of the first node in the cluster, or the given host if
+// the broker isn't clustered.
+func (o *Options) Seed(host string) string {
+	if !o.Clustered() {
+		return host
+	}
+	return o.Cluster.Nodes[0]
+}
+
+// ImageFor returns the image to run in place of the given default image.
+func (o *Options) ImageFor(image string) string {
+	if o == nil || o.Image == "" {
+		return image
+	}
+	if !strings.HasPrefix(o.Image, ":") {
+		return o.Image
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + o.Image
+}
+
+// Limits returns the resource limits for the broker node's container, or nil
+// if it's unconstrained.
+func (o *Options) Limits() *docker.Resources {
+	if o == nil {
+		return nil
+	}
+	return (*docker.Resources)(o.Resources)
+}
+
+// EnvList returns the environment variables in the form KEY=value, sorted by
+// key.
+func (o *Options) EnvList() []string {
+	if o == nil {
+		return nil
+	}
+	return join(o.Env, "", "=")
+}
+
+// ConfigFlags returns the configuration as command-line flags in the form
+// --key=value, sorted by key.
+func (o *Options) ConfigFlags() []string {
+	if o == nil {
+		return nil
+	}
+	return join(o.Config, "--", "=")
+}
+
+// ConfigUnsupported returns an error if configuration overrides were provided.
+// It's used by brokers which have no way of applying them.
+func (o *Options) ConfigUnsupported(broker string) error {
+	if o != nil && len(o.Config) > 0 {
+		return fmt.Errorf("Configuration overrides are not supported for %s", broker)
+	}
+	return nil
+}
+
+// ClusterUnsupported returns an error if a multi-node cluster was requested.
+// It's used by brokers which can't be clustered.
+func (o *Options) ClusterUnsupported(broker string) error {
+	if o.Clustered() {
+		return fmt.Errorf("Clustering is not supported for %s", broker)
+	}
+	return nil
+}
+
+// Unsupported returns an error if any overrides were provided. It's used by
+// brokers which aren't run in containers.
+func (o *Options) Unsupported(broker string) error {
+	if o != nil && (o.Image != "" || len(o.Env) > 0) {
+		return fmt.Errorf("Image and environment overrides are not supported for %s", broker)
+	}
+	if o != nil && o.Resources != nil {
+		return fmt.Errorf("Resource limits are not supported for %s", broker)
+	}
+	if err := o.SecurityUnsupported(broker); err != nil {
+		return err
+	}
+	if err := o.ClusterUnsupported(broker); err != nil {
+		return err
+	}
+	return o.ConfigUnsupported(broker)
+}
+
+func join(m map[string]string, prefix, sep string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	joined := make([]string, len(keys))
+	for i, key := range keys {
+		joined[i] = prefix + key + sep + m[key]
+	}
+	return joined
+}
@@ -0,0 +1,106 @@
+package inmem
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+)
+
+// delivery is a message in flight to a subscriber.
+type delivery struct {
+	message   []byte
+	deliverAt time.Time
+}
+
+// Peer implements the peer interface for the in-memory broker.
+type Peer struct {
+	broker   *Broker
+	messages chan *delivery
+	send     chan []byte
+	errors   chan error
+	done     chan bool
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// NewPeer creates and returns a new Peer for communicating with the in-memory
+// broker running on the given host. The broker must be running in the same
+// process, so the security settings must be empty.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	if err := security.Unsupported("the in-memory broker"); err != nil {
+		return nil, err
+	}
+	b, err := lookup(broker.Hosts(host)[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Peer{
+		broker:   b,
+		messages: make(chan *delivery, 10000),
+		send:     make(chan []byte),
+		errors:   make(chan error, 1),
+		done:     make(chan bool),
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+// Subscribe prepares the peer to consume messages.
+func (i *Peer) Subscribe() error {
+	return i.broker.subscribe(i)
+}
+
+// Recv returns a single message consumed by the peer. Subscribe must be called
+// before this. It returns an error if the receive failed.
+func (i *Peer) Recv() ([]byte, error) {
+	select {
+	case d := <-i.messages:
+		if wait := d.deliverAt.Sub(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+		return d.message, nil
+	case <-i.broker.done:
+		return nil, errBrokerStopped
+	}
+}
+
+// Send returns a channel on which messages can be sent for publishing.
+func (i *Peer) Send() chan<- []byte {
+	return i.send
+}
+
+// Errors returns the channel on which the peer sends publish errors.
+func (i *Peer) Errors() <-chan error {
+	return i.errors
+}
+
+// Done signals to the peer that message publishing has completed.
+func (i *Peer) Done() {
+	i.done <- true
+}
+
+// Setup prepares the peer for testing.
+func (i *Peer) Setup() {
+	go func() {
+		for {
+			select {
+			case msg := <-i.send:
+				if err := i.broker.publish(msg); err != nil {
+					i.errors <- err
+				}
+			case <-i.done:
+				return
+			}
+		}
+	}()
+}
+
+// Teardown performs any cleanup logic that needs to be performed after the
+// test is complete.
+func (i *Peer) Teardown() {
+	i.once.Do(func() {
+		close(i.closed)
+	})
+	i.broker.unsubscribe(i)
+}
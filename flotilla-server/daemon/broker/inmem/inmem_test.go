@@ -0,0 +1,135 @@
+package inmem
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func startBroker(t *testing.T, port string) *Broker {
+	b := &Broker{}
+	if _, err := b.Start("localhost", port, nil); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	return b
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := startBroker(t, "9001")
+	defer b.Stop()
+
+	subscribers := make([]*Peer, 2)
+	for i := range subscribers {
+		s, err := NewPeer("localhost:9001", nil)
+		if err != nil {
+			t.Fatalf("NewPeer failed: %s", err)
+		}
+		if err := s.Subscribe(); err != nil {
+			t.Fatalf("Subscribe failed: %s", err)
+		}
+		defer s.Teardown()
+		subscribers[i] = s
+	}
+
+	publisher, err := NewPeer("localhost:9001", nil)
+	if err != nil {
+		t.Fatalf("NewPeer failed: %s", err)
+	}
+	publisher.Setup()
+	defer publisher.Teardown()
+
+	const numMessages = 100
+	for i := 0; i < numMessages; i++ {
+		publisher.Send() <- []byte(fmt.Sprintf("%08d", i))
+	}
+	publisher.Done()
+
+	for n, s := range subscribers {
+		for i := 0; i < numMessages; i++ {
+			msg, err := s.Recv()
+			if err != nil {
+				t.Fatalf("Subscriber %d: Recv failed: %s", n, err)
+			}
+			if expected := fmt.Sprintf("%08d", i); string(msg) != expected {
+				t.Fatalf("Subscriber %d: expected %q, got %q", n, expected, msg)
+			}
+		}
+	}
+
+	select {
+	case err := <-publisher.Errors():
+		t.Fatalf("Unexpected publish error: %s", err)
+	default:
+	}
+}
+
+func TestLatency(t *testing.T) {
+	b := startBroker(t, "9002")
+	b.Latency = 50 * time.Millisecond
+	defer b.Stop()
+
+	s, err := NewPeer("localhost:9002", nil)
+	if err != nil {
+		t.Fatalf("NewPeer failed: %s", err)
+	}
+	if err := s.Subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	defer s.Teardown()
+
+	start := time.Now()
+	if err := b.publish([]byte("hello")); err != nil {
+		t.Fatalf("publish failed: %s", err)
+	}
+	if _, err := s.Recv(); err != nil {
+		t.Fatalf("Recv failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < b.Latency {
+		t.Fatalf("Expected message to be delayed by %s, got %s", b.Latency, elapsed)
+	}
+}
+
+func TestStop(t *testing.T) {
+	b := startBroker(t, "9003")
+
+	s, err := NewPeer("localhost:9003", nil)
+	if err != nil {
+		t.Fatalf("NewPeer failed: %s", err)
+	}
+	if err := s.Subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+
+	if _, err := b.Stop(); err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+	// Stopping again must not panic.
+	if _, err := b.Stop(); err != nil {
+		t.Fatalf("Second Stop failed: %s", err)
+	}
+
+	if _, err := s.Recv(); err != errBrokerStopped {
+		t.Fatalf("Expected %q from Recv, got %v", errBrokerStopped, err)
+	}
+	if err := b.Ready(); err != errBrokerStopped {
+		t.Fatalf("Expected %q from Ready, got %v", errBrokerStopped, err)
+	}
+	if _, err := NewPeer("localhost:9003", nil); err == nil {
+		t.Fatal("Expected NewPeer to fail after Stop")
+	}
+
+	// The address is free to start another broker on.
+	startBroker(t, "9003").Stop()
+}
+
+func TestStartTwice(t *testing.T) {
+	b := startBroker(t, "9004")
+	defer b.Stop()
+
+	if _, err := (&Broker{}).Start("localhost", "9004", nil); err == nil {
+		t.Fatal("Expected starting a second broker on the same address to fail")
+	}
+	if _, err := (&Broker{Loss: 2}).Start("localhost", "9005", nil); err == nil {
+		t.Fatal("Expected invalid loss to fail")
+	}
+}
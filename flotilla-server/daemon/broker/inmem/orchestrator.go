@@ -0,0 +1,153 @@
+package inmem
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+)
+
+var errBrokerStopped = errors.New("Broker stopped")
+
+// brokers contains the in-memory brokers running in this process, keyed by
+// the address peers use to reach them.
+var (
+	brokers   = make(map[string]*Broker)
+	brokersMu sync.Mutex
+)
+
+// Broker implements the broker interface for an in-memory broker which fans
+// messages out to subscribers over channels inside the daemon process. It
+// requires no external services, which makes it useful for local testing and
+// CI.
+type Broker struct {
+	// Latency is the delay added to every message before it's delivered.
+	Latency time.Duration
+
+	// Loss is the probability, between 0 and 1, that a published message is
+	// dropped.
+	Loss float64
+
+	addr        string
+	subscribers map[*Peer]bool
+	done        chan struct{}
+	stop        sync.Once
+	mu          sync.RWMutex
+}
+
+// Start will start the message broker and prepare it for testing.
+func (b *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := options.Unsupported("the in-memory broker"); err != nil {
+		return "", err
+	}
+
+	if b.Loss < 0 || b.Loss > 1 {
+		return "", fmt.Errorf("Invalid loss %f", b.Loss)
+	}
+
+	addr := fmt.Sprintf("%s:%s", host, port)
+	brokersMu.Lock()
+	defer brokersMu.Unlock()
+	if _, ok := brokers[addr]; ok {
+		return "", fmt.Errorf("Broker already running on %s", addr)
+	}
+
+	b.addr = addr
+	b.subscribers = make(map[*Peer]bool)
+	b.done = make(chan struct{})
+	brokers[addr] = b
+
+	log.Printf("Started in-memory broker on %s", addr)
+	return addr, nil
+}
+
+// Stop will stop the message broker. Stopping it again has no effect.
+func (b *Broker) Stop() (interface{}, error) {
+	b.stop.Do(func() {
+		brokersMu.Lock()
+		delete(brokers, b.addr)
+		brokersMu.Unlock()
+
+		close(b.done)
+		b.mu.Lock()
+		b.subscribers = make(map[*Peer]bool)
+		b.mu.Unlock()
+
+		log.Printf("Stopped in-memory broker on %s", b.addr)
+	})
+	return b.addr, nil
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (b *Broker) Ready() error {
+	select {
+	case <-b.done:
+		return errBrokerStopped
+	default:
+		return nil
+	}
+}
+
+func (b *Broker) subscribe(p *Peer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+		return errBrokerStopped
+	default:
+	}
+	b.subscribers[p] = true
+	return nil
+}
+
+func (b *Broker) unsubscribe(p *Peer) {
+	b.mu.Lock()
+	delete(b.subscribers, p)
+	b.mu.Unlock()
+}
+
+// publish fans the message out to every subscriber unless it's randomly
+// dropped. Subscribers share the message, so it must not be modified
+// afterwards.
+func (b *Broker) publish(message []byte) error {
+	select {
+	case <-b.done:
+		return errBrokerStopped
+	default:
+	}
+
+	if b.Loss > 0 && rand.Float64() < b.Loss {
+		return nil
+	}
+
+	d := &delivery{
+		message:   message,
+		deliverAt: time.Now().Add(b.Latency),
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber.messages <- d:
+		case <-subscriber.closed:
+		case <-b.done:
+			return errBrokerStopped
+		}
+	}
+	return nil
+}
+
+func lookup(addr string) (*Broker, error) {
+	brokersMu.Lock()
+	defer brokersMu.Unlock()
+	b, ok := brokers[addr]
+	if !ok {
+		return nil, fmt.Errorf("No in-memory broker running on %s", addr)
+	}
+	return b, nil
+}
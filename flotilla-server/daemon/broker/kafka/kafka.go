@@ -1,9 +1,8 @@
 package kafka
 
 import (
-	"strings"
-
 	"github.com/Shopify/sarama"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
 
 const topic = "test"
@@ -18,21 +17,26 @@ type Peer struct {
 	done     chan bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with Kafka.
-func NewPeer(host string) (*Peer, error) {
-	host = strings.Split(host, ":")[0] + ":9092"
+// NewPeer creates and returns a new Peer for communicating with Kafka. If
+// multiple comma-separated hosts are provided, they are used as bootstrap
+// brokers. The security settings are optional.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	hosts := broker.Hosts(host)
 	config := sarama.NewConfig()
-	client, err := sarama.NewClient([]string{host}, config)
+	if err := secure(config, security); err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(hosts, config)
 	if err != nil {
 		return nil, err
 	}
 
-	producer, err := sarama.NewAsyncProducer([]string{host}, config)
+	producer, err := sarama.NewAsyncProducer(hosts, config)
 	if err != nil {
 		return nil, err
 	}
 
-	consumer, err := sarama.NewConsumer([]string{host}, config)
+	consumer, err := sarama.NewConsumer(hosts, config)
 	if err != nil {
 		return nil, err
 	}
@@ -52,6 +56,29 @@ func NewPeer(host string) (*Peer, error) {
 	}, nil
 }
 
+// secure applies the security settings to the client configuration. Only
+// SASL/PLAIN is supported.
+func secure(config *sarama.Config, security *broker.Security) error {
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if security.Credentials() {
+		if _, err := security.SASLMechanism("Kafka", "PLAIN"); err != nil {
+			return err
+		}
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = security.Username
+		config.Net.SASL.Password = security.Password
+	}
+	return nil
+}
+
 // Subscribe prepares the peer to consume messages.
 func (k *Peer) Subscribe() error {
 	return nil
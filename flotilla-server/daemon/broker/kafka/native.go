@@ -0,0 +1,260 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/native"
+)
+
+const (
+	// kafkaHome is the Launcher path of the Kafka installation directory,
+	// which contains the bin directory with Kafka's scripts.
+	kafkaHome           = "kafka"
+	zookeeperProperties = "zookeeper.properties"
+	serverProperties    = "server.properties"
+
+	// controllerPort is the port KRaft controllers listen on.
+	controllerPort = "9093"
+)
+
+// nativeAllowed contains the environment variables and broker properties
+// native Kafka accepts. Kafka's scripts load code from variables such as
+// KAFKA_OPTS and JAVA_HOME, and properties such as log.dirs and the ssl ones
+// name files, so only heap sizes and tuning properties are allowed.
+var nativeAllowed = &native.Allowed{
+	Env: map[string]*regexp.Regexp{
+		"KAFKA_HEAP_OPTS": regexp.MustCompile(`^-Xm[sx][0-9]+[kKmMgG]?( -Xm[sx][0-9]+[kKmMgG]?)?$`),
+	},
+	Config: map[string]*regexp.Regexp{
+		"num.io.threads":                   native.Number,
+		"num.network.threads":              native.Number,
+		"num.partitions":                   native.Number,
+		"num.replica.fetchers":             native.Number,
+		"default.replication.factor":       native.Number,
+		"min.insync.replicas":              native.Number,
+		"offsets.topic.replication.factor": native.Number,
+		"message.max.bytes":                native.Number,
+		"replica.fetch.max.bytes":          native.Number,
+		"socket.send.buffer.bytes":         native.Number,
+		"socket.receive.buffer.bytes":      native.Number,
+		"socket.request.max.bytes":         native.Number,
+		"log.segment.bytes":                native.Number,
+		"log.retention.bytes":              native.Number,
+		"log.retention.hours":              native.Number,
+		"log.flush.interval.messages":      native.Number,
+		"log.flush.interval.ms":            native.Number,
+		"compression.type":                 native.Word,
+		"auto.create.topics.enable":        native.Bool,
+		"unclean.leader.election.enable":   native.Bool,
+	},
+}
+
+// NativeBroker implements the broker interface for Kafka and ZooKeeper run as
+// processes on the daemon's host using the scripts in a Kafka installation.
+type NativeBroker struct {
+	Launcher  *native.Launcher
+	zookeeper *native.Process
+	kafka     *native.Process
+	host      string
+	port      string
+}
+
+// Start will start the message broker and prepare it for testing. Kafka runs
+// with ZooKeeper if the installation still ships ZooKeeper's scripts, which
+// were removed in Kafka 4.0, and in KRaft mode otherwise.
+func (k *NativeBroker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if port == zookeeperPort || port == controllerPort {
+		return nil, fmt.Errorf("Port %s is reserved", port)
+	}
+	if err := k.Validate(options); err != nil {
+		return "", err
+	}
+
+	var (
+		processes []*native.Process
+		kafka     *native.Process
+		err       error
+	)
+	if _, statErr := os.Stat(k.script("zookeeper-server-start.sh")); statErr == nil {
+		// In a cluster, ZooKeeper only runs alongside the first node.
+		if options.Node() == 0 {
+			zookeeper, err := k.startScript("zookeeper-server-start.sh", zookeeperProperties,
+				func(dir string) []string {
+					return []string{
+						"dataDir=" + filepath.Join(dir, "zookeeper"),
+						"clientPort=" + zookeeperPort,
+					}
+				}, nil, nil)
+			if err != nil {
+				return "", err
+			}
+			k.zookeeper = zookeeper
+			processes = append(processes, zookeeper)
+		}
+
+		kafka, err = k.startScript("kafka-server-start.sh", serverProperties,
+			func(dir string) []string {
+				return append([]string{
+					"broker.id=" + strconv.Itoa(options.Node()),
+					"listeners=PLAINTEXT://:" + port,
+					"advertised.listeners=PLAINTEXT://" + net.JoinHostPort(host, port),
+					"log.dirs=" + filepath.Join(dir, "kafka-logs"),
+					"zookeeper.connect=" + options.Seed(host) + ":" + zookeeperPort,
+				}, configProperties(options)...)
+			}, nil, options.EnvList())
+	} else {
+		// Every node is both a broker and a controller, and formats its
+		// storage with the cluster ID before its first start.
+		kafka, err = k.startScript("kafka-server-start.sh", serverProperties,
+			func(dir string) []string {
+				return append([]string{
+					"process.roles=broker,controller",
+					"node.id=" + strconv.Itoa(options.Node()),
+					"listeners=PLAINTEXT://:" + port + ",CONTROLLER://:" + controllerPort,
+					"advertised.listeners=PLAINTEXT://" + net.JoinHostPort(host, port),
+					"listener.security.protocol.map=PLAINTEXT:PLAINTEXT,CONTROLLER:PLAINTEXT",
+					"controller.listener.names=CONTROLLER",
+					"inter.broker.listener.name=PLAINTEXT",
+					"controller.quorum.voters=" + quorumVoters(host, options),
+					"log.dirs=" + filepath.Join(dir, "kafka-logs"),
+				}, configProperties(options)...)
+			}, func(dir string) error {
+				return k.format(dir, clusterID(host, options), options.EnvList())
+			}, options.EnvList())
+	}
+	if err != nil {
+		k.Stop()
+		return "", err
+	}
+
+	k.kafka = kafka
+	k.host = host
+	k.port = port
+	return append(processes, kafka), nil
+}
+
+// script returns the path of the named script in the Kafka installation.
+func (k *NativeBroker) script(name string) string {
+	return filepath.Join(k.Launcher.Path(kafkaHome), "bin", name)
+}
+
+// startScript writes the properties for a new working directory to a file in
+// it, calls prepare with the directory if it's not nil, and runs the Kafka
+// script with the file.
+func (k *NativeBroker) startScript(script, file string, properties func(string) []string,
+	prepare func(string) error, env []string) (*native.Process, error) {
+
+	dir, err := k.Launcher.WorkDir(script)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := native.WriteFile(dir, file, properties(dir)); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if prepare != nil {
+		if err := prepare(dir); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	return k.Launcher.StartIn(dir, k.script(script), []string{filepath.Join(dir, file)}, env)
+}
+
+// format formats the KRaft storage configured by the server properties in the
+// working directory, which Kafka requires before its first start.
+func (k *NativeBroker) format(dir, clusterID string, env []string) error {
+	cmd := exec.Command(k.script("kafka-storage.sh"), "format",
+		"-t", clusterID, "-c", filepath.Join(dir, serverProperties))
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to format Kafka storage: %s: %s", err, output)
+	}
+	return nil
+}
+
+// quorumVoters returns the KRaft controller quorum, which is every node in a
+// cluster.
+func quorumVoters(host string, options *broker.Options) string {
+	if !options.Clustered() {
+		return "0@" + net.JoinHostPort(host, controllerPort)
+	}
+
+	voters := make([]string, len(options.Cluster.Nodes))
+	for i, node := range options.Cluster.Nodes {
+		voters[i] = strconv.Itoa(i) + "@" + net.JoinHostPort(node, controllerPort)
+	}
+	return strings.Join(voters, ",")
+}
+
+// clusterID returns the KRaft cluster ID, a base64-encoded UUID. Every node
+// must be formatted with the same ID, so it's derived from the cluster's
+// nodes.
+func clusterID(host string, options *broker.Options) string {
+	nodes := []string{host}
+	if options.Clustered() {
+		nodes = options.Cluster.Nodes
+	}
+	sum := sha256.Sum256([]byte(strings.Join(nodes, ",")))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// configProperties returns the configuration overrides as properties, sorted
+// by key.
+func configProperties(options *broker.Options) []string {
+	if options == nil {
+		return nil
+	}
+
+	properties := make([]string, 0, len(options.Config))
+	for key, value := range options.Config {
+		properties = append(properties, key+"="+value)
+	}
+	sort.Strings(properties)
+	return properties
+}
+
+// Validate returns an error if the broker can't be started natively with the
+// options.
+func (k *NativeBroker) Validate(options *broker.Options) error {
+	if err := options.SecurityUnsupported("Kafka"); err != nil {
+		return err
+	}
+	return nativeAllowed.Validate("Kafka", options)
+}
+
+// Stop will stop the message broker.
+func (k *NativeBroker) Stop() (interface{}, error) {
+	err := native.Stop(k.zookeeper, k.kafka)
+	k.zookeeper = nil
+	k.kafka = nil
+	return "", err
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+// Leader election can take a while, so Kafka is ready once the test topic has
+// a partition leader.
+func (k *NativeBroker) Ready() error {
+	return native.Ready(func() error {
+		return ready(k.host, k.port)
+	}, k.zookeeper, k.kafka)
+}
+
+// Logs returns the output of the broker processes.
+func (k *NativeBroker) Logs() map[string]string {
+	return native.Logs(k.zookeeper, k.kafka)
+}
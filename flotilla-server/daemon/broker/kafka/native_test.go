@@ -0,0 +1,35 @@
+package kafka
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+func TestQuorumVoters(t *testing.T) {
+	if voters := quorumVoters("10.0.0.1", nil); voters != "0@10.0.0.1:9093" {
+		t.Errorf("Expected a single voter, got %s", voters)
+	}
+
+	options := &broker.Options{Cluster: &protocol.Cluster{Nodes: []string{"a", "::1"}, Node: 1}}
+	if voters := quorumVoters("::1", options); voters != "0@a:9093,1@[::1]:9093" {
+		t.Errorf("Expected every node to vote, got %s", voters)
+	}
+}
+
+func TestClusterID(t *testing.T) {
+	nodes := []string{"a", "b", "c"}
+	first := clusterID("a", &broker.Options{Cluster: &protocol.Cluster{Nodes: nodes}})
+	last := clusterID("c", &broker.Options{Cluster: &protocol.Cluster{Nodes: nodes, Node: 2}})
+	if first != last {
+		t.Errorf("Expected nodes to share a cluster ID, got %s and %s", first, last)
+	}
+	if id, err := base64.RawURLEncoding.DecodeString(first); err != nil || len(id) != 16 {
+		t.Errorf("Expected a base64-encoded UUID, got %s", first)
+	}
+	if clusterID("a", nil) == clusterID("b", nil) {
+		t.Error("Expected hosts to have different cluster IDs")
+	}
+}
@@ -3,81 +3,147 @@ package kafka
 import (
 	"fmt"
 	"log"
-	"os/exec"
-	"time"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
 )
 
 const (
 	zookeeper     = "jplock/zookeeper:3.4.6"
-	zookeeperCmd  = "docker run -d -p %s:%s %s"
 	zookeeperPort = "2181"
 	kafka         = "ches/kafka"
 	kafkaPort     = "9092"
 	jmxPort       = "7203"
-	// TODO: Use --link.
-	kafkaCmd = `docker run -d \
-	                     -h %s \
-	                     -p %s:%s -p %s:%s \
-	                     -e EXPOSED_HOST=%s \
-						 -e ZOOKEEPER_IP=%s %s`
 )
 
 // Broker implements the broker interface for Kafka.
 type Broker struct {
+	Docker               *docker.Client
 	kafkaContainerID     string
 	zookeeperContainerID string
+	host                 string
+	port                 string
 }
 
 // Start will start the message broker and prepare it for testing.
-func (k *Broker) Start(host, port string) (interface{}, error) {
+func (k *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
 	if port == zookeeperPort || port == jmxPort {
 		return nil, fmt.Errorf("Port %s is reserved", port)
 	}
-
-	cmd := fmt.Sprintf(zookeeperCmd, zookeeperPort, zookeeperPort, zookeeper)
-	zkContainerID, err := exec.Command("/bin/sh", "-c", cmd).Output()
-	if err != nil {
-		log.Printf("Failed to start container %s: %s", zookeeper, err.Error())
+	if err := options.SecurityUnsupported("Kafka"); err != nil {
 		return "", err
 	}
-	log.Printf("Started container %s: %s", zookeeper, zkContainerID)
 
-	cmd = fmt.Sprintf(kafkaCmd, host, kafkaPort, kafkaPort, jmxPort, jmxPort, host, host, kafka)
-	kafkaContainerID, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	// In a cluster, ZooKeeper only runs alongside the first node.
+	var containers []*docker.Container
+	if options.Node() == 0 {
+		zkContainer, err := k.Docker.Run(&docker.Config{
+			Image: zookeeper,
+			Ports: map[string]string{zookeeperPort: zookeeperPort},
+		})
+		if err != nil {
+			log.Printf("Failed to start container %s: %s", zookeeper, err.Error())
+			return "", err
+		}
+		log.Printf("Started container %s: %s", zookeeper, zkContainer.ID)
+		k.zookeeperContainerID = zkContainer.ID
+		containers = append(containers, zkContainer)
+	}
+
+	// TODO: Use --link.
+	env := append([]string{
+		"BROKER_ID=" + strconv.Itoa(options.Node()),
+		"EXPOSED_HOST=" + host,
+		"EXPOSED_PORT=" + port,
+		"ZOOKEEPER_IP=" + options.Seed(host),
+	}, configEnv(options)...)
+	kafkaContainer, err := k.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(kafka),
+		Hostname:  host,
+		Env:       append(env, options.EnvList()...),
+		Resources: options.Limits(),
+		Ports:     map[string]string{kafkaPort: port, jmxPort: jmxPort},
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", kafka, err.Error())
 		k.Stop()
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", kafka, kafkaContainerID)
-	k.kafkaContainerID = string(kafkaContainerID)
-	k.zookeeperContainerID = string(zkContainerID)
+	log.Printf("Started container %s: %s", kafkaContainer.Image, kafkaContainer.ID)
+	k.kafkaContainerID = kafkaContainer.ID
+	k.host = host
+	k.port = port
+	return append(containers, kafkaContainer), nil
+}
 
-	// NOTE: Leader election can take a while. For now, just sleep to try to
-	// ensure the cluster is ready. Is there a way to avoid this or make it
-	// better?
-	time.Sleep(time.Minute)
+// configEnv returns the configuration overrides as environment variables,
+// following the convention that num.io.threads is set by
+// KAFKA_NUM_IO_THREADS.
+func configEnv(options *broker.Options) []string {
+	if options == nil {
+		return nil
+	}
 
-	return string(kafkaContainerID), nil
+	env := make([]string, 0, len(options.Config))
+	for key, value := range options.Config {
+		name := "KAFKA_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
 }
 
 // Stop will stop the message broker.
 func (k *Broker) Stop() (interface{}, error) {
-	_, err := exec.Command("/bin/sh", "-c", fmt.Sprintf("docker kill %s", k.zookeeperContainerID)).Output()
-	if err != nil {
-		log.Printf("Failed to stop container %s: %s", zookeeper, err.Error())
-	} else {
-		log.Printf("Stopped container %s: %s", zookeeper, k.zookeeperContainerID)
+	var err error
+	if k.zookeeperContainerID != "" {
+		if err = k.Docker.Remove(k.zookeeperContainerID); err != nil {
+			log.Printf("Failed to stop container %s: %s", zookeeper, err.Error())
+		} else {
+			log.Printf("Stopped container %s: %s", zookeeper, k.zookeeperContainerID)
+		}
 	}
 
-	kafkaContainerID, e := exec.Command("/bin/sh", "-c", fmt.Sprintf("docker kill %s", k.kafkaContainerID)).Output()
-	if e != nil {
-		log.Printf("Failed to stop container %s: %s", kafka, err.Error())
+	if k.kafkaContainerID == "" {
+		return "", err
+	}
+
+	if e := k.Docker.Remove(k.kafkaContainerID); e != nil {
+		log.Printf("Failed to stop container %s: %s", kafka, e.Error())
 		err = e
 	} else {
 		log.Printf("Stopped container %s: %s", kafka, k.kafkaContainerID)
 	}
 
-	return string(kafkaContainerID), err
+	return k.kafkaContainerID, err
+}
+
+// Container returns the ID of the container running the broker node.
+func (k *Broker) Container() string {
+	return k.kafkaContainerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+// Leader election can take a while, so Kafka is ready once the test topic has
+// a partition leader.
+func (k *Broker) Ready() error {
+	return ready(k.host, k.port)
+}
+
+// ready returns an error if the test topic has no partition leader according
+// to the broker on the given host and port.
+func ready(host, port string) error {
+	client, err := sarama.NewClient([]string{host + ":" + port}, sarama.NewConfig())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Leader(topic, 0)
+	return err
 }
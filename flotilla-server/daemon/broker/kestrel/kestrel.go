@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/alindeman/go-kestrel"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
 
 const (
@@ -27,8 +28,39 @@ type Peer struct {
 	subscriber bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with Kestrel.
-func NewPeer(host string) (*Peer, error) {
+// NewPeer creates and returns a new Peer for communicating with Kestrel. If
+// multiple comma-separated hosts are provided, the first reachable one is used.
+// Kestrel supports neither TLS nor authentication, so the security settings
+// must be empty.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	if err := security.Unsupported("Kestrel"); err != nil {
+		return nil, err
+	}
+
+	var (
+		client *kestrel.Client
+		err    error
+	)
+	for _, addr := range broker.Hosts(host) {
+		if client, err = connect(addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Peer{
+		client:   client,
+		messages: make(chan []byte, 10000),
+		send:     make(chan []byte),
+		errors:   make(chan error, 1),
+		done:     make(chan bool),
+		flush:    make(chan bool),
+	}, nil
+}
+
+func connect(host string) (*kestrel.Client, error) {
 	addrAndPort := strings.Split(host, ":")
 	if len(addrAndPort) < 2 {
 		return nil, fmt.Errorf("Invalid host: %s", host)
@@ -44,15 +76,7 @@ func NewPeer(host string) (*Peer, error) {
 		client.Close()
 		return nil, err
 	}
-
-	return &Peer{
-		client:   client,
-		messages: make(chan []byte, 10000),
-		send:     make(chan []byte),
-		errors:   make(chan error, 1),
-		done:     make(chan bool),
-		flush:    make(chan bool),
-	}, nil
+	return client, nil
 }
 
 // Subscribe prepares the peer to consume messages.
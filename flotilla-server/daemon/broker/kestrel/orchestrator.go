@@ -1,9 +1,12 @@
 package kestrel
 
 import (
-	"fmt"
 	"log"
-	"os/exec"
+	"strconv"
+
+	"github.com/alindeman/go-kestrel"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
 )
 
 const (
@@ -13,32 +16,68 @@ const (
 
 // Broker implements the broker interface for Kestrel.
 type Broker struct {
+	Docker      *docker.Client
 	containerID string
+	host        string
+	port        string
 }
 
 // Start will start the message broker and prepare it for testing.
-func (k *Broker) Start(host, port string) (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker run -d -p %s:%s %s", port, internalPort, kestrelImage)).Output()
+func (k *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := options.ConfigUnsupported("Kestrel"); err != nil {
+		return "", err
+	}
+	if err := options.ClusterUnsupported("Kestrel"); err != nil {
+		return "", err
+	}
+	if err := options.SecurityUnsupported("Kestrel"); err != nil {
+		return "", err
+	}
+
+	container, err := k.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(kestrelImage),
+		Env:       options.EnvList(),
+		Resources: options.Limits(),
+		Ports:     map[string]string{internalPort: port},
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", kestrelImage, err.Error())
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", kestrelImage, containerID)
-	k.containerID = string(containerID)
-	return string(containerID), nil
+	log.Printf("Started container %s: %s", container.Image, container.ID)
+	k.containerID = container.ID
+	k.host = host
+	k.port = port
+	return []*docker.Container{container}, nil
 }
 
 // Stop will stop the message broker.
 func (k *Broker) Stop() (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker kill %s", k.containerID)).Output()
-	if err != nil {
+	if err := k.Docker.Remove(k.containerID); err != nil {
 		log.Printf("Failed to stop container %s: %s", kestrelImage, err.Error())
 		return "", err
 	}
 
 	log.Printf("Stopped container %s: %s", kestrelImage, k.containerID)
-	return string(containerID), nil
+	return k.containerID, nil
+}
+
+// Container returns the ID of the container running the broker node.
+func (k *Broker) Container() string {
+	return k.containerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (k *Broker) Ready() error {
+	port, err := strconv.Atoi(k.port)
+	if err != nil {
+		return err
+	}
+
+	// Peers flush the queues when they connect, so this has no side effects
+	// on the test.
+	client := kestrel.NewClient(k.host, port)
+	defer client.Close()
+	return client.FlushAllQueues()
 }
@@ -0,0 +1,279 @@
+// Package native launches brokers as processes on the daemon's host rather
+// than in Docker containers. This is useful on hosts which can't run Docker
+// and avoids the overhead of container networking. Each process runs in its
+// own working directory, which holds its configuration files, data and
+// output.
+package native
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+)
+
+const (
+	logFile     = "output.log"
+	stopTimeout = 10 * time.Second
+)
+
+// These patterns are used to check the values of allowed environment
+// variables and configuration. None of them match a path.
+var (
+	// Number matches non-negative integers.
+	Number = regexp.MustCompile(`^[0-9]+$`)
+
+	// Bool matches true and false.
+	Bool = regexp.MustCompile(`^(true|false)$`)
+
+	// Word matches values such as durations, sizes and log levels.
+	Word = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// GoEnv contains the environment variables which tune the Go runtime, for
+// brokers written in Go.
+var GoEnv = map[string]*regexp.Regexp{
+	"GOMAXPROCS": Number,
+	"GOGC":       Word,
+}
+
+// Launcher starts broker binaries as child processes of the daemon.
+type Launcher struct {
+	// Paths maps binaries, such as "nats-server", to their paths. Binaries
+	// without a path are looked up in PATH.
+	Paths map[string]string
+
+	// Dir is where working directories are created, the system's temporary
+	// directory if empty.
+	Dir string
+}
+
+// Path returns the path of the named binary.
+func (l *Launcher) Path(name string) string {
+	if path, ok := l.Paths[name]; ok {
+		return path
+	}
+	return name
+}
+
+// Start runs the named binary with the given arguments and extra environment
+// variables in a new working directory. The process and any children it
+// starts are placed in their own process group so they can be stopped
+// together.
+func (l *Launcher) Start(name string, args, env []string) (*Process, error) {
+	dir, err := l.WorkDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return l.StartIn(dir, name, args, env)
+}
+
+// StartIn is like Start but runs the binary in the given working directory,
+// which must exist. This allows configuration files to be written before the
+// process is started.
+func (l *Launcher) StartIn(dir, name string, args, env []string) (*Process, error) {
+	output, err := os.Create(filepath.Join(dir, logFile))
+	if err != nil {
+		return nil, err
+	}
+
+	path := l.Path(name)
+	cmd := exec.Command(path, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		output.Close()
+		return nil, err
+	}
+
+	p := &Process{
+		Name: name,
+		Path: path,
+		Pid:  cmd.Process.Pid,
+		Dir:  dir,
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		output.Close()
+		close(p.done)
+	}()
+
+	log.Printf("Started %s (pid %d) in %s", path, p.Pid, dir)
+	return p, nil
+}
+
+// WorkDir creates and returns a new working directory for the named binary.
+func (l *Launcher) WorkDir(name string) (string, error) {
+	return ioutil.TempDir(l.Dir, "flotilla-"+filepath.Base(name)+"-")
+}
+
+// Process is a broker process started by a Launcher.
+type Process struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Pid  int    `json:"pid"`
+	Dir  string `json:"dir"`
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// Exited returns an error if the process has exited, which it shouldn't
+// while the broker is running.
+func (p *Process) Exited() error {
+	select {
+	case <-p.done:
+		if p.err != nil {
+			return fmt.Errorf("%s exited: %s", p.Name, p.err.Error())
+		}
+		return fmt.Errorf("%s exited", p.Name)
+	default:
+		return nil
+	}
+}
+
+// Output returns everything the process has written to stdout and stderr.
+func (p *Process) Output() (string, error) {
+	output, err := ioutil.ReadFile(filepath.Join(p.Dir, logFile))
+	return string(output), err
+}
+
+// Stop terminates the process group, killing it if it doesn't exit within
+// a few seconds, and removes the working directory.
+func (p *Process) Stop() error {
+	if p.Exited() == nil {
+		syscall.Kill(-p.Pid, syscall.SIGTERM)
+		select {
+		case <-p.done:
+		case <-time.After(stopTimeout):
+			log.Printf("%s (pid %d) didn't exit, killing it", p.Name, p.Pid)
+			syscall.Kill(-p.Pid, syscall.SIGKILL)
+			<-p.done
+		}
+	}
+
+	log.Printf("Stopped %s (pid %d)", p.Name, p.Pid)
+	return os.RemoveAll(p.Dir)
+}
+
+// Allowed contains the environment variables and configuration keys a native
+// broker accepts, mapped to the pattern their values must match. Unlike a
+// container, the process runs on the daemon's host, so nothing which names a
+// file or loads code, such as LD_PRELOAD, KAFKA_OPTS or a log path, may be
+// allowed.
+type Allowed struct {
+	Env    map[string]*regexp.Regexp
+	Config map[string]*regexp.Regexp
+}
+
+// Validate returns an error if the Options contain overrides which only apply
+// to containers, or environment variables or configuration which aren't
+// allowed.
+func (a *Allowed) Validate(name string, options *broker.Options) error {
+	if err := Unsupported(name, options); err != nil {
+		return err
+	}
+	if options == nil {
+		return nil
+	}
+	if err := allowed(name, "Environment variable", options.Env, a.Env); err != nil {
+		return err
+	}
+	return allowed(name, "Configuration key", options.Config, a.Config)
+}
+
+func allowed(name, kind string, values map[string]string, patterns map[string]*regexp.Regexp) error {
+	for key, value := range values {
+		pattern, ok := patterns[key]
+		if !ok {
+			return fmt.Errorf("%s %s is not allowed for native %s", kind, key, name)
+		}
+		if !pattern.MatchString(value) {
+			return fmt.Errorf("Invalid value %q for %s", value, key)
+		}
+	}
+	return nil
+}
+
+// Unsupported returns an error if the Options contain overrides which only
+// apply to containers.
+func Unsupported(name string, options *broker.Options) error {
+	if options == nil {
+		return nil
+	}
+	if options.Image != "" {
+		return fmt.Errorf("Image overrides are not supported for native %s", name)
+	}
+	if options.Resources != nil {
+		return fmt.Errorf("Resource limits are not supported for native %s", name)
+	}
+	return nil
+}
+
+// Ready returns an error if any of the processes has exited, otherwise the
+// result of the probe.
+func Ready(probe func() error, processes ...*Process) error {
+	for _, p := range processes {
+		if p == nil {
+			continue
+		}
+		if err := p.Exited(); err != nil {
+			return err
+		}
+	}
+	return probe()
+}
+
+// Stop stops the processes in reverse order, returning the first error
+// encountered.
+func Stop(processes ...*Process) error {
+	var err error
+	for i := len(processes) - 1; i >= 0; i-- {
+		if processes[i] == nil {
+			continue
+		}
+		if e := processes[i].Stop(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Logs returns the output of each process keyed by name.
+func Logs(processes ...*Process) map[string]string {
+	logs := make(map[string]string, len(processes))
+	for _, p := range processes {
+		if p == nil {
+			continue
+		}
+		output, err := p.Output()
+		if err != nil {
+			output += fmt.Sprintf("\n[flotilla] failed to read output: %s\n", err.Error())
+		}
+		logs[filepath.Base(p.Name)+"-"+strconv.Itoa(p.Pid)] = output
+	}
+	return logs
+}
+
+// WriteFile writes the lines to the named file in the directory.
+func WriteFile(dir, name string, lines []string) error {
+	var contents []byte
+	for _, line := range lines {
+		contents = append(contents, line...)
+		contents = append(contents, '\n')
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), contents, 0644)
+}
@@ -0,0 +1,51 @@
+package native
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+func TestAllowedValidate(t *testing.T) {
+	a := &Allowed{
+		Env:    GoEnv,
+		Config: map[string]*regexp.Regexp{"debug": Bool, "max": Number, "timeout": Word},
+	}
+
+	valid := []*broker.Options{
+		nil,
+		{},
+		{Env: map[string]string{"GOMAXPROCS": "4", "GOGC": "off"}},
+		{Config: map[string]string{"debug": "true", "max": "100", "timeout": "10s"}},
+	}
+	invalid := map[string]*broker.Options{
+		"LD_PRELOAD":        {Env: map[string]string{"LD_PRELOAD": "/tmp/evil.so"}},
+		"PATH":              {Env: map[string]string{"PATH": "/tmp"}},
+		"JAVA_HOME":         {Env: map[string]string{"JAVA_HOME": "/tmp/java"}},
+		"KAFKA_OPTS":        {Env: map[string]string{"KAFKA_OPTS": "-javaagent:/tmp/evil.jar"}},
+		"GOMAXPROCS value":  {Env: map[string]string{"GOMAXPROCS": "four"}},
+		"log flag":          {Config: map[string]string{"log": "/etc/cron.d/evil"}},
+		"pid flag":          {Config: map[string]string{"pid": "/tmp/nats.pid"}},
+		"config flag":       {Config: map[string]string{"config": "/tmp/nats.conf"}},
+		"bool value":        {Config: map[string]string{"debug": "yes"}},
+		"number value":      {Config: map[string]string{"max": "-1"}},
+		"path value":        {Config: map[string]string{"timeout": "/tmp/x"}},
+		"relative path":     {Config: map[string]string{"timeout": "../x"}},
+		"value with option": {Config: map[string]string{"timeout": "1s --log=/tmp/x"}},
+		"image":             {Image: "nats"},
+		"resources":         {Resources: &protocol.Resources{Memory: 1 << 30}},
+	}
+
+	for _, options := range valid {
+		if err := a.Validate("test", options); err != nil {
+			t.Errorf("Expected %+v to be valid, got %s", options, err)
+		}
+	}
+	for name, options := range invalid {
+		if err := a.Validate("test", options); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package nats
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/native"
+)
+
+const natsServer = "nats-server"
+
+// nativeAllowed contains the environment variables and flags the native NATS
+// server accepts. Flags which name files, such as --config, --log and --pid,
+// aren't allowed.
+var nativeAllowed = &native.Allowed{
+	Env: native.GoEnv,
+	Config: map[string]*regexp.Regexp{
+		"debug":           native.Bool,
+		"trace":           native.Bool,
+		"logtime":         native.Bool,
+		"connect_retries": native.Number,
+	},
+}
+
+// NativeBroker implements the broker interface for a NATS server run as a
+// process on the daemon's host.
+type NativeBroker struct {
+	Launcher *native.Launcher
+	process  *native.Process
+	host     string
+	port     string
+	secured  bool
+}
+
+// Start will start the message broker and prepare it for testing.
+func (n *NativeBroker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := n.Validate(options); err != nil {
+		return "", err
+	}
+
+	args := append([]string{"--addr=0.0.0.0", "--port=" + port}, options.ConfigFlags()...)
+	if options.Clustered() {
+		args = append(args, clusterFlags(options.Cluster)...)
+	}
+
+	dir, err := n.Launcher.WorkDir(natsServer)
+	if err != nil {
+		return "", err
+	}
+	if options.Secured() {
+		// The files are removed along with the working directory.
+		files, err := options.ServerSecurity().WriteFiles(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		args = append(args, securityFlags(options.ServerSecurity(), files)...)
+	}
+
+	process, err := n.Launcher.StartIn(dir, natsServer, args, options.EnvList())
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	n.process = process
+	n.host = host
+	n.port = port
+	n.secured = options.Secured()
+	return []*native.Process{process}, nil
+}
+
+// Validate returns an error if the broker can't be started natively with the
+// options.
+func (n *NativeBroker) Validate(options *broker.Options) error {
+	return nativeAllowed.Validate("NATS", options)
+}
+
+// Stop will stop the message broker.
+func (n *NativeBroker) Stop() (interface{}, error) {
+	if n.process == nil {
+		return "", nil
+	}
+	pid := n.process.Pid
+	err := n.process.Stop()
+	n.process = nil
+	return pid, err
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (n *NativeBroker) Ready() error {
+	return native.Ready(func() error {
+		return ready(n.host, n.port, n.secured)
+	}, n.process)
+}
+
+// Logs returns the output of the broker process.
+func (n *NativeBroker) Logs() map[string]string {
+	return native.Logs(n.process)
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
 
 const (
@@ -29,9 +30,19 @@ type Peer struct {
 	done     chan bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with NATS.
-func NewPeer(host string) (*Peer, error) {
-	conn, err := nats.Connect(fmt.Sprintf("nats://%s", host))
+// NewPeer creates and returns a new Peer for communicating with NATS. If
+// multiple comma-separated hosts are provided, they are used as the cluster's
+// seed servers. The security settings are optional.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	opts := nats.DefaultOptions
+	for _, addr := range broker.Hosts(host) {
+		opts.Servers = append(opts.Servers, fmt.Sprintf("nats://%s", addr))
+	}
+	if err := secure(&opts, security); err != nil {
+		return nil, err
+	}
+
+	conn, err := opts.Connect()
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +60,29 @@ func NewPeer(host string) (*Peer, error) {
 	}, nil
 }
 
+// secure applies the security settings to the connection options. NATS
+// authenticates with a plain username and password, so no SASL mechanism may
+// be requested.
+func secure(opts *nats.Options, security *broker.Security) error {
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts.Secure = true
+		opts.TLSConfig = tlsConfig
+	}
+
+	if security.Credentials() {
+		if _, err := security.SASLMechanism("NATS"); err != nil {
+			return err
+		}
+		opts.User = security.Username
+		opts.Password = security.Password
+	}
+	return nil
+}
+
 // Subscribe prepares the peer to consume messages.
 func (n *Peer) Subscribe() error {
 	n.conn.Subscribe(subject, func(message *nats.Msg) {
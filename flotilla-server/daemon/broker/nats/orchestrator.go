@@ -1,45 +1,171 @@
 package nats
 
 import (
+	"bufio"
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
 const (
 	gnatsd       = "nats"
 	internalPort = "4222"
+	clusterPort  = "6222"
+	tlsDir       = "/flotilla-tls"
+	infoTimeout  = 5 * time.Second
 )
 
 // Broker implements the broker interface for NATS.
 type Broker struct {
+	Docker      *docker.Client
 	containerID string
+	host        string
+	port        string
+	secured     bool
+	files       *broker.SecurityFiles
 }
 
 // Start will start the message broker and prepare it for testing.
-func (n *Broker) Start(host, port string) (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker run -d -p %s:%s %s", port, internalPort, gnatsd)).Output()
+func (n *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	var (
+		cmd   = options.ConfigFlags()
+		ports = map[string]string{internalPort: port}
+		binds []string
+	)
+	if options.Clustered() {
+		cmd = append(cmd, clusterFlags(options.Cluster)...)
+		ports[clusterPort] = clusterPort
+	}
+	if options.Secured() {
+		files, err := options.ServerSecurity().WriteFiles("")
+		if err != nil {
+			return "", err
+		}
+		n.files = files
+		cmd = append(cmd, securityFlags(options.ServerSecurity(), files.In(tlsDir))...)
+		binds = append(binds, files.Bind(tlsDir))
+	}
+
+	container, err := n.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(gnatsd),
+		Cmd:       cmd,
+		Env:       options.EnvList(),
+		Resources: options.Limits(),
+		Ports:     ports,
+		Binds:     binds,
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", gnatsd, err.Error())
+		n.files.Remove()
+		n.files = nil
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", gnatsd, containerID)
-	n.containerID = string(containerID)
-	return string(containerID), nil
+	log.Printf("Started container %s: %s", container.Image, container.ID)
+	n.containerID = container.ID
+	n.host = host
+	n.port = port
+	n.secured = options.Secured()
+	return []*docker.Container{container}, nil
+}
+
+// clusterFlags returns the flags which have the node listen for routes from
+// the other nodes in the cluster and route to them.
+func clusterFlags(cluster *protocol.Cluster) []string {
+	routes := make([]string, 0, len(cluster.Nodes)-1)
+	for i, node := range cluster.Nodes {
+		if i != cluster.Node {
+			routes = append(routes, fmt.Sprintf("nats://%s:%s", node, clusterPort))
+		}
+	}
+	return []string{
+		"--cluster=nats://0.0.0.0:" + clusterPort,
+		"--routes=" + strings.Join(routes, ","),
+	}
+}
+
+// securityFlags returns the flags which have the server require TLS using
+// the given files and, if configured, client certificates and credentials.
+func securityFlags(security *broker.ServerSecurity, files *broker.SecurityFiles) []string {
+	flags := []string{"--tls", "--tlscert=" + files.Cert, "--tlskey=" + files.Key}
+	if files.CA != "" {
+		flags = append(flags, "--tlsverify", "--tlscacert="+files.CA)
+	}
+	if security.Username != "" {
+		flags = append(flags, "--user="+security.Username, "--pass="+security.Password)
+	}
+	return flags
 }
 
 // Stop will stop the message broker.
 func (n *Broker) Stop() (interface{}, error) {
-	containerID, err := exec.Command("/bin/sh", "-c",
-		fmt.Sprintf("docker kill %s", n.containerID)).Output()
-	if err != nil {
+	if err := n.Docker.Remove(n.containerID); err != nil {
 		log.Printf("Failed to stop container %s: %s", gnatsd, err.Error())
 		return "", err
 	}
 
-	log.Printf("Stopped container %s: %s", gnatsd, n.containerID)
+	containerID := n.containerID
+	log.Printf("Stopped container %s: %s", gnatsd, containerID)
 	n.containerID = ""
-	return string(containerID), nil
+	if err := n.files.Remove(); err != nil {
+		log.Printf("Failed to remove TLS files: %s", err.Error())
+	}
+	n.files = nil
+	return containerID, nil
+}
+
+// Container returns the ID of the container running the broker node.
+func (n *Broker) Container() string {
+	return n.containerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (n *Broker) Ready() error {
+	return ready(n.host, n.port, n.secured)
+}
+
+// ready returns an error if the server on the given host and port isn't ready
+// for testing. A secured server requires TLS and possibly a client
+// certificate or credentials the daemon doesn't have, so it's only checked
+// for its INFO greeting, which is sent in plaintext before the TLS handshake.
+func ready(host, port string, secured bool) error {
+	if secured {
+		return info(host, port)
+	}
+
+	conn, err := nats.Connect(fmt.Sprintf("nats://%s:%s", host, port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Flush performs a PING/PONG round trip with the server.
+	return conn.Flush()
+}
+
+// info returns an error if the server on the given host and port doesn't
+// greet connections with its INFO line.
+func info(host, port string) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), infoTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(infoTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("Unexpected greeting from %s:%s", host, port)
+	}
+	return nil
 }
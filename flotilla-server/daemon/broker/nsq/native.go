@@ -0,0 +1,132 @@
+package nsq
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/native"
+)
+
+const (
+	nsqlookupdBinary = "nsqlookupd"
+	nsqdBinary       = "nsqd"
+)
+
+// nativeAllowed contains the environment variables and flags the native nsqd
+// accepts. Flags which name files, such as --config and --data-path, aren't
+// allowed.
+var nativeAllowed = &native.Allowed{
+	Env: native.GoEnv,
+	Config: map[string]*regexp.Regexp{
+		"mem-queue-size": native.Number,
+		"max-msg-size":   native.Number,
+		"max-body-size":  native.Number,
+		"max-rdy-count":  native.Number,
+		"sync-every":     native.Number,
+		"sync-timeout":   native.Word,
+		"msg-timeout":    native.Word,
+		"snappy":         native.Bool,
+		"deflate":        native.Bool,
+		"log-level":      native.Word,
+	},
+}
+
+// NativeBroker implements the broker interface for NSQ run as processes on
+// the daemon's host.
+type NativeBroker struct {
+	Launcher   *native.Launcher
+	nsqlookupd *native.Process
+	nsqd       *native.Process
+	host       string
+}
+
+// Start will start the message broker and prepare it for testing.
+func (n *NativeBroker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if port == nsqlookupdPort1 || port == nsqlookupdPort2 || port == nsqdPort {
+		return nil, fmt.Errorf("Port %s is reserved", port)
+	}
+	if err := n.Validate(options); err != nil {
+		return "", err
+	}
+
+	// In a cluster, nsqlookupd only runs alongside the first nsqd.
+	var processes []*native.Process
+	if options.Node() == 0 {
+		nsqlookupd, err := n.Launcher.Start(nsqlookupdBinary, []string{
+			"--tcp-address=0.0.0.0:" + nsqlookupdPort1,
+			"--http-address=0.0.0.0:" + nsqlookupdPort2,
+			"--broadcast-address=" + host,
+		}, nil)
+		if err != nil {
+			return "", err
+		}
+		n.nsqlookupd = nsqlookupd
+		processes = append(processes, nsqlookupd)
+	}
+
+	dir, err := n.Launcher.WorkDir(nsqdBinary)
+	if err != nil {
+		n.Stop()
+		return "", err
+	}
+	args := append([]string{
+		"--tcp-address=0.0.0.0:" + port,
+		"--http-address=0.0.0.0:" + nsqdPort,
+		"--broadcast-address=" + host,
+		fmt.Sprintf("--lookupd-tcp-address=%s:%s", options.Seed(host), nsqlookupdPort1),
+		"--data-path=" + dir,
+	}, options.ConfigFlags()...)
+	if options.Secured() {
+		// The files are removed along with the working directory.
+		files, err := options.ServerSecurity().WriteFiles(dir)
+		if err != nil {
+			n.Stop()
+			return "", err
+		}
+		args = append(args, securityFlags(files)...)
+	}
+	nsqd, err := n.Launcher.StartIn(dir, nsqdBinary, args, options.EnvList())
+	if err != nil {
+		n.Stop()
+		return "", err
+	}
+
+	n.nsqd = nsqd
+	n.host = host
+	return append(processes, nsqd), nil
+}
+
+// Validate returns an error if the broker can't be started natively with the
+// options.
+func (n *NativeBroker) Validate(options *broker.Options) error {
+	if err := securityUnsupported(options); err != nil {
+		return err
+	}
+	return nativeAllowed.Validate("NSQ", options)
+}
+
+// Stop will stop the message broker.
+func (n *NativeBroker) Stop() (interface{}, error) {
+	err := native.Stop(n.nsqlookupd, n.nsqd)
+	n.nsqlookupd = nil
+	n.nsqd = nil
+	return "", err
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (n *NativeBroker) Ready() error {
+	return native.Ready(func() error {
+		if n.nsqlookupd != nil {
+			if err := ping(n.host, nsqlookupdPort2); err != nil {
+				return err
+			}
+		}
+		return ping(n.host, nsqdPort)
+	}, n.nsqlookupd, n.nsqd)
+}
+
+// Logs returns the output of the broker processes.
+func (n *NativeBroker) Logs() map[string]string {
+	return native.Logs(n.nsqlookupd, n.nsqd)
+}
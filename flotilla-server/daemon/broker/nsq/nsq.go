@@ -17,7 +17,8 @@ const (
 type Peer struct {
 	producer *nsq.Producer
 	consumer *nsq.Consumer
-	host     string
+	config   *nsq.Config
+	hosts    []string
 	messages chan []byte
 	send     chan []byte
 	errors   chan error
@@ -25,15 +26,25 @@ type Peer struct {
 	flush    chan bool
 }
 
-// NewPeer creates and returns a new Peer for communicating with NSQ.
-func NewPeer(host string) (*Peer, error) {
-	producer, err := nsq.NewProducer(host, nsq.NewConfig())
+// NewPeer creates and returns a new Peer for communicating with NSQ. If
+// multiple comma-separated nsqd hosts are provided, messages are published to
+// the first and consumed from all of them. The security settings are
+// optional.
+func NewPeer(host string, security *broker.Security) (*Peer, error) {
+	config, err := newConfig(security)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := broker.Hosts(host)
+	producer, err := nsq.NewProducer(hosts[0], config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Peer{
-		host:     host,
+		config:   config,
+		hosts:    hosts,
 		producer: producer,
 		messages: make(chan []byte, 10000),
 		send:     make(chan []byte),
@@ -43,9 +54,32 @@ func NewPeer(host string) (*Peer, error) {
 	}, nil
 }
 
+// newConfig returns the producer and consumer configuration for the security
+// settings. nsqd authenticates clients with a secret, which is taken from the
+// password, rather than a SASL mechanism.
+func newConfig(security *broker.Security) (*nsq.Config, error) {
+	config := nsq.NewConfig()
+	tlsConfig, err := security.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.TlsV1 = true
+		config.TlsConfig = tlsConfig
+	}
+
+	if security.Credentials() {
+		if _, err := security.SASLMechanism("NSQ"); err != nil {
+			return nil, err
+		}
+		config.AuthSecret = security.Password
+	}
+	return config, nil
+}
+
 // Subscribe prepares the peer to consume messages.
 func (n *Peer) Subscribe() error {
-	consumer, err := nsq.NewConsumer(topic, broker.GenerateName(), nsq.NewConfig())
+	consumer, err := nsq.NewConsumer(topic, broker.GenerateName(), n.config)
 	if err != nil {
 		return err
 	}
@@ -55,7 +89,7 @@ func (n *Peer) Subscribe() error {
 		return nil
 	}))
 
-	if err := consumer.ConnectToNSQD(n.host); err != nil {
+	if err := consumer.ConnectToNSQDs(n.hosts); err != nil {
 		return err
 	}
 
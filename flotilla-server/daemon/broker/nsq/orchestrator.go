@@ -1,76 +1,185 @@
 package nsq
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"os/exec"
+	"net/http"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
 )
 
 const (
 	nsqlookupd      = "nsqio/nsqlookupd"
 	nsqlookupdPort1 = "4160"
 	nsqlookupdPort2 = "4161"
-	nsqlookupdCmd   = "docker run -d -p %s:%s -p %s:%s %s"
 	nsqd            = "nsqio/nsqd"
 	internalPort    = "4150"
 	nsqdPort        = "4151"
-	nsqdCmd         = `docker run -d -p %s:%s -p %s:%s %s \
-	                       --broadcast-address=%s \
-	                       --lookupd-tcp-address=%s:%s`
+	pingTimeout     = 5 * time.Second
+	tlsDir          = "/flotilla-tls"
 )
 
 // Broker is an implementation of the broker interface which handles
 // orchestrating NSQ.
 type Broker struct {
+	Docker                *docker.Client
 	nsqlookupdContainerID string
 	nsqdContainerID       string
+	host                  string
+	files                 *broker.SecurityFiles
 }
 
 // Start will start the message broker and prepare it for testing.
-func (n *Broker) Start(host, port string) (interface{}, error) {
+func (n *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
 	if port == nsqlookupdPort1 || port == nsqlookupdPort2 || port == nsqdPort {
 		return nil, fmt.Errorf("Port %s is reserved", port)
 	}
-
-	cmd := fmt.Sprintf(nsqlookupdCmd, nsqlookupdPort1, nsqlookupdPort1, nsqlookupdPort2,
-		nsqlookupdPort2, nsqlookupd)
-	nsqlookupdContainerID, err := exec.Command("/bin/sh", "-c", cmd).Output()
-	if err != nil {
-		log.Printf("Failed to start container %s: %s", nsqlookupd, err.Error())
+	if err := securityUnsupported(options); err != nil {
 		return "", err
 	}
-	log.Printf("Started container %s: %s", nsqlookupd, nsqlookupdContainerID)
 
-	cmd = fmt.Sprintf(nsqdCmd, port, internalPort, nsqdPort, nsqdPort, nsqd, host,
-		host, nsqlookupdPort1)
-	nsqdContainerID, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	// In a cluster, nsqlookupd only runs alongside the first nsqd.
+	var containers []*docker.Container
+	if options.Node() == 0 {
+		nsqlookupdContainer, err := n.Docker.Run(&docker.Config{
+			Image: nsqlookupd,
+			Ports: map[string]string{
+				nsqlookupdPort1: nsqlookupdPort1,
+				nsqlookupdPort2: nsqlookupdPort2,
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to start container %s: %s", nsqlookupd, err.Error())
+			return "", err
+		}
+		log.Printf("Started container %s: %s", nsqlookupd, nsqlookupdContainer.ID)
+		n.nsqlookupdContainerID = nsqlookupdContainer.ID
+		containers = append(containers, nsqlookupdContainer)
+	}
+
+	cmd := []string{
+		"--broadcast-address=" + host,
+		fmt.Sprintf("--lookupd-tcp-address=%s:%s", options.Seed(host), nsqlookupdPort1),
+	}
+	var binds []string
+	if options.Secured() {
+		files, err := options.ServerSecurity().WriteFiles("")
+		if err != nil {
+			n.Stop()
+			return "", err
+		}
+		n.files = files
+		cmd = append(cmd, securityFlags(files.In(tlsDir))...)
+		binds = append(binds, files.Bind(tlsDir))
+	}
+	nsqdContainer, err := n.Docker.Run(&docker.Config{
+		Image:     options.ImageFor(nsqd),
+		Cmd:       append(cmd, options.ConfigFlags()...),
+		Env:       options.EnvList(),
+		Resources: options.Limits(),
+		Ports:     map[string]string{internalPort: port, nsqdPort: nsqdPort},
+		Binds:     binds,
+	})
 	if err != nil {
 		log.Printf("Failed to start container %s: %s", nsqd, err.Error())
+		n.Stop()
 		return "", err
 	}
 
-	log.Printf("Started container %s: %s", nsqd, nsqdContainerID)
-	n.nsqlookupdContainerID = string(nsqlookupdContainerID)
-	n.nsqdContainerID = string(nsqdContainerID)
-	return string(nsqdContainerID), nil
+	log.Printf("Started container %s: %s", nsqdContainer.Image, nsqdContainer.ID)
+	n.nsqdContainerID = nsqdContainer.ID
+	n.host = host
+	return append(containers, nsqdContainer), nil
+}
+
+// securityUnsupported returns an error if the broker should be started with
+// credentials, which nsqd only supports through an external auth server.
+func securityUnsupported(options *broker.Options) error {
+	if options.Secured() && options.Security.Username != "" {
+		return errors.New("Authentication is not supported for starting NSQ")
+	}
+	return nil
+}
+
+// securityFlags returns the flags which have nsqd require TLS for TCP
+// connections using the given files and, if configured, client
+// certificates. HTTP stays available for pings.
+func securityFlags(files *broker.SecurityFiles) []string {
+	flags := []string{
+		"--tls-cert=" + files.Cert,
+		"--tls-key=" + files.Key,
+		"--tls-required=tcp-https",
+	}
+	if files.CA != "" {
+		flags = append(flags, "--tls-root-ca-file="+files.CA, "--tls-client-auth-policy=require-verify")
+	}
+	return flags
 }
 
 // Stop will stop the message broker.
 func (n *Broker) Stop() (interface{}, error) {
-	_, err := exec.Command("/bin/sh", "-c", fmt.Sprintf("docker kill %s", n.nsqlookupdContainerID)).Output()
-	if err != nil {
-		log.Printf("Failed to stop container %s: %s", nsqlookupd, err.Error())
-	} else {
-		log.Printf("Stopped container %s: %s", nsqlookupd, n.nsqlookupdContainerID)
+	defer func() {
+		if err := n.files.Remove(); err != nil {
+			log.Printf("Failed to remove TLS files: %s", err.Error())
+		}
+		n.files = nil
+	}()
+
+	var err error
+	if n.nsqlookupdContainerID != "" {
+		if err = n.Docker.Remove(n.nsqlookupdContainerID); err != nil {
+			log.Printf("Failed to stop container %s: %s", nsqlookupd, err.Error())
+		} else {
+			log.Printf("Stopped container %s: %s", nsqlookupd, n.nsqlookupdContainerID)
+		}
+	}
+
+	if n.nsqdContainerID == "" {
+		return "", err
 	}
 
-	nsqdContainerID, e := exec.Command("/bin/sh", "-c", fmt.Sprintf("docker kill %s", n.nsqdContainerID)).Output()
-	if e != nil {
-		log.Printf("Failed to stop container %s: %s", nsqd, err.Error())
+	if e := n.Docker.Remove(n.nsqdContainerID); e != nil {
+		log.Printf("Failed to stop container %s: %s", nsqd, e.Error())
 		err = e
 	} else {
 		log.Printf("Stopped container %s: %s", nsqd, n.nsqdContainerID)
 	}
 
-	return string(nsqdContainerID), err
+	return n.nsqdContainerID, err
+}
+
+// Container returns the ID of the container running the broker node.
+func (n *Broker) Container() string {
+	return n.nsqdContainerID
+}
+
+// Ready returns an error if the message broker is not yet ready for testing.
+func (n *Broker) Ready() error {
+	if n.nsqlookupdContainerID != "" {
+		if err := ping(n.host, nsqlookupdPort2); err != nil {
+			return err
+		}
+	}
+	return ping(n.host, nsqdPort)
+}
+
+// ping checks the health of the nsqlookupd or nsqd HTTP endpoint on the given
+// host and port.
+func ping(host, port string) error {
+	client := &http.Client{Timeout: pingTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s:%s/ping", host, port))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Ping %s:%s failed: %s", host, port, body)
+	}
+	return nil
 }
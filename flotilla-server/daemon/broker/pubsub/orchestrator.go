@@ -10,6 +10,8 @@ import (
 	"golang.org/x/oauth2/google"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/pubsub"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 )
 
 const topic = "test"
@@ -21,7 +23,11 @@ type Broker struct {
 }
 
 // Start will start the message broker and prepare it for testing.
-func (c *Broker) Start(host, port string) (interface{}, error) {
+func (c *Broker) Start(host, port string, options *broker.Options) (interface{}, error) {
+	if err := options.Unsupported("Cloud Pub/Sub"); err != nil {
+		return "", err
+	}
+
 	ctx, err := newContext(c.ProjectID, c.JSONKey)
 	if err != nil {
 		return "", err
@@ -50,6 +56,23 @@ func (c *Broker) Start(host, port string) (interface{}, error) {
 	return "", nil
 }
 
+// Ready returns an error if the message broker is not yet ready for testing.
+func (c *Broker) Ready() error {
+	ctx, err := newContext(c.ProjectID, c.JSONKey)
+	if err != nil {
+		return err
+	}
+
+	exists, err := pubsub.TopicExists(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("Cloud Pub/Sub topic does not exist")
+	}
+	return nil
+}
+
 // Stop will stop the message broker.
 func (c *Broker) Stop() (interface{}, error) {
 	ctx, err := newContext(c.ProjectID, c.JSONKey)
@@ -0,0 +1,237 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// These are the names of the files ServerSecurity is written to.
+const (
+	certFile = "cert.pem"
+	keyFile  = "key.pem"
+	caFile   = "ca.pem"
+)
+
+// Security contains the TLS and authentication settings peers connect to the
+// broker with. It's the protocol's Security, with the methods peers use to
+// apply it.
+type Security protocol.Security
+
+// Validate returns an error if the Security is invalid.
+func (s *Security) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if (s.Cert == "") != (s.Key == "") {
+		return errors.New("Client certificate requires both a certificate and a key")
+	}
+	if !s.TLS && (s.CA != "" || s.Cert != "" || s.InsecureSkipVerify) {
+		return errors.New("Certificates require TLS")
+	}
+	if s.Username == "" && (s.Password != "" || s.Mechanism != "") {
+		return errors.New("Password and mechanism require a username")
+	}
+	if err := validateValue("username", s.Username); err != nil {
+		return err
+	}
+	return validateValue("password", s.Password)
+}
+
+// TLSConfig returns the TLS configuration for connecting to the broker, or
+// nil if TLS isn't enabled.
+func (s *Security) TLSConfig() (*tls.Config, error) {
+	if s == nil || !s.TLS {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: s.InsecureSkipVerify}
+	if s.CA != "" {
+		pool, err := certPool(s.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if s.Cert != "" {
+		cert, err := tls.X509KeyPair([]byte(s.Cert), []byte(s.Key))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Credentials returns true if peers authenticate with a username.
+func (s *Security) Credentials() bool {
+	return s != nil && s.Username != ""
+}
+
+// SASLMechanism returns the mechanism peers authenticate with, which is the
+// first of the broker's supported mechanisms if none was requested. It
+// returns an error if the requested mechanism isn't supported.
+func (s *Security) SASLMechanism(broker string, supported ...string) (string, error) {
+	if s == nil || s.Mechanism == "" {
+		if len(supported) == 0 {
+			return "", nil
+		}
+		return supported[0], nil
+	}
+	for _, mechanism := range supported {
+		if strings.EqualFold(s.Mechanism, mechanism) {
+			return mechanism, nil
+		}
+	}
+	return "", fmt.Errorf("SASL mechanism %s is not supported for %s", s.Mechanism, broker)
+}
+
+// CredentialsUnsupported returns an error if credentials were provided. It's
+// used by brokers which have no way of authenticating peers.
+func (s *Security) CredentialsUnsupported(broker string) error {
+	if s.Credentials() {
+		return fmt.Errorf("Authentication is not supported for %s", broker)
+	}
+	return nil
+}
+
+// Unsupported returns an error if TLS or credentials were requested. It's
+// used by brokers which support neither.
+func (s *Security) Unsupported(broker string) error {
+	if s != nil && s.TLS {
+		return fmt.Errorf("TLS is not supported for %s", broker)
+	}
+	return s.CredentialsUnsupported(broker)
+}
+
+// ServerSecurity contains the TLS and authentication settings a broker is
+// started with. It's the protocol's ServerSecurity, with the methods brokers
+// use to apply it.
+type ServerSecurity protocol.ServerSecurity
+
+// SecurityFiles contains the paths ServerSecurity was written to. CA is
+// empty if there's no CA.
+type SecurityFiles struct {
+	Dir  string
+	Cert string
+	Key  string
+	CA   string
+}
+
+// Validate returns an error if the ServerSecurity is invalid.
+func (s *ServerSecurity) Validate() error {
+	if s.Cert == "" || s.Key == "" {
+		return errors.New("Broker TLS requires both a certificate and a key")
+	}
+	if _, err := tls.X509KeyPair([]byte(s.Cert), []byte(s.Key)); err != nil {
+		return err
+	}
+	if s.CA != "" {
+		if _, err := certPool(s.CA); err != nil {
+			return err
+		}
+	}
+	if (s.Username == "") != (s.Password == "") {
+		return errors.New("Broker authentication requires both a username and a password")
+	}
+	if err := validateValue("username", s.Username); err != nil {
+		return err
+	}
+	return validateValue("password", s.Password)
+}
+
+// WriteFiles writes the certificate, key and CA to the directory so the
+// broker can read them. The directory is created if it's empty.
+func (s *ServerSecurity) WriteFiles(dir string) (*SecurityFiles, error) {
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "flotilla-tls-"); err != nil {
+			return nil, err
+		}
+	}
+
+	files := &SecurityFiles{
+		Dir:  dir,
+		Cert: filepath.Join(dir, certFile),
+		Key:  filepath.Join(dir, keyFile),
+	}
+	if err := ioutil.WriteFile(files.Cert, []byte(s.Cert), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(files.Key, []byte(s.Key), 0600); err != nil {
+		return nil, err
+	}
+	if s.CA != "" {
+		files.CA = filepath.Join(dir, caFile)
+		if err := ioutil.WriteFile(files.CA, []byte(s.CA), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// In returns the paths of the files if their directory is mounted at dir,
+// such as in a container.
+func (f *SecurityFiles) In(dir string) *SecurityFiles {
+	in := &SecurityFiles{
+		Dir:  dir,
+		Cert: filepath.Join(dir, certFile),
+		Key:  filepath.Join(dir, keyFile),
+	}
+	if f.CA != "" {
+		in.CA = filepath.Join(dir, caFile)
+	}
+	return in
+}
+
+// Bind returns the read-only bind mount of the files' directory at dir.
+func (f *SecurityFiles) Bind(dir string) string {
+	return f.Dir + ":" + dir + ":ro"
+}
+
+// Remove removes the files.
+func (f *SecurityFiles) Remove() error {
+	if f == nil {
+		return nil
+	}
+	return os.RemoveAll(f.Dir)
+}
+
+// Secured returns true if the broker should be started with TLS.
+func (o *Options) Secured() bool {
+	return o != nil && o.Security != nil
+}
+
+// ServerSecurity returns the settings the broker should be started with, or
+// nil if it shouldn't be started with TLS.
+func (o *Options) ServerSecurity() *ServerSecurity {
+	if !o.Secured() {
+		return nil
+	}
+	return (*ServerSecurity)(o.Security)
+}
+
+// SecurityUnsupported returns an error if the broker should be started with
+// TLS. It's used by brokers which can't be.
+func (o *Options) SecurityUnsupported(broker string) error {
+	if o.Secured() {
+		return fmt.Errorf("Starting with TLS is not supported for %s", broker)
+	}
+	return nil
+}
+
+// certPool returns a pool containing the PEM-encoded certificates.
+func certPool(pem string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(pem)) {
+		return nil, errors.New("No certificates found in CA")
+	}
+	return pool, nil
+}
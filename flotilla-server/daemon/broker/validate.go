@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+const maxImageLength = 255
+
+var (
+	// hostnamePattern matches RFC 1123 hostnames.
+	hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+	// imagePattern matches image references, such as
+	// "registry:5000/user/nats:0.7.2" or "nats@sha256:...", and tags such
+	// as ":0.7.2".
+	imagePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9._/:-]*[a-z0-9])?)?(:[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?(@sha256:[a-f0-9]{64})?$`)
+
+	envKeyPattern    = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	configKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	secretPattern    = regexp.MustCompile(`^[a-zA-Z0-9]*$`)
+)
+
+// ValidateHost returns an error if the host isn't an IP address or hostname.
+func ValidateHost(host string) error {
+	if net.ParseIP(host) == nil && (len(host) > 253 || !hostnamePattern.MatchString(host)) {
+		return fmt.Errorf("Invalid host %q", host)
+	}
+	return nil
+}
+
+// ValidatePort returns an error if the port isn't a number from 1 to 65535.
+func ValidatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 || strconv.Itoa(n) != port {
+		return fmt.Errorf("Invalid port %q", port)
+	}
+	return nil
+}
+
+// ValidateAddrs returns an error if any of the comma-separated broker
+// addresses isn't a host or a host and port.
+func ValidateAddrs(addrs string) error {
+	if strings.ContainsAny(addrs, "\x00\r\n") {
+		return fmt.Errorf("Invalid addresses %q", addrs)
+	}
+	for _, addr := range Hosts(addrs) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = addr, ""
+		}
+		if err := ValidateHost(host); err != nil {
+			return err
+		}
+		if port != "" {
+			if err := ValidatePort(port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateImage returns an error if the image isn't an image reference or a
+// tag.
+func ValidateImage(image string) error {
+	if len(image) > maxImageLength || !imagePattern.MatchString(image) ||
+		strings.Contains(image, "//") || strings.Contains(image, "..") {
+		return fmt.Errorf("Invalid image %q", image)
+	}
+	return nil
+}
+
+// Validate returns an error if any of the Options are invalid. Values end up
+// in container and process arguments, environments and configuration files,
+// so keys are restricted and values may not contain line breaks.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	if o.Image != "" {
+		if err := ValidateImage(o.Image); err != nil {
+			return err
+		}
+	}
+	for key, value := range o.Env {
+		if !envKeyPattern.MatchString(key) {
+			return fmt.Errorf("Invalid environment variable %q", key)
+		}
+		if err := validateValue(key, value); err != nil {
+			return err
+		}
+	}
+	for key, value := range o.Config {
+		if !configKeyPattern.MatchString(key) {
+			return fmt.Errorf("Invalid configuration key %q", key)
+		}
+		if err := validateValue(key, value); err != nil {
+			return err
+		}
+	}
+	if o.Cluster != nil {
+		if err := validateCluster(o.Cluster); err != nil {
+			return err
+		}
+	}
+	if o.Secured() {
+		if err := o.ServerSecurity().Validate(); err != nil {
+			return err
+		}
+	}
+	if o.Resources != nil {
+		return o.Limits().Validate()
+	}
+	return nil
+}
+
+func validateCluster(c *protocol.Cluster) error {
+	if c.Node < 0 || (len(c.Nodes) > 0 && c.Node >= len(c.Nodes)) {
+		return fmt.Errorf("Invalid cluster node %d", c.Node)
+	}
+	for _, node := range c.Nodes {
+		if err := ValidateHost(node); err != nil {
+			return err
+		}
+	}
+	if !secretPattern.MatchString(c.Secret) {
+		return errors.New("Invalid cluster secret")
+	}
+	return nil
+}
+
+func validateValue(key, value string) error {
+	if strings.ContainsAny(value, "\x00\r\n") {
+		return fmt.Errorf("Invalid value for %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+func TestValidateHost(t *testing.T) {
+	valid := []string{
+		"localhost",
+		"broker-1.example.com",
+		"broker.example.com.",
+		"10.0.0.1",
+		"::1",
+		"fe80::1",
+	}
+	invalid := []string{
+		"",
+		"a;rm -rf /",
+		"$(id)",
+		"`id`",
+		"host\n",
+		"host\nother",
+		"host name",
+		"-host",
+		"host-",
+		"host..example.com",
+		"host/path",
+		"host:4222",
+		"user@host",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat("a.", 127) + "com",
+	}
+
+	for _, host := range valid {
+		if err := ValidateHost(host); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", host, err)
+		}
+	}
+	for _, host := range invalid {
+		if err := ValidateHost(host); err == nil {
+			t.Errorf("Expected %q to be invalid", host)
+		}
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	valid := []string{"1", "80", "4222", "65535"}
+	invalid := []string{"", "0", "65536", "080", "+80", "-1", " 80", "80 ", "80\n", "0x50", "4222;id", "http"}
+
+	for _, port := range valid {
+		if err := ValidatePort(port); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", port, err)
+		}
+	}
+	for _, port := range invalid {
+		if err := ValidatePort(port); err == nil {
+			t.Errorf("Expected %q to be invalid", port)
+		}
+	}
+}
+
+func TestValidateAddrs(t *testing.T) {
+	valid := []string{"localhost", "10.0.0.1:4222", "a:1, b:2", "[::1]:4222"}
+	invalid := []string{"", "a:0", "a:080", "a;id:4222", "a:1,$(id)", "a:1,\nb:2"}
+
+	for _, addrs := range valid {
+		if err := ValidateAddrs(addrs); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", addrs, err)
+		}
+	}
+	for _, addrs := range invalid {
+		if err := ValidateAddrs(addrs); err == nil {
+			t.Errorf("Expected %q to be invalid", addrs)
+		}
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	valid := []string{
+		"nats",
+		"nats:0.7.2",
+		":0.7.2",
+		"apache/kafka:2.8.0",
+		"registry.example.com:5000/user/nats:latest",
+		"nats:Latest",
+		"nats@sha256:" + strings.Repeat("a", 64),
+	}
+	invalid := []string{
+		"NATS",
+		"Apache/kafka",
+		"registry//nats",
+		"registry/../nats",
+		"nats..",
+		"../nats",
+		"/nats",
+		"nats/",
+		"nats:",
+		"nats;id",
+		"nats $(id)",
+		"nats\n",
+		"nats@sha256:abc",
+		strings.Repeat("a", maxImageLength+1),
+	}
+
+	for _, image := range valid {
+		if err := ValidateImage(image); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", image, err)
+		}
+	}
+	for _, image := range invalid {
+		if err := ValidateImage(image); err == nil {
+			t.Errorf("Expected %q to be invalid", image)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	valid := []*Options{
+		nil,
+		{},
+		{Image: ":0.7.2"},
+		{Env: map[string]string{"JAVA_OPTS": "-Xmx1g -Dfoo=bar", "_X1": ""}},
+		{Config: map[string]string{"num.io.threads": "8", "max_payload": "1MB", "log-level": "debug"}},
+		{Cluster: &protocol.Cluster{Nodes: []string{"a", "b"}, Node: 1, Secret: "abc123XYZ"}},
+		{Cluster: &protocol.Cluster{}},
+		{Resources: &protocol.Resources{Memory: 1 << 30, BlkioWeight: 500}},
+	}
+	invalid := map[string]*Options{
+		"image":                 {Image: "NATS"},
+		"image traversal":       {Image: "registry/../nats"},
+		"env key":               {Env: map[string]string{"1KEY": "x"}},
+		"env key with equals":   {Env: map[string]string{"KEY=x": "x"}},
+		"env key with space":    {Env: map[string]string{"KEY X": "x"}},
+		"env key with newline":  {Env: map[string]string{"KEY\n": "x"}},
+		"empty env key":         {Env: map[string]string{"": "x"}},
+		"env value newline":     {Env: map[string]string{"KEY": "a\nb"}},
+		"env value return":      {Env: map[string]string{"KEY": "a\rb"}},
+		"env value nul":         {Env: map[string]string{"KEY": "a\x00b"}},
+		"config key":            {Config: map[string]string{"-key": "x"}},
+		"config key with slash": {Config: map[string]string{"../key": "x"}},
+		"config key with equal": {Config: map[string]string{"key=x": "x"}},
+		"config key with space": {Config: map[string]string{"key x": "x"}},
+		"empty config key":      {Config: map[string]string{"": "x"}},
+		"config value newline":  {Config: map[string]string{"key": "x\nother.key=y"}},
+		"cluster node":          {Cluster: &protocol.Cluster{Nodes: []string{"a", "$(id)"}}},
+		"cluster node index":    {Cluster: &protocol.Cluster{Nodes: []string{"a", "b"}, Node: 2}},
+		"negative node index":   {Cluster: &protocol.Cluster{Node: -1}},
+		"secret with space":     {Cluster: &protocol.Cluster{Secret: "a b"}},
+		"secret with quote":     {Cluster: &protocol.Cluster{Secret: "a'b"}},
+		"secret with newline":   {Cluster: &protocol.Cluster{Secret: "ab\n"}},
+		"secret with command":   {Cluster: &protocol.Cluster{Secret: "$(id)"}},
+		"secret with unicode":   {Cluster: &protocol.Cluster{Secret: "sécret"}},
+		"security":              {Security: &protocol.ServerSecurity{}},
+		"resources":             {Resources: &protocol.Resources{Memory: -1}},
+	}
+
+	for _, options := range valid {
+		if err := options.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %s", options, err)
+		}
+	}
+	for name, options := range invalid {
+		if err := options.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
+
+func TestValidateSecurity(t *testing.T) {
+	invalid := map[string]*Security{
+		"certificate without key": {TLS: true, Cert: "cert"},
+		"CA without TLS":          {CA: "ca"},
+		"password without user":   {Password: "secret"},
+		"username newline":        {Username: "user\nother"},
+		"password newline":        {Username: "user", Password: "a\r\nb"},
+	}
+
+	var nilSecurity *Security
+	if err := nilSecurity.Validate(); err != nil {
+		t.Errorf("Expected nil security to be valid, got %s", err)
+	}
+	if err := (&Security{TLS: true, Username: "user", Password: "pass word"}).Validate(); err != nil {
+		t.Errorf("Expected security to be valid, got %s", err)
+	}
+	for name, security := range invalid {
+		if err := security.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
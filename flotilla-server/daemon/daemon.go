@@ -5,34 +5,64 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/rep"
-	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/tylertreat/Flotilla/discovery"
+	brokers "github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/activemq"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/amqp"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/amqp/rabbitmq"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/beanstalkd"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/inmem"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/kafka"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/kestrel"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/native"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/nats"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/nsq"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/pubsub"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/netem"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/usage"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
 type daemon string
-type operation string
 
 const (
-	start    operation = "start"
-	stop     operation = "stop"
-	run      operation = "run"
-	sub      operation = "subscribers"
-	pub      operation = "publishers"
-	results  operation = "results"
-	teardown operation = "teardown"
+	defaultStartupTimeout = 2 * time.Minute
+	readyPollInterval     = time.Second
+	sampleInterval        = time.Second
+	procfs                = "/proc"
 )
 
+const (
+	hello     = protocol.Hello
+	start     = protocol.Start
+	stop      = protocol.Stop
+	run       = protocol.Run
+	sub       = protocol.Subscribers
+	pub       = protocol.Publishers
+	results   = protocol.Results
+	teardown  = protocol.Teardown
+	faults    = protocol.Faults
+	impair    = protocol.Impair
+	logs      = protocol.Logs
+	reap      = protocol.Reap
+	sessions  = protocol.Sessions
+	heartbeat = protocol.Heartbeat
+	status    = protocol.Status
+)
+
+// operations contains the operations the daemon performs.
+var operations = []protocol.Operation{
+	hello, start, stop, run, sub, pub, results, teardown, faults, impair, logs, reap, sessions,
+	heartbeat, status,
+}
+
 // These are supported message brokers.
 const (
 	NATS        = "nats"
@@ -43,42 +73,111 @@ const (
 	RabbitMQ    = "rabbitmq"
 	NSQ         = "nsq"
 	CloudPubSub = "pubsub"
+	InMem       = "inmem"
+)
+
+// brokerNames contains the supported message brokers.
+var brokerNames = []string{NATS, Beanstalkd, Kafka, Kestrel, ActiveMQ, RabbitMQ, NSQ, CloudPubSub, InMem}
+
+// These are the ways brokers can be launched.
+const (
+	// DockerLauncher runs brokers in Docker containers.
+	DockerLauncher = "docker"
+
+	// NativeLauncher runs broker binaries as processes on the daemon's host.
+	NativeLauncher = "native"
 )
 
+// request is a request from the client. The payloads specific to some
+// operations are added to the shared fields.
 type request struct {
-	Operation   operation `json:"operation"`
-	Broker      string    `json:"broker"`
-	Port        string    `json:"port"`
-	NumMessages int       `json:"num_messages"`
-	MessageSize int64     `json:"message_size"`
-	Count       int       `json:"count"`
-	Host        string    `json:"host"`
+	protocol.Request
+
+	// Options overrides the broker's image, environment and configuration.
+	Options *brokers.Options `json:"options,omitempty"`
+
+	// Faults contains the faults to inject into the broker node.
+	Faults []*protocol.Fault `json:"faults,omitempty"`
+
+	// Impairment contains the network conditions to emulate on the Target.
+	Impairment *netem.Impairment `json:"impairment,omitempty"`
+
+	// Security contains the TLS and authentication settings publishers and
+	// subscribers connect to the broker with.
+	Security *brokers.Security `json:"security,omitempty"`
 }
 
 type response struct {
-	Success    bool        `json:"success"`
-	Message    string      `json:"message"`
-	Result     interface{} `json:"result"`
-	PubResults []*result   `json:"pub_results,omitempty"`
-	SubResults []*result   `json:"sub_results,omitempty"`
+	protocol.Response
+	Result     interface{}        `json:"result"`
+	PubResults []*protocol.Result `json:"pub_results,omitempty"`
+	SubResults []*protocol.Result `json:"sub_results,omitempty"`
+
+	// Usage contains the resource usage of the host and any broker
+	// containers during the run, keyed by source.
+	Usage map[string]*protocol.Usage `json:"usage,omitempty"`
+
+	// status is the HTTP status of a failed request, which is 500 unless the
+	// request itself was at fault.
+	status int
+}
+
+// requestError is an error caused by the request rather than a failure of the
+// daemon, such as stopping a broker which isn't running. The HTTP API
+// responds with its status.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// invalidRequest returns an error for a request the daemon can't perform.
+func invalidRequest(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
 }
 
-type result struct {
-	Duration   float32         `json:"duration,omitempty"`
-	Throughput float32         `json:"throughput,omitempty"`
-	Latency    *latencyResults `json:"latency,omitempty"`
-	Err        string          `json:"error,omitempty"`
+// notFound returns an error for a request which refers to a broker or session
+// that doesn't exist.
+func notFound(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusNotFound, message: fmt.Sprintf(format, args...)}
+}
+
+// conflict returns an error for a request which can't be performed in the
+// session's or daemon's current state, such as starting a second broker.
+func conflict(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusConflict, message: fmt.Sprintf(format, args...)}
+}
+
+type startResult struct {
+	Broker      interface{} `json:"broker"`
+	TimeToReady float32     `json:"time_to_ready"`
 }
 
 // broker handles configuring the message broker for testing.
 type broker interface {
 	// Start will start the message broker and prepare it for testing.
-	Start(string, string) (interface{}, error)
+	Start(string, string, *brokers.Options) (interface{}, error)
+
+	// Ready returns an error if the message broker is not yet ready for
+	// testing.
+	Ready() error
 
 	// Stop will stop the message broker.
 	Stop() (interface{}, error)
 }
 
+// validated is implemented by brokers which restrict the options they can be
+// started with, such as those run natively, so that requests with other
+// options are rejected before anything is started.
+type validated interface {
+	// Validate returns an error if the broker can't be started with the
+	// options.
+	Validate(*brokers.Options) error
+}
+
 // peer is a single producer or consumer in the test.
 type peer interface {
 	// Subscribe prepares the peer to consume messages.
@@ -89,6 +188,8 @@ type peer interface {
 	Recv() ([]byte, error)
 
 	// Send returns a channel on which messages can be sent for publishing.
+	// The peer owns each message once it's sent, so senders must not modify
+	// it afterwards.
 	Send() chan<- []byte
 
 	// Errors returns the channel on which the peer sends publish errors.
@@ -107,18 +208,108 @@ type peer interface {
 
 // Config contains configuration settings for the Flotilla daemon.
 type Config struct {
+	// ID identifies the daemon's containers, so daemons sharing a Docker
+	// host don't reap each other's.
+	ID string
+
+	// StateFile is where the running broker's state is persisted so that
+	// its containers can be reaped if the daemon exits without stopping it.
+	// If empty, the state isn't persisted.
+	StateFile string
+
+	DockerEndpoint       string
 	GoogleCloudProjectID string
 	GoogleCloudJSONKey   string
+	InMemLatency         time.Duration
+	InMemLoss            float64
+
+	// Launcher is how brokers are launched, DockerLauncher if empty.
+	Launcher string
+
+	// NativePaths maps broker binaries, such as "nats-server", to their
+	// paths for the NativeLauncher. For Kafka, "kafka" is the installation
+	// directory. Binaries without a path are looked up in PATH.
+	NativePaths map[string]string
+
+	// NativeDir is where the NativeLauncher creates working directories for
+	// broker processes, the system's temporary directory if empty.
+	NativeDir string
+
+	// TLSCert and TLSKey are the PEM-encoded certificate and key files the
+	// daemon serves TLS with. If empty, requests are received in plaintext.
+	TLSCert string
+	TLSKey  string
+
+	// TLSCA is a PEM-encoded CA certificate file. If set, clients must
+	// present a certificate signed by it.
+	TLSCA string
+
+	// Tokens contains the credentials requests must be signed with, keyed by
+	// name. If empty, requests aren't authenticated.
+	Tokens map[string]*Token
+
+	// ProgressPort is the port progress is published on during runs. If
+	// zero, progress isn't published. Subscribing isn't subject to Tokens,
+	// so progress is only restricted to authorized clients if TLSCA is set.
+	ProgressPort int
+
+	// Discovery is where the daemon registers itself while it runs, so
+	// clients can select it by label. If nil, it isn't registered.
+	Discovery discovery.Backend
+
+	// Registration describes the daemon in Discovery, which is required if
+	// Discovery is set.
+	Registration *discovery.Registration
+
+	// HTTPPort is the port the HTTP API is served on, with TLS if the
+	// daemon's socket uses it. If zero, the API isn't served.
+	HTTPPort int
 }
 
 // Daemon is the server portion of Flotilla which runs on machines we want to
 // communicate with and include in our benchmarks.
 type Daemon struct {
 	mangos.Socket
-	broker      broker
-	publishers  []*publisher
-	subscribers []*subscriber
-	config      *Config
+	config   *Config
+	docker   *docker.Client
+	launcher *native.Launcher
+	sessions map[string]*session
+	tls      bool
+
+	// progress publishes the progress of runs, if it's enabled.
+	progress mangos.Socket
+
+	// http serves the HTTP API, if it's enabled.
+	http *http.Server
+
+	// mu guards the sessions map. Each session has its own lock, so requests
+	// for different sessions are performed concurrently. It's never held
+	// while acquiring a session's lock, so a slow request can't hold up
+	// requests for other sessions.
+	mu sync.Mutex
+
+	// states contains the state of each session's running broker, which is
+	// persisted to the state file. It's guarded by stateMu.
+	states  map[string]*brokerState
+	stateMu sync.Mutex
+
+	// impaired maps the target of each applied network impairment to the ID
+	// of the session which applied it, so sessions can't change or revert
+	// each other's. It's guarded by impairedMu, which may be acquired while
+	// holding a session's lock.
+	impaired   map[string]string
+	impairedMu sync.Mutex
+
+	// requests tracks the requests received on the socket which are being
+	// performed.
+	requests sync.WaitGroup
+
+	// closed is closed when the Daemon is.
+	closed chan struct{}
+
+	// started is when the Daemon was created, which its uptime is relative
+	// to.
+	started time.Time
 }
 
 // NewDaemon creates and returns a new Daemon from the provided Config. An
@@ -128,148 +319,418 @@ func NewDaemon(config *Config) (*Daemon, error) {
 	if err != nil {
 		return nil, err
 	}
-	rep.AddTransport(tcp.NewTransport())
-	return &Daemon{rep, nil, []*publisher{}, []*subscriber{}, config}, nil
+	captureLogs()
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := addTransport(rep, tlsConfig); err != nil {
+		return nil, err
+	}
+	// In raw mode, requests can be received before earlier ones are answered,
+	// so one slow request doesn't hold up the rest.
+	if err := rep.SetOption(mangos.OptionRaw, true); err != nil {
+		return nil, err
+	}
+
+	var progress mangos.Socket
+	if config.ProgressPort > 0 {
+		if progress, err = newProgressSocket(tlsConfig); err != nil {
+			return nil, err
+		}
+		if len(config.Tokens) > 0 && config.TLSCA == "" {
+			log.Printf("Progress on port %d is published to unauthenticated subscribers; "+
+				"set a TLS CA to require client certificates", config.ProgressPort)
+		}
+	}
+
+	switch config.Launcher {
+	case "", DockerLauncher, NativeLauncher:
+	default:
+		return nil, fmt.Errorf("Invalid launcher %s", config.Launcher)
+	}
+
+	if config.Discovery != nil && (config.Registration == nil || config.Registration.Addr == "") {
+		return nil, errors.New("Discovery requires an address to register")
+	}
+
+	docker, err := docker.NewClient(config.DockerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Daemon{
+		Socket:   rep,
+		config:   config,
+		docker:   docker,
+		launcher: &native.Launcher{Paths: config.NativePaths, Dir: config.NativeDir},
+		sessions: make(map[string]*session),
+		states:   make(map[string]*brokerState),
+		impaired: make(map[string]string),
+		tls:      tlsConfig != nil,
+		progress: progress,
+		closed:   make(chan struct{}),
+		started:  time.Now(),
+	}
+	if config.HTTPPort > 0 {
+		d.http = &http.Server{Handler: d, TLSConfig: tlsConfig}
+	}
+	docker.Labels = d.labels()
+	return d, nil
 }
 
-// Start will allow the Daemon to begin processing requests. This is a blocking
-// call.
+// Start will allow the Daemon to begin processing requests. Containers left
+// behind by a previous daemon are reaped first. This is a blocking call.
 func (d *Daemon) Start(port int) error {
-	if err := d.Listen(fmt.Sprintf("tcp://:%d", port)); err != nil {
+	if err := d.Recover(); err != nil {
+		log.Printf("Failed to reap orphaned containers: %s", err.Error())
+	}
+	if err := d.Listen(d.URL(fmt.Sprintf(":%d", port))); err != nil {
+		return err
+	}
+	if err := d.listenProgress(); err != nil {
+		return err
+	}
+	if err := d.listenHTTP(); err != nil {
+		return err
+	}
+	if err := d.register(); err != nil {
 		return err
 	}
+	return d.Serve()
+}
+
+// Serve processes requests received on the Daemon's listening sockets until
+// the Daemon is closed. This is a blocking call.
+func (d *Daemon) Serve() error {
 	return d.loop()
 }
 
+// Close closes the Daemon's sockets and removes its discovery registration.
+func (d *Daemon) Close() error {
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+		d.deregister()
+	}
+	if d.progress != nil {
+		d.progress.Close()
+	}
+	if d.http != nil {
+		d.http.Close()
+	}
+	return d.Socket.Close()
+}
+
+// loop receives requests until the Daemon is closed, performing each one
+// concurrently, and then waits for those in progress.
 func (d *Daemon) loop() error {
 	for {
-		msg, err := d.Recv()
+		msg, err := d.RecvMsg()
+		if err == mangos.ErrClosed {
+			d.requests.Wait()
+			return nil
+		}
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		var req request
-		if err := json.Unmarshal(msg, &req); err != nil {
-			log.Println("Invalid peer request:", err)
-			d.sendResponse(response{
-				Success: false,
-				Message: fmt.Sprintf("Invalid request: %s", err.Error()),
-			})
-			continue
-		}
+		d.requests.Add(1)
+		go func() {
+			defer d.requests.Done()
+			d.sendResponse(msg, d.handle(msg.Body))
+		}()
+	}
+}
+
+// handle authenticates, validates and performs the request received on the
+// socket.
+func (d *Daemon) handle(msg []byte) response {
+	var req request
+	if err := json.Unmarshal(msg, &req); err != nil {
+		log.Println("Invalid peer request:", err)
+		return response{Response: protocol.Response{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request: %s", err.Error()),
+		}}
+	}
+
+	if err := d.authenticate(msg, req.Operation); err != nil {
+		log.Printf("Rejected %s request: %s", req.Operation, err.Error())
+		return response{Response: protocol.Response{
+			Success: false,
+			Message: fmt.Sprintf("Unauthorized: %s", err.Error()),
+		}}
+	}
+
+	if err := req.validate(); err != nil {
+		log.Printf("Invalid %s request: %s", req.Operation, err.Error())
+		return response{Response: protocol.Response{
+			Success: false,
+			Message: fmt.Sprintf("Invalid request: %s", err.Error()),
+		}}
+	}
+
+	return d.process(req)
+}
 
-		resp := d.processRequest(req)
-		d.sendResponse(resp)
+// process performs the request. Requests arrive concurrently, on the socket
+// and the HTTP API, so each session's are performed one at a time while its
+// lock is held. Operations on the daemon as a whole don't belong to a session.
+func (d *Daemon) process(req request) response {
+	switch req.Operation {
+	case hello, heartbeat, status, sessions, reap:
+		return d.processDaemonRequest(req)
 	}
+
+	s := d.session(req)
+	defer d.release(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return d.processRequest(s, req)
 }
 
-func (d *Daemon) sendResponse(rep response) {
+// sendResponse answers the request in msg, which is the raw message it was
+// received in.
+func (d *Daemon) sendResponse(msg *mangos.Message, rep response) {
 	repJSON, err := json.Marshal(rep)
 	if err != nil {
 		// This is not recoverable.
 		panic(err)
 	}
 
-	if err := d.Send(repJSON); err != nil {
+	reply := mangos.NewMessage(len(repJSON))
+	reply.Header = append(reply.Header, msg.Header...)
+	reply.Body = append(reply.Body, repJSON...)
+	msg.Free()
+	if err := d.SendMsg(reply); err != nil {
 		log.Println(err)
 	}
 }
 
-func (d *Daemon) processRequest(req request) response {
+// processDaemonRequest performs an operation on the daemon as a whole.
+func (d *Daemon) processDaemonRequest(req request) response {
+	var (
+		response response
+		err      error
+	)
+
+	switch req.Operation {
+	case hello:
+		response.Result = d.processHello()
+	case reap:
+		response.Result, err = d.processReap()
+	case sessions:
+		response.Result, err = d.processSessions(req)
+	case heartbeat:
+		// Answering is all a heartbeat needs. It takes no locks, so it's
+		// answered even while the daemon's or a session's are held by slow
+		// requests, such as a broker starting.
+	case status:
+		response.Result = d.processStatus()
+	}
+
+	return complete(response, err)
+}
+
+// processRequest performs an operation on the session, which must be locked.
+func (d *Daemon) processRequest(s *session, req request) response {
 	var (
 		response response
 		err      error
 	)
+
 	switch req.Operation {
 	case start:
-		response.Result, err = d.processBrokerStart(req.Broker, req.Host, req.Port)
+		response.Result, response.Logs, err = d.processBrokerStart(s, req)
 	case stop:
-		response.Result, err = d.processBrokerStop()
+		response.Result, response.Logs, err = d.processBrokerStop(s)
 	case pub:
-		err = d.processPub(req)
+		err = d.processPub(s, req)
 	case sub:
-		err = d.processSub(req)
+		err = d.processSub(s, req)
 	case run:
-		err = d.processPublisherStart()
+		err = d.processPublisherStart(s)
 	case results:
-		response.PubResults, response.SubResults, err = d.processResults()
+		response.PubResults, response.SubResults, err = d.processResults(s)
 		if err != nil {
 			response.Message = err.Error()
 			err = nil
+		} else {
+			response.Usage = d.stopSampling(s)
 		}
 	case teardown:
-		d.processTeardown()
+		response.Logs = d.processTeardown(s)
+	case faults:
+		err = d.processFaults(s, req)
+	case impair:
+		err = d.processImpair(s, req)
+	case logs:
+		response.Logs = d.processLogs(s)
 	default:
-		err = fmt.Errorf("Invalid operation %s", req.Operation)
+		err = invalidRequest("Invalid operation %s", req.Operation)
 	}
 
+	return complete(response, err)
+}
+
+// complete marks the response as successful, or failed with the error if it's
+// not nil.
+func complete(response response, err error) response {
 	if err != nil {
 		response.Message = err.Error()
+		response.status = http.StatusInternalServerError
+		if reqErr, ok := err.(*requestError); ok {
+			response.status = reqErr.status
+		}
 	} else {
 		response.Success = true
 	}
-
 	return response
 }
-func (d *Daemon) processBrokerStart(broker, host, port string) (interface{}, error) {
-	if d.broker != nil {
-		return "", errors.New("Broker already running")
+
+// processBrokerStart starts the session's broker and waits for it to become
+// ready. If it doesn't, the output of its containers is returned to help
+// diagnose why. The session is unlocked while the broker starts and becomes
+// ready, which can take minutes, so that it can be inspected meanwhile.
+func (d *Daemon) processBrokerStart(s *session, req request) (interface{}, map[string]string, error) {
+	if s.starting != nil && sameStart(*s.started, req) {
+		// A retried request, such as after the client timed out waiting for
+		// the broker to become ready, waits for the first one.
+		starting := s.starting
+		s.mu.Unlock()
+		<-starting
+		s.mu.Lock()
+		if s.broker == nil {
+			return "", nil, errors.New("Broker failed to start")
+		}
+	}
+	if s.broker != nil {
+		// A retried request gets the running broker.
+		if s.startResult != nil && sameStart(*s.started, req) {
+			log.Println("Broker already running with the requested configuration")
+			return s.startResult, nil, nil
+		}
+		return "", nil, conflict("Broker already running")
 	}
 
-	switch broker {
-	case NATS:
-		d.broker = &nats.Broker{}
-	case Beanstalkd:
-		d.broker = &beanstalkd.Broker{}
-	case Kafka:
-		d.broker = &kafka.Broker{}
-	case Kestrel:
-		d.broker = &kestrel.Broker{}
-	case ActiveMQ:
-		d.broker = &activemq.Broker{}
-	case RabbitMQ:
-		d.broker = &rabbitmq.Broker{}
-	case NSQ:
-		d.broker = &nsq.Broker{}
-	case CloudPubSub:
-		d.broker = &pubsub.Broker{
-			ProjectID: d.config.GoogleCloudProjectID,
-			JSONKey:   d.config.GoogleCloudJSONKey,
+	timeout := defaultStartupTimeout
+	if req.StartupTimeout > 0 {
+		timeout = time.Duration(req.StartupTimeout) * time.Second
+	}
+
+	b, err := d.newBroker(req.Broker)
+	if err != nil {
+		return "", nil, err
+	}
+	if v, ok := b.(validated); ok {
+		if err := v.Validate(req.Options); err != nil {
+			return "", nil, invalidRequest("%s", err.Error())
 		}
-	default:
-		return "", fmt.Errorf("Invalid broker %s", broker)
 	}
 
-	result, err := d.broker.Start(host, port)
+	started := time.Now()
+	s.broker = b
+	s.started = &req
+	s.launched = started
+	s.starting = make(chan struct{})
+	defer func() {
+		close(s.starting)
+		s.starting = nil
+	}()
+
+	s.mu.Unlock()
+	result, err := b.Start(req.Host, req.Port, req.Options)
+	s.mu.Lock()
+	if err != nil {
+		s.broker = nil
+		s.started = nil
+		return result, nil, err
+	}
+	if containers, ok := result.([]*docker.Container); ok {
+		s.containers = containers
+		d.saveState(s)
+	}
+
+	s.mu.Unlock()
+	err = waitForBroker(b, started.Add(timeout))
+	s.mu.Lock()
 	if err != nil {
-		d.broker = nil
+		log.Printf("Broker failed to become ready: %s", err.Error())
+		logs := d.collectBrokerLogs(s)
+		b.Stop()
+		s.broker = nil
+		s.containers = nil
+		s.started = nil
+		d.saveState(s)
+		return result, logs, err
+	}
+
+	timeToReady := time.Since(started)
+	log.Printf("Session %s broker ready after %s", s.id, timeToReady)
+	s.startResult = &startResult{
+		Broker:      result,
+		TimeToReady: float32(timeToReady) / float32(time.Millisecond),
+	}
+	return s.startResult, nil, nil
+}
+
+// waitForBroker polls the broker until it's ready or the deadline passes.
+func waitForBroker(b broker, deadline time.Time) error {
+	for {
+		err := b.Ready()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Broker not ready: %s", err.Error())
+		}
+		time.Sleep(readyPollInterval)
 	}
-	return result, err
 }
 
-func (d *Daemon) processBrokerStop() (interface{}, error) {
-	if d.broker == nil {
-		return "", errors.New("No broker running")
+// processBrokerStop stops the session's broker and returns the output of its
+// containers, which is collected before they're removed, along with the daemon
+// output logged for the session since it was last torn down, clearing it.
+func (d *Daemon) processBrokerStop(s *session) (interface{}, map[string]string, error) {
+	if err := s.brokerRunning(); err != nil {
+		return "", nil, err
 	}
 
-	result, err := d.broker.Stop()
+	d.cancelFaults(s)
+	d.revertImpairments(s)
+	logs := d.collectBrokerLogs(s)
+	result, err := s.broker.Stop()
 	if err == nil {
-		d.broker = nil
+		s.broker = nil
+		s.containers = nil
+		s.started = nil
+		s.startResult = nil
+		d.saveState(s)
 	}
-	return result, err
+	logs["daemon"] = s.logs.Drain()
+	return result, logs, err
 }
 
-func (d *Daemon) processPub(req request) error {
+func (d *Daemon) processPub(s *session, req request) error {
 	for i := 0; i < req.Count; i++ {
-		sender, err := d.newPeer(req.Broker, req.Host)
+		sender, err := d.newPeer(req.Broker, req.Host, req.Security)
 		if err != nil {
 			return err
 		}
 
-		d.publishers = append(d.publishers, &publisher{
+		tag, err := newTag()
+		if err != nil {
+			return err
+		}
+
+		s.publishers = append(s.publishers, &publisher{
 			peer:        sender,
 			id:          i,
+			tag:         tag,
 			numMessages: req.NumMessages,
 			messageSize: req.MessageSize,
 		})
@@ -278,9 +739,9 @@ func (d *Daemon) processPub(req request) error {
 	return nil
 }
 
-func (d *Daemon) processSub(req request) error {
+func (d *Daemon) processSub(s *session, req request) error {
 	for i := 0; i < req.Count; i++ {
-		receiver, err := d.newPeer(req.Broker, req.Host)
+		receiver, err := d.newPeer(req.Broker, req.Host, req.Security)
 		if err != nil {
 			return err
 		}
@@ -294,25 +755,53 @@ func (d *Daemon) processSub(req request) error {
 			id:          i,
 			numMessages: req.NumMessages,
 			messageSize: req.MessageSize,
+			idleTimeout: time.Duration(req.IdleTimeout) * time.Second,
 		}
-		d.subscribers = append(d.subscribers, subscriber)
+		s.subscribers = append(s.subscribers, subscriber)
 		go subscriber.start()
 	}
 
 	return nil
 }
 
-func (d *Daemon) processPublisherStart() error {
-	for _, publisher := range d.publishers {
+func (d *Daemon) processPublisherStart(s *session) error {
+	d.startSampling(s)
+	s.running = true
+	for _, publisher := range s.publishers {
 		go publisher.start()
 	}
 
 	return nil
 }
 
-func (d *Daemon) processResults() ([]*result, []*result, error) {
-	subResults := make([]*result, 0, len(d.subscribers))
-	for _, subscriber := range d.subscribers {
+// startSampling begins sampling the resource usage of the host and of any
+// broker containers the session started.
+func (d *Daemon) startSampling(s *session) {
+	d.stopSampling(s)
+	sources := map[string]usage.Source{"host": usage.Host(procfs)}
+	for _, container := range s.containers {
+		name := fmt.Sprintf("container %s (%.12s)", container.Image, container.ID)
+		sources[name] = usage.Container(d.docker, container.ID)
+	}
+
+	s.sampler = usage.NewSampler(sampleInterval, sources)
+	s.sampler.Start()
+	s.usage = nil
+}
+
+// stopSampling stops sampling resource usage, if it's running, and returns
+// the usage sampled during the run.
+func (d *Daemon) stopSampling(s *session) map[string]*protocol.Usage {
+	if s.sampler != nil {
+		s.usage = s.sampler.Stop()
+		s.sampler = nil
+	}
+	return s.usage
+}
+
+func (d *Daemon) processResults(s *session) ([]*protocol.Result, []*protocol.Result, error) {
+	subResults := make([]*protocol.Result, 0, len(s.subscribers))
+	for _, subscriber := range s.subscribers {
 		result, err := subscriber.getResults()
 		if err != nil {
 			return nil, nil, err
@@ -320,8 +809,8 @@ func (d *Daemon) processResults() ([]*result, []*result, error) {
 		subResults = append(subResults, result)
 	}
 
-	pubResults := make([]*result, 0, len(d.publishers))
-	for _, publisher := range d.publishers {
+	pubResults := make([]*protocol.Result, 0, len(s.publishers))
+	for _, publisher := range s.publishers {
 		result, err := publisher.getResults()
 		if err != nil {
 			return nil, nil, err
@@ -329,44 +818,104 @@ func (d *Daemon) processResults() ([]*result, []*result, error) {
 		pubResults = append(pubResults, result)
 	}
 
-	log.Println("Benchmark completed")
+	log.Printf("Session %s benchmark completed", s.id)
 	return pubResults, subResults, nil
 }
 
-func (d *Daemon) processTeardown() {
-	for _, subscriber := range d.subscribers {
+// processTeardown tears down the session's peers and returns the daemon output
+// logged for the session since it was last torn down, clearing it.
+func (d *Daemon) processTeardown(s *session) map[string]string {
+	d.revertImpairments(s)
+	d.stopSampling(s)
+	s.usage = nil
+
+	for _, subscriber := range s.subscribers {
 		subscriber.Teardown()
 	}
-	d.subscribers = d.subscribers[:0]
+	s.subscribers = s.subscribers[:0]
 
-	for _, publisher := range d.publishers {
+	for _, publisher := range s.publishers {
 		publisher.Teardown()
 	}
-	d.publishers = d.publishers[:0]
+	s.publishers = s.publishers[:0]
+	s.running = false
+	return map[string]string{"daemon": s.logs.Drain()}
+}
+
+func (d *Daemon) newBroker(name string) (broker, error) {
+	if d.config.Launcher == NativeLauncher {
+		switch name {
+		case NATS:
+			return &nats.NativeBroker{Launcher: d.launcher}, nil
+		case Beanstalkd:
+			return &beanstalkd.NativeBroker{Launcher: d.launcher}, nil
+		case Kafka:
+			return &kafka.NativeBroker{Launcher: d.launcher}, nil
+		case NSQ:
+			return &nsq.NativeBroker{Launcher: d.launcher}, nil
+		case Kestrel, ActiveMQ, RabbitMQ:
+			return nil, invalidRequest("Broker %s can't be launched natively", name)
+		}
+	}
+
+	switch name {
+	case NATS:
+		return &nats.Broker{Docker: d.docker}, nil
+	case Beanstalkd:
+		return &beanstalkd.Broker{Docker: d.docker}, nil
+	case Kafka:
+		return &kafka.Broker{Docker: d.docker}, nil
+	case Kestrel:
+		return &kestrel.Broker{Docker: d.docker}, nil
+	case ActiveMQ:
+		return &activemq.Broker{Docker: d.docker}, nil
+	case RabbitMQ:
+		return &rabbitmq.Broker{Docker: d.docker}, nil
+	case NSQ:
+		return &nsq.Broker{Docker: d.docker}, nil
+	case CloudPubSub:
+		return &pubsub.Broker{
+			ProjectID: d.config.GoogleCloudProjectID,
+			JSONKey:   d.config.GoogleCloudJSONKey,
+		}, nil
+	case InMem:
+		return &inmem.Broker{
+			Latency: d.config.InMemLatency,
+			Loss:    d.config.InMemLoss,
+		}, nil
+	default:
+		return nil, invalidRequest("Invalid broker %s", name)
+	}
 }
 
-func (d *Daemon) newPeer(broker, host string) (peer, error) {
+func (d *Daemon) newPeer(broker, host string, security *brokers.Security) (peer, error) {
 	switch broker {
 	case NATS:
-		return nats.NewPeer(host)
+		return nats.NewPeer(host, security)
 	case Beanstalkd:
-		return beanstalkd.NewPeer(host)
+		return beanstalkd.NewPeer(host, security)
 	case Kafka:
-		return kafka.NewPeer(host)
+		return kafka.NewPeer(host, security)
 	case Kestrel:
-		return kestrel.NewPeer(host)
+		return kestrel.NewPeer(host, security)
 	case ActiveMQ:
-		return activemq.NewPeer(host)
+		return activemq.NewPeer(host, security)
 	case RabbitMQ:
-		return amqp.NewPeer(host)
+		return amqp.NewPeer(host, security)
 	case NSQ:
-		return nsq.NewPeer(host)
+		return nsq.NewPeer(host, security)
 	case CloudPubSub:
+		// Cloud Pub/Sub is secured with the daemon's service account.
+		if err := security.Unsupported("Cloud Pub/Sub"); err != nil {
+			return nil, err
+		}
 		return pubsub.NewPeer(
 			d.config.GoogleCloudProjectID,
 			d.config.GoogleCloudJSONKey,
 		)
+	case InMem:
+		return inmem.NewPeer(host, security)
 	default:
-		return nil, fmt.Errorf("Invalid broker: %s", broker)
+		return nil, invalidRequest("Invalid broker: %s", broker)
 	}
 }
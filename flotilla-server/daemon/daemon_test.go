@@ -0,0 +1,336 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/req"
+	"github.com/go-mangos/mangos/transport/tcp"
+	brokers "github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/netem"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// slowBroker is a broker which is left starting by the tests.
+type slowBroker struct{}
+
+func (b *slowBroker) Start(host, port string, options *brokers.Options) (interface{}, error) {
+	return host + ":" + port, nil
+}
+
+func (b *slowBroker) Ready() error { return nil }
+
+func (b *slowBroker) Stop() (interface{}, error) { return "", nil }
+
+func newTestDaemon(t *testing.T) *Daemon {
+	d, err := NewDaemon(&Config{})
+	if err != nil {
+		t.Fatalf("NewDaemon failed: %s", err)
+	}
+	return d
+}
+
+func newRequest(op protocol.Operation, session string) request {
+	return request{Request: protocol.Request{
+		Operation: op,
+		Session:   session,
+		Broker:    InMem,
+		Host:      "localhost",
+		Port:      "4222",
+	}}
+}
+
+// startSlowly puts the session's broker into the state it's in while
+// processBrokerStart waits for it to become ready, with the session unlocked.
+func startSlowly(d *Daemon, id string) *session {
+	req := newRequest(start, id)
+	s := d.session(req)
+	s.mu.Lock()
+	s.broker = &slowBroker{}
+	s.started = &req
+	s.launched = time.Now()
+	s.starting = make(chan struct{})
+	s.mu.Unlock()
+	return s
+}
+
+func finishStart(s *session) {
+	s.mu.Lock()
+	s.startResult = &startResult{Broker: "localhost:4222"}
+	close(s.starting)
+	s.starting = nil
+	s.mu.Unlock()
+}
+
+// process performs the request, failing the test if it doesn't complete
+// promptly.
+func process(t *testing.T, d *Daemon, req request) response {
+	done := make(chan response, 1)
+	go func() {
+		done <- d.process(req)
+	}()
+	select {
+	case resp := <-done:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s request blocked", req.Operation)
+		return response{}
+	}
+}
+
+func TestRequestsWhileBrokerStarting(t *testing.T) {
+	d := newTestDaemon(t)
+	s := startSlowly(d, "starting")
+	defer d.release(s)
+
+	// Other sessions and the daemon as a whole aren't held up.
+	for _, op := range []protocol.Operation{hello, heartbeat, status, sessions} {
+		if resp := process(t, d, newRequest(op, "other")); !resp.Success {
+			t.Errorf("%s failed: %s", op, resp.Message)
+		}
+	}
+	if resp := process(t, d, newRequest(teardown, "other")); !resp.Success {
+		t.Errorf("Teardown failed: %s", resp.Message)
+	}
+
+	st := process(t, d, newRequest(status, "")).Result.(*protocol.StatusResult)
+	if len(st.Sessions) != 1 || st.Sessions[0].ID != "starting" || st.Sessions[0].Broker != InMem {
+		t.Errorf("Expected the starting session's broker in the status, got %+v", st.Sessions)
+	}
+
+	// The starting session's broker can't be used or stopped yet.
+	for _, op := range []protocol.Operation{stop, faults} {
+		resp := process(t, d, newRequest(op, "starting"))
+		if resp.Success || resp.Message != "Broker is still starting" {
+			t.Errorf("Expected %s to fail while the broker is starting, got %+v", op, resp)
+		}
+	}
+	if resp := process(t, d, newRequest(reap, "")); resp.Success {
+		t.Error("Expected reap to fail while a broker is starting")
+	}
+}
+
+func TestNativeOptionsRejected(t *testing.T) {
+	d, err := NewDaemon(&Config{Launcher: NativeLauncher})
+	if err != nil {
+		t.Fatalf("NewDaemon failed: %s", err)
+	}
+
+	tests := map[string]*brokers.Options{
+		NATS:       {Env: map[string]string{"LD_PRELOAD": "/tmp/evil.so"}},
+		NSQ:        {Config: map[string]string{"data-path": "/etc"}},
+		Kafka:      {Env: map[string]string{"KAFKA_OPTS": "-javaagent:/tmp/evil.jar"}},
+		Beanstalkd: {Env: map[string]string{"GOGC": "off"}},
+	}
+	for name, options := range tests {
+		req := newRequest(start, "native")
+		req.Broker = name
+		req.Options = options
+		resp := process(t, d, req)
+		if resp.Success || resp.status != http.StatusBadRequest || !strings.Contains(resp.Message, "not allowed") {
+			t.Errorf("%s: expected the options to be rejected, got %d %q", name, resp.status, resp.Message)
+		}
+	}
+	if s, ok := d.sessions["native"]; ok && s.broker != nil {
+		t.Error("Expected no broker to be started")
+	}
+}
+
+func TestImpairmentConflict(t *testing.T) {
+	d := newTestDaemon(t)
+	owner := d.session(newRequest(impair, "owner"))
+	defer d.release(owner)
+	if err := d.claimImpairment(owner, "eth1"); err != nil {
+		t.Fatalf("claimImpairment failed: %s", err)
+	}
+
+	req := newRequest(impair, "other")
+	req.Target = hostTarget
+	req.Impairment = &netem.Impairment{Delay: 10, Device: "eth1"}
+	resp := process(t, d, req)
+	if resp.Success || resp.status != http.StatusConflict || !strings.Contains(resp.Message, "owner") {
+		t.Fatalf("Expected a conflict with the owning session, got %d %q", resp.status, resp.Message)
+	}
+
+	d.releaseImpairment("eth1")
+	if err := d.claimImpairment(&session{id: "other"}, "eth1"); err != nil {
+		t.Fatalf("Expected the released device to be claimed, got %s", err)
+	}
+}
+
+func TestRetriedStartWaits(t *testing.T) {
+	d := newTestDaemon(t)
+	s := startSlowly(d, "starting")
+	defer d.release(s)
+
+	done := make(chan response, 1)
+	go func() {
+		done <- d.process(newRequest(start, "starting"))
+	}()
+
+	select {
+	case resp := <-done:
+		t.Fatalf("Expected the retried start to wait, got %+v", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	finishStart(s)
+	select {
+	case resp := <-done:
+		if !resp.Success {
+			t.Fatalf("Expected the retried start to get the started broker, got %s", resp.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retried start didn't complete")
+	}
+
+	resp := process(t, d, request{Request: protocol.Request{
+		Operation: start,
+		Session:   "starting",
+		Broker:    NATS,
+		Host:      "localhost",
+		Port:      "4222",
+	}})
+	if resp.Success || !strings.Contains(resp.Message, "already running") {
+		t.Fatalf("Expected a different broker to be refused, got %+v", resp)
+	}
+}
+
+func TestSessionReleased(t *testing.T) {
+	d := newTestDaemon(t)
+
+	process(t, d, newRequest(teardown, "idle"))
+	if len(d.allSessions()) != 0 {
+		t.Fatal("Expected the idle session to be discarded")
+	}
+
+	// A session in use by another request isn't discarded.
+	s := d.session(newRequest(teardown, "busy"))
+	process(t, d, newRequest(teardown, "busy"))
+	if len(d.allSessions()) != 1 {
+		t.Fatal("Expected the session in use to be kept")
+	}
+	d.release(s)
+	if len(d.allSessions()) != 0 {
+		t.Fatal("Expected the session to be discarded once released")
+	}
+}
+
+func TestReleaseWhileSessionLocked(t *testing.T) {
+	d := newTestDaemon(t)
+	s := d.session(newRequest(teardown, "locked"))
+	s.mu.Lock()
+	released := make(chan struct{})
+	go func() {
+		d.release(s)
+		close(released)
+	}()
+
+	// Releasing the session waits for its lock without holding the Daemon's,
+	// so requests for other sessions aren't held up.
+	other := make(chan struct{})
+	go func() {
+		d.release(d.session(newRequest(teardown, "other")))
+		close(other)
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Another session's request blocked while the session was locked")
+	}
+
+	s.mu.Unlock()
+	<-released
+	if len(d.allSessions()) != 0 {
+		t.Fatal("Expected the session to be discarded once unlocked")
+	}
+}
+
+func TestProgressStopsOnClose(t *testing.T) {
+	d, err := NewDaemon(&Config{ProgressPort: 9011})
+	if err != nil {
+		t.Fatalf("NewDaemon failed: %s", err)
+	}
+
+	// With no sessions, nothing is ever sent on the progress socket, so only
+	// closing the Daemon stops the publisher.
+	done := make(chan struct{})
+	go func() {
+		d.publishProgress()
+		close(done)
+	}()
+	d.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Progress publisher didn't stop when the daemon was closed")
+	}
+}
+
+func TestHeartbeatWhileBusy(t *testing.T) {
+	d := newTestDaemon(t)
+	defer d.Close()
+	if err := d.Listen(d.URL(":9012")); err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go d.Serve()
+
+	// Hold up a request on the socket behind its session's lock, and hold
+	// the daemon's lock as well.
+	s := d.session(newRequest(teardown, "busy"))
+	s.mu.Lock()
+	busy := dialDaemon(t, "tcp://localhost:9012")
+	defer busy.Close()
+	if err := busy.Send(encodeRequest(t, newRequest(teardown, "busy"))); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.mu.Lock()
+
+	heartbeats := dialDaemon(t, "tcp://localhost:9012")
+	defer heartbeats.Close()
+	if err := heartbeats.Send(encodeRequest(t, newRequest(heartbeat, "busy"))); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	_, err := heartbeats.Recv()
+	d.mu.Unlock()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Heartbeat wasn't answered while the daemon was busy: %s", err)
+	}
+
+	if _, err := busy.Recv(); err != nil {
+		t.Fatalf("Busy request wasn't answered once unblocked: %s", err)
+	}
+	d.release(s)
+}
+
+// dialDaemon returns a REQ socket connected to the daemon at url, which times
+// out after a second.
+func dialDaemon(t *testing.T, url string) mangos.Socket {
+	s, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %s", err)
+	}
+	s.AddTransport(tcp.NewTransport())
+	s.SetOption(mangos.OptionSendDeadline, time.Second)
+	s.SetOption(mangos.OptionRecvDeadline, time.Second)
+	if err := s.Dial(url); err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	return s
+}
+
+func encodeRequest(t *testing.T, req request) []byte {
+	req.Version = protocol.Version
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reqJSON
+}
@@ -0,0 +1,233 @@
+// Package daemontest provides utilities for end-to-end testing of the
+// client/daemon protocol. It runs daemons in-process on random ports and
+// drives them with the Flotilla client against the in-memory broker, so no
+// Docker or other external services are needed.
+package daemontest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/rep"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/tylertreat/Flotilla/flotilla-client/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon"
+)
+
+const (
+	host            = "127.0.0.1"
+	defaultMessages = 1000
+	defaultSize     = 100
+	daemonTimeout   = 5
+	closeTimeout    = 5 * time.Second
+)
+
+// Daemon is a daemon.Daemon listening on a random local port.
+type Daemon struct {
+	*daemon.Daemon
+	Addr string
+	done chan error
+}
+
+// NewDaemon starts a Daemon with the given Config on a random local port. It
+// returns an error if the Daemon cannot be started. Close must be called when
+// the Daemon is no longer needed.
+func NewDaemon(config *daemon.Config) (*Daemon, error) {
+	if config == nil {
+		config = &daemon.Config{}
+	}
+
+	port, err := FreePort()
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := daemon.NewDaemon(config)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	if err := d.Listen(d.URL(addr)); err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	td := &Daemon{Daemon: d, Addr: addr, done: make(chan error, 1)}
+	go func() {
+		td.done <- d.Serve()
+	}()
+	return td, nil
+}
+
+// Close stops the Daemon and waits for it to finish processing requests.
+func (d *Daemon) Close() error {
+	if err := d.Daemon.Close(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-d.done:
+		return err
+	case <-time.After(closeTimeout):
+		return fmt.Errorf("Timed out closing daemon %s", d.Addr)
+	}
+}
+
+// Cluster is a group of in-process Daemons. The first Daemon runs the broker
+// and every Daemon runs peers.
+type Cluster struct {
+	Daemons []*Daemon
+}
+
+// NewCluster starts n Daemons with the given Config. It returns an error if
+// any of them cannot be started. Close must be called when the Cluster is no
+// longer needed.
+func NewCluster(n int, config *daemon.Config) (*Cluster, error) {
+	if n <= 0 {
+		return nil, errors.New("Cluster must have at least one daemon")
+	}
+
+	c := &Cluster{Daemons: make([]*Daemon, 0, n)}
+	for i := 0; i < n; i++ {
+		d, err := NewDaemon(config)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Daemons = append(c.Daemons, d)
+	}
+	return c, nil
+}
+
+// Benchmark returns a Benchmark which runs the in-memory broker on the first
+// Daemon and peers on every Daemon in the Cluster. The broker is given its own
+// port so that Clusters don't interfere with each other. Fields can be
+// modified before passing it to NewClient.
+func (c *Cluster) Benchmark() (*broker.Benchmark, error) {
+	port, err := FreePort()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]string, len(c.Daemons))
+	for i, d := range c.Daemons {
+		peers[i] = d.Addr
+	}
+
+	return &broker.Benchmark{
+		BrokerdHosts:  []string{c.Daemons[0].Addr},
+		BrokerName:    daemon.InMem,
+		BrokerHost:    host,
+		BrokerPort:    strconv.Itoa(port),
+		PeerHosts:     peers,
+		NumMessages:   defaultMessages,
+		MessageSize:   defaultSize,
+		Publishers:    1,
+		Subscribers:   1,
+		DaemonTimeout: daemonTimeout,
+	}, nil
+}
+
+// Close stops every Daemon in the Cluster. It returns the first error
+// encountered.
+func (c *Cluster) Close() error {
+	var err error
+	for _, d := range c.Daemons {
+		if e := d.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Run creates a client for the Benchmark, runs it and tears it down, returning
+// the results. Teardown happens even if the run fails, just like the Flotilla
+// client.
+func Run(b *broker.Benchmark) ([]*broker.ResultContainer, error) {
+	client, err := broker.NewClient(b)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Teardown()
+	return client.Start()
+}
+
+// CheckResults returns an error if the results don't contain a container for
+// every peer in the Benchmark with the expected number of error-free
+// publisher and subscriber results.
+func CheckResults(b *broker.Benchmark, results []*broker.ResultContainer) error {
+	if len(results) != len(b.PeerHosts) {
+		return fmt.Errorf("Expected results from %d peers, got %d",
+			len(b.PeerHosts), len(results))
+	}
+
+	for _, peerResults := range results {
+		if peerResults == nil {
+			return errors.New("Missing peer results")
+		}
+		if len(peerResults.PublisherResults) != int(b.Publishers) {
+			return fmt.Errorf("Expected %d publisher results from %s, got %d",
+				b.Publishers, peerResults.Peer, len(peerResults.PublisherResults))
+		}
+		if len(peerResults.SubscriberResults) != int(b.Subscribers) {
+			return fmt.Errorf("Expected %d subscriber results from %s, got %d",
+				b.Subscribers, peerResults.Peer, len(peerResults.SubscriberResults))
+		}
+		for _, result := range peerResults.PublisherResults {
+			if result.Err != "" {
+				return fmt.Errorf("Publisher on %s failed: %s", peerResults.Peer, result.Err)
+			}
+		}
+		for _, result := range peerResults.SubscriberResults {
+			if result.Err != "" {
+				return fmt.Errorf("Subscriber on %s failed: %s", peerResults.Peer, result.Err)
+			}
+		}
+	}
+	return nil
+}
+
+// Unresponsive is a socket which accepts daemon requests but never replies.
+// It's useful for exercising client timeouts.
+type Unresponsive struct {
+	mangos.Socket
+	Addr string
+}
+
+// NewUnresponsive starts an Unresponsive socket on a random local port. Close
+// must be called when it is no longer needed.
+func NewUnresponsive() (*Unresponsive, error) {
+	port, err := FreePort()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := rep.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	s.AddTransport(tcp.NewTransport())
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	if err := s.Listen("tcp://" + addr); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return &Unresponsive{Socket: s, Addr: addr}, nil
+}
+
+// FreePort returns a local TCP port which is not currently in use.
+func FreePort() (int, error) {
+	l, err := net.Listen("tcp", host+":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,246 @@
+package daemontest
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/req"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/tylertreat/Flotilla/flotilla-client/broker"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+func newCluster(t *testing.T, n int) *Cluster {
+	c, err := NewCluster(n, nil)
+	if err != nil {
+		t.Fatalf("NewCluster failed: %s", err)
+	}
+	return c
+}
+
+func benchmark(t *testing.T, c *Cluster) *broker.Benchmark {
+	b, err := c.Benchmark()
+	if err != nil {
+		t.Fatalf("Benchmark failed: %s", err)
+	}
+	return b
+}
+
+// response is a daemon's response with its result left encoded.
+type response struct {
+	protocol.Response
+	Result json.RawMessage `json:"result"`
+}
+
+// send sends the request straight to the daemon at the given address, without
+// the client's checks, and returns its response.
+func send(t *testing.T, addr string, request protocol.Request) *response {
+	s, err := req.NewSocket()
+	if err != nil {
+		t.Fatalf("NewSocket failed: %s", err)
+	}
+	defer s.Close()
+	s.AddTransport(tcp.NewTransport())
+	s.SetOption(mangos.OptionSendDeadline, 5*time.Second)
+	s.SetOption(mangos.OptionRecvDeadline, 5*time.Second)
+	if err := s.Dial("tcp://" + addr); err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	request.Version = protocol.Version
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Send(requestJSON); err != nil {
+		t.Fatalf("Send failed: %s", err)
+	}
+	rep, err := s.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %s", err)
+	}
+
+	var resp response
+	if err := json.Unmarshal(rep, &resp); err != nil {
+		t.Fatalf("Invalid response %q: %s", rep, err)
+	}
+	return &resp
+}
+
+func checkRun(t *testing.T, b *broker.Benchmark) {
+	results, err := Run(b)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if err := CheckResults(b, results); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make(map[string]bool)
+	for _, r := range results {
+		peers[r.Peer] = true
+		for _, p := range r.PublisherResults {
+			if p.Throughput <= 0 {
+				t.Errorf("Expected positive publisher throughput on %s, got %f", r.Peer, p.Throughput)
+			}
+		}
+		for _, s := range r.SubscriberResults {
+			if s.Received != int(b.NumMessages) {
+				t.Errorf("Expected subscriber on %s to receive %d messages, got %d",
+					r.Peer, b.NumMessages, s.Received)
+			}
+			if s.Throughput <= 0 {
+				t.Errorf("Expected positive subscriber throughput on %s, got %f", r.Peer, s.Throughput)
+			}
+		}
+	}
+	for _, peer := range b.PeerHosts {
+		if !peers[peer] {
+			t.Errorf("Missing results from %s", peer)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.Close()
+
+	b := benchmark(t, c)
+	b.Publishers = 2
+	b.Subscribers = 2
+	checkRun(t, b)
+}
+
+func TestRunAfterTeardown(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.Close()
+
+	checkRun(t, benchmark(t, c))
+
+	// The first run's broker and peers are gone, so the daemons are idle.
+	for _, d := range c.Daemons {
+		resp := send(t, d.Addr, protocol.Request{Operation: protocol.Status})
+		if !resp.Success {
+			t.Fatalf("Status failed: %s", resp.Message)
+		}
+		var status protocol.StatusResult
+		if err := json.Unmarshal(resp.Result, &status); err != nil {
+			t.Fatal(err)
+		}
+		if len(status.Sessions) != 0 {
+			t.Fatalf("Expected no sessions after teardown on %s, got %d", d.Addr, len(status.Sessions))
+		}
+	}
+
+	checkRun(t, benchmark(t, c))
+}
+
+func TestInvalidBroker(t *testing.T) {
+	c := newCluster(t, 1)
+	defer c.Close()
+
+	b := benchmark(t, c)
+	b.BrokerName = "bogus"
+	if _, err := Run(b); err == nil || !strings.Contains(err.Error(), "can't start bogus") {
+		t.Fatalf("Expected the client to refuse the broker, got %v", err)
+	}
+
+	resp := send(t, c.Daemons[0].Addr, protocol.Request{
+		Operation: protocol.Start,
+		Broker:    "bogus",
+		Host:      host,
+		Port:      b.BrokerPort,
+	})
+	if resp.Success || resp.Message != "Invalid broker bogus" {
+		t.Fatalf("Expected invalid broker error, got %+v", resp)
+	}
+}
+
+func TestInvalidOperation(t *testing.T) {
+	c := newCluster(t, 1)
+	defer c.Close()
+
+	resp := send(t, c.Daemons[0].Addr, protocol.Request{Operation: "bogus"})
+	if resp.Success || resp.Message != "Invalid operation bogus" {
+		t.Fatalf("Expected invalid operation error, got %+v", resp)
+	}
+
+	resp = send(t, c.Daemons[0].Addr, protocol.Request{Operation: protocol.Hello, Session: "not a session"})
+	if resp.Success || !strings.HasPrefix(resp.Message, "Invalid request") {
+		t.Fatalf("Expected invalid request error, got %+v", resp)
+	}
+}
+
+func TestUnresponsive(t *testing.T) {
+	u, err := NewUnresponsive()
+	if err != nil {
+		t.Fatalf("NewUnresponsive failed: %s", err)
+	}
+	defer u.Close()
+
+	c := newCluster(t, 1)
+	defer c.Close()
+
+	b := benchmark(t, c)
+	b.PeerHosts = append(b.PeerHosts, u.Addr)
+	b.DaemonTimeout = 1
+
+	start := time.Now()
+	_, err = broker.NewClient(b)
+	if err == nil || !strings.Contains(err.Error(), u.Addr) {
+		t.Fatalf("Expected hello to %s to fail, got %v", u.Addr, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the client to time out after %ds, took %s", b.DaemonTimeout, elapsed)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.Close()
+
+	// Each benchmark gets its daemons' output, even though the first one's
+	// was returned on teardown.
+	for i := 0; i < 2; i++ {
+		client, err := broker.NewClient(benchmark(t, c))
+		if err != nil {
+			t.Fatalf("NewClient failed: %s", err)
+		}
+		if _, err := client.Start(); err != nil {
+			t.Fatalf("Start failed: %s", err)
+		}
+		client.Teardown()
+
+		for _, d := range c.Daemons {
+			output := client.Logs[strings.Replace(d.Addr, ":", "_", -1)+"/daemon.log"]
+			if !strings.Contains(output, "Publisher completed") {
+				t.Fatalf("Run %d: expected the output of %s, got %q", i, d.Addr, output)
+			}
+		}
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	c := newCluster(t, 2)
+	defer c.Close()
+
+	benchmarks := []*broker.Benchmark{benchmark(t, c), benchmark(t, c)}
+	errs := make(chan error, len(benchmarks))
+	for _, b := range benchmarks {
+		go func(b *broker.Benchmark) {
+			results, err := Run(b)
+			if err == nil {
+				err = CheckResults(b, results)
+			}
+			errs <- err
+		}(b)
+	}
+	for range benchmarks {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"log"
+	"time"
+)
+
+// registrationTTL is how long the daemon's registration lasts without being
+// renewed, so daemons which exit without deregistering are soon forgotten.
+// It's renewed well before then.
+const (
+	registrationTTL   = 30 * time.Second
+	registrationRenew = registrationTTL / 3
+)
+
+// register registers the daemon with the discovery backend, if there is one,
+// and keeps renewing the registration until the daemon is closed. The first
+// registration must succeed, but failed renewals are only logged since the
+// backend may recover before the registration lapses.
+func (d *Daemon) register() error {
+	if d.config.Discovery == nil {
+		return nil
+	}
+	registration := *d.config.Registration
+	registration.Daemon = Version
+	if err := d.config.Discovery.Register(&registration, registrationTTL); err != nil {
+		return err
+	}
+	log.Printf("Registered as %s with labels %v", registration.Addr, registration.Labels)
+
+	go func() {
+		ticker := time.NewTicker(registrationRenew)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.closed:
+				return
+			case <-ticker.C:
+				if err := d.config.Discovery.Register(&registration, registrationTTL); err != nil {
+					log.Printf("Failed to renew registration: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// deregister removes the daemon's registration, if it has one.
+func (d *Daemon) deregister() {
+	if d.config.Discovery == nil {
+		return
+	}
+	if err := d.config.Discovery.Deregister(d.config.Registration.Addr); err != nil {
+		log.Printf("Failed to deregister: %s", err.Error())
+	}
+}
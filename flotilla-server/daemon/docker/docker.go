@@ -0,0 +1,719 @@
+// Package docker provides a minimal client for the Docker Engine API which the
+// daemon uses to run brokers in containers. It talks to the engine over its
+// unix socket by default, avoiding the need to shell out to the docker CLI.
+package docker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEndpoint is the Docker Engine endpoint used when none is
+	// provided and DOCKER_HOST is not set.
+	DefaultEndpoint = "unix:///var/run/docker.sock"
+
+	unixBaseURL = "http://docker"
+	dialTimeout = 10 * time.Second
+
+	// minAPIVersion and maxAPIVersion are the oldest and newest Engine API
+	// versions the Client works with. It uses the newest of them the engine
+	// supports.
+	minAPIVersion = "1.24"
+	maxAPIVersion = "1.47"
+)
+
+// Error is returned when the Docker Engine fails to fulfill a request.
+type Error struct {
+	Op         string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("docker: failed to %s (%d): %s", e.Op, e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if the error indicates that the requested container
+// or image doesn't exist.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Config describes a container to run.
+type Config struct {
+	// Image is the image to run, optionally including a tag.
+	Image string
+
+	// Cmd overrides the image's default command arguments.
+	Cmd []string
+
+	// Env contains environment variables in the form KEY=value.
+	Env []string
+
+	// Hostname is the container's hostname.
+	Hostname string
+
+	// Ports maps container ports to host ports, e.g. "4222" to "5000".
+	Ports map[string]string
+
+	// ExtraHosts contains additional /etc/hosts entries in the form
+	// hostname:ip.
+	ExtraHosts []string
+
+	// Binds contains host directories to mount in the container in the form
+	// host-dir:container-dir[:ro].
+	Binds []string
+
+	// Resources limits the host resources the container can use. If nil,
+	// it's unconstrained.
+	Resources *Resources
+}
+
+// Resources limits the host resources a container can use.
+type Resources struct {
+	// CpusetCpus contains the CPUs the container can run on, such as "0-3"
+	// or "0,2".
+	CpusetCpus string `json:"cpuset_cpus,omitempty"`
+
+	// Memory is the container's memory limit in bytes.
+	Memory int64 `json:"memory,omitempty"`
+
+	// BlkioWeight is the container's relative block IO weight, between 10
+	// and 1000.
+	BlkioWeight uint16 `json:"blkio_weight,omitempty"`
+}
+
+// Validate returns an error if the Resources are invalid.
+func (r *Resources) Validate() error {
+	if r.Memory < 0 {
+		return fmt.Errorf("Invalid memory limit %d", r.Memory)
+	}
+	if r.BlkioWeight != 0 && (r.BlkioWeight < 10 || r.BlkioWeight > 1000) {
+		return fmt.Errorf("Invalid block IO weight %d", r.BlkioWeight)
+	}
+	return nil
+}
+
+// Container is a container started by the Client.
+type Container struct {
+	ID    string `json:"id"`
+	Image string `json:"image"`
+
+	// Digest identifies the exact image the container is running. It's the
+	// image's repository digest if it was pulled from a registry, otherwise
+	// its ID.
+	Digest string `json:"digest,omitempty"`
+
+	// Ports maps container ports to the host ports they are published on.
+	Ports map[string]string `json:"ports,omitempty"`
+
+	// Pid is the host process ID of the container's main process, or zero if
+	// it isn't running.
+	Pid int `json:"-"`
+}
+
+// Client communicates with the Docker Engine API.
+type Client struct {
+	// Labels are added to every container the Client creates, which allows
+	// them to be found with List.
+	Labels map[string]string
+
+	http    *http.Client
+	baseURL string
+
+	// version is the API version negotiated with the engine, or empty until
+	// it has been. It's guarded by mu.
+	version string
+	mu      sync.Mutex
+}
+
+// NewClient creates and returns a new Client for the given endpoint, which
+// may be a unix://, tcp://, http:// or https:// address. If the endpoint is
+// empty, DOCKER_HOST is used if set, otherwise DefaultEndpoint. For tcp://
+// endpoints, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH are honored.
+func NewClient(endpoint string) (*Client, error) {
+	if endpoint == "" {
+		endpoint = os.Getenv("DOCKER_HOST")
+	}
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+	client := &Client{http: &http.Client{Transport: transport}}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		transport.Dial = func(string, string) (net.Conn, error) {
+			return net.DialTimeout("unix", path, dialTimeout)
+		}
+		client.baseURL = unixBaseURL
+	case "tcp":
+		scheme := "http"
+		if os.Getenv("DOCKER_TLS_VERIFY") != "" || os.Getenv("DOCKER_CERT_PATH") != "" {
+			config, err := tlsConfigFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = config
+			scheme = "https"
+		}
+		client.baseURL = fmt.Sprintf("%s://%s", scheme, u.Host)
+	case "http", "https":
+		client.baseURL = strings.TrimSuffix(endpoint, "/")
+	default:
+		return nil, fmt.Errorf("Invalid Docker endpoint %s", endpoint)
+	}
+
+	return client, nil
+}
+
+// Run creates and starts a container from the given Config, pulling the image
+// first if it isn't present.
+func (c *Client) Run(config *Config) (*Container, error) {
+	id, err := c.create(config)
+	if IsNotFound(err) {
+		if err := c.Pull(config.Image); err != nil {
+			return nil, err
+		}
+		id, err = c.create(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Start(id); err != nil {
+		c.Remove(id)
+		return nil, err
+	}
+
+	// The container is only returned to the caller if it can be inspected,
+	// so it's removed otherwise rather than left running.
+	container, err := c.Inspect(id)
+	if err != nil {
+		c.Remove(id)
+		return nil, err
+	}
+	return container, nil
+}
+
+// Pull pulls the given image. An image with a digest is pulled by its digest,
+// and if neither a digest nor a tag is provided, latest is used.
+func (c *Client) Pull(image string) error {
+	name, tag := splitImage(image)
+	query := url.Values{"fromImage": {name}, "tag": {tag}}
+	resp, err := c.do("POST", "/images/create", query, nil, "pull image "+image)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Pull progress is streamed as JSON messages, and a failure partway
+	// through is reported in the stream rather than by the status code.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if progress.Error != "" {
+			return &Error{Op: "pull image " + image, StatusCode: resp.StatusCode, Message: progress.Error}
+		}
+	}
+}
+
+// Start starts the container with the given id. This can be used to restart a
+// container which has been killed.
+func (c *Client) Start(id string) error {
+	return c.call("POST", "/containers/"+id+"/start", nil, nil, nil, "start container "+id)
+}
+
+// Kill kills the container with the given id. The container is not removed.
+func (c *Client) Kill(id string) error {
+	return c.call("POST", "/containers/"+id+"/kill", nil, nil, nil, "kill container "+id)
+}
+
+// Restart restarts the container with the given id without waiting for it to
+// stop gracefully. The container is started even if it isn't running.
+func (c *Client) Restart(id string) error {
+	query := url.Values{"t": {"0"}}
+	return c.call("POST", "/containers/"+id+"/restart", query, nil, nil, "restart container "+id)
+}
+
+// Remove kills the container with the given id, if it's running, and removes
+// it along with its volumes.
+func (c *Client) Remove(id string) error {
+	query := url.Values{"force": {"1"}, "v": {"1"}}
+	return c.call("DELETE", "/containers/"+id, query, nil, nil, "remove container "+id)
+}
+
+// Inspect returns the Container with the given id.
+func (c *Client) Inspect(id string) (*Container, error) {
+	var info struct {
+		ID     string `json:"Id"`
+		Image  string `json:"Image"`
+		Config struct {
+			Image string `json:"Image"`
+		} `json:"Config"`
+		State struct {
+			Pid int `json:"Pid"`
+		} `json:"State"`
+		NetworkSettings struct {
+			Ports map[string][]struct {
+				HostPort string `json:"HostPort"`
+			} `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := c.call("GET", "/containers/"+id+"/json", nil, nil, &info, "inspect container "+id); err != nil {
+		return nil, err
+	}
+
+	digest, err := c.imageDigest(info.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	container := &Container{
+		ID:     info.ID,
+		Image:  info.Config.Image,
+		Digest: digest,
+		Ports:  make(map[string]string, len(info.NetworkSettings.Ports)),
+		Pid:    info.State.Pid,
+	}
+	for port, bindings := range info.NetworkSettings.Ports {
+		if len(bindings) > 0 {
+			container.Ports[strings.TrimSuffix(port, "/tcp")] = bindings[0].HostPort
+		}
+	}
+	return container, nil
+}
+
+// List returns the IDs of all containers, running or not, which have the given
+// labels.
+func (c *Client) List(labels map[string]string) ([]string, error) {
+	filter := make([]string, 0, len(labels))
+	for key, value := range labels {
+		filter = append(filter, key+"="+value)
+	}
+	filters, err := json.Marshal(map[string][]string{"label": filter})
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	query := url.Values{"all": {"1"}, "filters": {string(filters)}}
+	if err := c.call("GET", "/containers/json", query, nil, &containers, "list containers"); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(containers))
+	for i, container := range containers {
+		ids[i] = container.ID
+	}
+	return ids, nil
+}
+
+// Logs returns the stdout and stderr output of the container with the given
+// id, with each line prefixed by its timestamp.
+func (c *Client) Logs(id string) (string, error) {
+	query := url.Values{"stdout": {"1"}, "stderr": {"1"}, "timestamps": {"1"}}
+	resp, err := c.do("GET", "/containers/"+id+"/logs", query, nil, "logs for container "+id)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return readStream(resp.Body)
+}
+
+// Stats contains the cumulative resource usage of a container.
+type Stats struct {
+	// CPU is the total CPU time consumed by the container.
+	CPU time.Duration
+
+	// Memory is the container's current memory usage in bytes.
+	Memory uint64
+
+	// NetRx and NetTx are the bytes received and transmitted on all of the
+	// container's network interfaces.
+	NetRx uint64
+	NetTx uint64
+
+	// DiskRead and DiskWrite are the bytes read from and written to block
+	// devices.
+	DiskRead  uint64
+	DiskWrite uint64
+}
+
+// Stats returns a snapshot of the resource usage of the container with the
+// given id.
+func (c *Client) Stats(id string) (*Stats, error) {
+	var info struct {
+		CPUStats struct {
+			CPUUsage struct {
+				TotalUsage uint64 `json:"total_usage"`
+			} `json:"cpu_usage"`
+		} `json:"cpu_stats"`
+		MemoryStats struct {
+			Usage uint64 `json:"usage"`
+		} `json:"memory_stats"`
+		Networks map[string]struct {
+			RxBytes uint64 `json:"rx_bytes"`
+			TxBytes uint64 `json:"tx_bytes"`
+		} `json:"networks"`
+		BlkioStats struct {
+			IOServiceBytesRecursive []struct {
+				Op    string `json:"op"`
+				Value uint64 `json:"value"`
+			} `json:"io_service_bytes_recursive"`
+		} `json:"blkio_stats"`
+	}
+	query := url.Values{"stream": {"0"}}
+	if err := c.call("GET", "/containers/"+id+"/stats", query, nil, &info, "stats for container "+id); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		CPU:    time.Duration(info.CPUStats.CPUUsage.TotalUsage),
+		Memory: info.MemoryStats.Usage,
+	}
+	for _, network := range info.Networks {
+		stats.NetRx += network.RxBytes
+		stats.NetTx += network.TxBytes
+	}
+	for _, entry := range info.BlkioStats.IOServiceBytesRecursive {
+		switch entry.Op {
+		case "Read":
+			stats.DiskRead += entry.Value
+		case "Write":
+			stats.DiskWrite += entry.Value
+		}
+	}
+	return stats, nil
+}
+
+// imageDigest returns the repository digest of the image with the given id,
+// or the id itself if the image has no repository digest.
+func (c *Client) imageDigest(id string) (string, error) {
+	var info struct {
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	if err := c.call("GET", "/images/"+id+"/json", nil, nil, &info, "inspect image "+id); err != nil {
+		return "", err
+	}
+	if len(info.RepoDigests) > 0 {
+		return info.RepoDigests[0], nil
+	}
+	return id, nil
+}
+
+// Exec runs a command in the container with the given id and returns its
+// output. An error is returned if the command exits with a non-zero status.
+func (c *Client) Exec(id string, cmd []string) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	body := map[string]interface{}{
+		"Cmd":          cmd,
+		"AttachStdout": true,
+		"AttachStderr": true,
+	}
+	op := fmt.Sprintf("exec %s in container %s", strings.Join(cmd, " "), id)
+	if err := c.call("POST", "/containers/"+id+"/exec", nil, body, &created, op); err != nil {
+		return "", err
+	}
+
+	resp, err := c.do("POST", "/exec/"+created.ID+"/start", nil, map[string]bool{"Detach": false}, op)
+	if err != nil {
+		return "", err
+	}
+	output, err := readStream(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := c.call("GET", "/exec/"+created.ID+"/json", nil, nil, &info, op); err != nil {
+		return "", err
+	}
+	if info.ExitCode != 0 {
+		return output, fmt.Errorf("docker: %s exited with status %d: %s",
+			strings.Join(cmd, " "), info.ExitCode, strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+func (c *Client) create(config *Config) (string, error) {
+	var (
+		exposed  = make(map[string]struct{}, len(config.Ports))
+		bindings = make(map[string][]map[string]string, len(config.Ports))
+	)
+	for containerPort, hostPort := range config.Ports {
+		if !strings.Contains(containerPort, "/") {
+			containerPort += "/tcp"
+		}
+		exposed[containerPort] = struct{}{}
+		bindings[containerPort] = []map[string]string{{"HostPort": hostPort}}
+	}
+
+	hostConfig := map[string]interface{}{
+		"PortBindings": bindings,
+		"ExtraHosts":   config.ExtraHosts,
+		"Binds":        config.Binds,
+	}
+	if r := config.Resources; r != nil {
+		if err := r.Validate(); err != nil {
+			return "", err
+		}
+		hostConfig["CpusetCpus"] = r.CpusetCpus
+		hostConfig["Memory"] = r.Memory
+		hostConfig["BlkioWeight"] = r.BlkioWeight
+	}
+
+	body := map[string]interface{}{
+		"Image":        config.Image,
+		"Cmd":          config.Cmd,
+		"Env":          config.Env,
+		"Hostname":     config.Hostname,
+		"Labels":       c.Labels,
+		"ExposedPorts": exposed,
+		"HostConfig":   hostConfig,
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := c.call("POST", "/containers/create", nil, body, &created, "create container "+config.Image); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// call performs a request and decodes the JSON response into out, if it's not
+// nil.
+func (c *Client) call(method, path string, query url.Values, body, out interface{}, op string) error {
+	resp, err := c.do(method, path, query, body, op)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do performs a request against the API. Non-2xx responses are returned as an
+// Error. The caller must close the response body.
+func (c *Client) do(method, path string, query url.Values, body interface{}, op string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	version, err := c.apiVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	u := c.baseURL + "/v" + version + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return c.send(method, u, reader, body != nil, op)
+}
+
+// apiVersion returns the API version to use, negotiating it with the engine
+// if it hasn't been. An engine whose supported versions don't overlap the
+// Client's is rejected.
+func (c *Client) apiVersion() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != "" {
+		return c.version, nil
+	}
+
+	resp, err := c.send("GET", c.baseURL+"/version", nil, false, "get version")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		APIVersion    string `json:"ApiVersion"`
+		MinAPIVersion string `json:"MinAPIVersion"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+
+	version := maxAPIVersion
+	if info.APIVersion != "" && versionLess(info.APIVersion, version) {
+		version = info.APIVersion
+	}
+	if versionLess(version, minAPIVersion) ||
+		(info.MinAPIVersion != "" && versionLess(maxAPIVersion, info.MinAPIVersion)) {
+		return "", fmt.Errorf("docker: engine API versions %s to %s aren't supported, %s to %s are",
+			info.MinAPIVersion, info.APIVersion, minAPIVersion, maxAPIVersion)
+	}
+	c.version = version
+	return version, nil
+}
+
+// send performs a request against the URL. Non-2xx responses are returned as
+// an Error. The caller must close the response body.
+func (c *Client) send(method, u string, reader io.Reader, isJSON bool, op string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if isJSON {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, &Error{Op: op, StatusCode: resp.StatusCode, Message: errorMessage(resp.Body)}
+	}
+	return resp, nil
+}
+
+// errorMessage extracts the error message from an API error response body.
+func errorMessage(body io.Reader) string {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err.Error()
+	}
+
+	var message struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &message); err == nil && message.Message != "" {
+		return message.Message
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// versionLess returns true if API version a is older than b. Versions are
+// compared by their dot-separated numbers, so 1.9 is older than 1.24.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// readStream reads a multiplexed stdout/stderr stream, as returned when
+// attaching to a container without a TTY, and returns the combined output.
+// Each frame has an 8-byte header whose last four bytes are the big-endian
+// payload size.
+func readStream(r io.Reader) (string, error) {
+	var (
+		output bytes.Buffer
+		header = make([]byte, 8)
+	)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return output.String(), nil
+		} else if err != nil {
+			return output.String(), err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(&output, r, size); err != nil {
+			return output.String(), err
+		}
+	}
+}
+
+// splitImage splits an image reference into its name and either its digest or
+// its tag. A digest takes precedence over a tag, and the tag is latest if
+// neither is provided.
+func splitImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		name, _ := splitImage(image[:i])
+		return name, image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+func tlsConfigFromEnv() (*tls.Config, error) {
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		return nil, errors.New("DOCKER_CERT_PATH not set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(certPath, "cert.pem"),
+		filepath.Join(certPath, "key.pem"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("Invalid Docker CA certificate")
+	}
+	return config, nil
+}
@@ -0,0 +1,446 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// engineVersion is the fake engine's API version, which is older than
+// maxAPIVersion so the Client negotiates down to it.
+const engineVersion = "1.41"
+
+// engine is a fake Docker Engine. Handlers are keyed by method and path,
+// without the API version. Requests other than for the engine's version are
+// only recorded if they use the API version the engine supports.
+type engine struct {
+	*httptest.Server
+	handlers map[string]http.HandlerFunc
+	requests []string
+}
+
+func newEngine(t *testing.T) (*engine, *Client) {
+	e := &engine{handlers: make(map[string]http.HandlerFunc)}
+	e.handle("GET", "/version", reply(http.StatusOK, `{"ApiVersion":"`+engineVersion+`","MinAPIVersion":"1.12"}`))
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path != "/version" {
+			if !strings.HasPrefix(path, "/v"+engineVersion+"/") {
+				http.Error(w, `{"message":"unsupported version `+path+`"}`, http.StatusBadRequest)
+				return
+			}
+			path = strings.TrimPrefix(path, "/v"+engineVersion)
+			e.requests = append(e.requests, r.Method+" "+path)
+		}
+		key := r.Method + " " + path
+		handler, ok := e.handlers[key]
+		if !ok {
+			http.Error(w, `{"message":"unexpected request `+key+`"}`, http.StatusTeapot)
+			return
+		}
+		handler(w, r)
+	}))
+
+	c, err := NewClient(e.URL)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	return e, c
+}
+
+func (e *engine) handle(method, path string, handler http.HandlerFunc) {
+	e.handlers[method+" "+path] = handler
+}
+
+func (e *engine) called(method, path string) bool {
+	for _, r := range e.requests {
+		if r == method+" "+path {
+			return true
+		}
+	}
+	return false
+}
+
+func reply(code int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		fmt.Fprint(w, body)
+	}
+}
+
+// stream encodes the output as frames of a multiplexed stdout/stderr stream.
+func stream(frames ...string) string {
+	var b bytes.Buffer
+	for i, frame := range frames {
+		header := make([]byte, 8)
+		header[0] = byte(1 + i%2)
+		binary.BigEndian.PutUint32(header[4:], uint32(len(frame)))
+		b.Write(header)
+		b.WriteString(frame)
+	}
+	return b.String()
+}
+
+const inspectBody = `{
+	"Id": "abc",
+	"Image": "sha256:123",
+	"Config": {"Image": "nats:latest"},
+	"State": {"Pid": 42},
+	"NetworkSettings": {"Ports": {
+		"4222/tcp": [{"HostIp": "0.0.0.0", "HostPort": "5000"}],
+		"8222/tcp": null
+	}}
+}`
+
+func TestRun(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+	c.Labels = map[string]string{"flotilla": "true"}
+
+	var (
+		creates int
+		created map[string]interface{}
+	)
+	e.handle("POST", "/containers/create", func(w http.ResponseWriter, r *http.Request) {
+		creates++
+		if creates == 1 {
+			reply(http.StatusNotFound, `{"message":"No such image: nats:latest"}`)(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+			t.Errorf("Invalid create body: %s", err)
+		}
+		reply(http.StatusCreated, `{"Id":"abc"}`)(w, r)
+	})
+	e.handle("POST", "/images/create", func(w http.ResponseWriter, r *http.Request) {
+		if image, tag := r.URL.Query().Get("fromImage"), r.URL.Query().Get("tag"); image != "nats" || tag != "latest" {
+			t.Errorf("Expected to pull nats:latest, got %s:%s", image, tag)
+		}
+		reply(http.StatusOK, `{"status":"Pulling"}{"status":"Done"}`)(w, r)
+	})
+	e.handle("POST", "/containers/abc/start", reply(http.StatusNoContent, ""))
+	e.handle("GET", "/containers/abc/json", reply(http.StatusOK, inspectBody))
+	e.handle("GET", "/images/sha256:123/json", reply(http.StatusOK, `{"RepoDigests":["nats@sha256:456"]}`))
+
+	container, err := c.Run(&Config{
+		Image: "nats",
+		Cmd:   []string{"-m", "8222"},
+		Ports: map[string]string{"4222": "5000"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	if creates != 2 {
+		t.Errorf("Expected the container to be created again after pulling, got %d creates", creates)
+	}
+	if created["Image"] != "nats" {
+		t.Errorf("Expected image nats, got %v", created["Image"])
+	}
+	if labels, _ := created["Labels"].(map[string]interface{}); labels["flotilla"] != "true" {
+		t.Errorf("Expected the client's labels, got %v", created["Labels"])
+	}
+	if _, ok := created["ExposedPorts"].(map[string]interface{})["4222/tcp"]; !ok {
+		t.Errorf("Expected 4222/tcp to be exposed, got %v", created["ExposedPorts"])
+	}
+
+	if container.ID != "abc" || container.Image != "nats:latest" || container.Pid != 42 {
+		t.Errorf("Unexpected container %+v", container)
+	}
+	if container.Digest != "nats@sha256:456" {
+		t.Errorf("Expected the repository digest, got %s", container.Digest)
+	}
+	if len(container.Ports) != 1 || container.Ports["4222"] != "5000" {
+		t.Errorf("Expected port 4222 on 5000, got %v", container.Ports)
+	}
+}
+
+func TestRunStartFailed(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	e.handle("POST", "/containers/create", reply(http.StatusCreated, `{"Id":"abc"}`))
+	e.handle("POST", "/containers/abc/start", reply(http.StatusInternalServerError, `{"message":"port is already allocated"}`))
+	e.handle("DELETE", "/containers/abc", reply(http.StatusNoContent, ""))
+
+	_, err := c.Run(&Config{Image: "nats"})
+	if err == nil || !strings.Contains(err.Error(), "port is already allocated") {
+		t.Fatalf("Expected start error, got %v", err)
+	}
+	if !e.called("DELETE", "/containers/abc") {
+		t.Error("Expected the container to be removed after failing to start")
+	}
+}
+
+func TestRunInspectFailed(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	e.handle("POST", "/containers/create", reply(http.StatusCreated, `{"Id":"abc"}`))
+	e.handle("POST", "/containers/abc/start", reply(http.StatusNoContent, ""))
+	e.handle("GET", "/containers/abc/json", reply(http.StatusInternalServerError, `{"message":"engine busy"}`))
+	e.handle("DELETE", "/containers/abc", reply(http.StatusNoContent, ""))
+
+	_, err := c.Run(&Config{Image: "nats"})
+	if err == nil || !strings.Contains(err.Error(), "engine busy") {
+		t.Fatalf("Expected inspect error, got %v", err)
+	}
+	if !e.called("DELETE", "/containers/abc") {
+		t.Error("Expected the container to be removed after failing to inspect it")
+	}
+}
+
+func TestRunInvalidResources(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	_, err := c.Run(&Config{Image: "nats", Resources: &Resources{BlkioWeight: 5}})
+	if err == nil {
+		t.Fatal("Expected invalid resources to fail")
+	}
+	if len(e.requests) != 0 {
+		t.Errorf("Expected no requests, got %v", e.requests)
+	}
+}
+
+func TestPull(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	tests := []struct {
+		image string
+		name  string
+		tag   string
+		body  string
+		err   string
+	}{
+		{"nats", "nats", "latest", `{"status":"Done"}`, ""},
+		{"rabbitmq:3-management", "rabbitmq", "3-management", "", ""},
+		{"localhost:5000/kafka", "localhost:5000/kafka", "latest", "", ""},
+		{"nats@sha256:" + digest, "nats", "sha256:" + digest, "", ""},
+		{"localhost:5000/nats:0.7.2@sha256:" + digest, "localhost:5000/nats", "sha256:" + digest, "", ""},
+		{"nats:bogus", "nats", "bogus", `{"status":"Pulling"}{"error":"manifest unknown"}`, "manifest unknown"},
+	}
+
+	for _, test := range tests {
+		e, c := newEngine(t)
+		e.handle("POST", "/images/create", func(w http.ResponseWriter, r *http.Request) {
+			if name, tag := r.URL.Query().Get("fromImage"), r.URL.Query().Get("tag"); name != test.name || tag != test.tag {
+				t.Errorf("%s: expected %s:%s, got %s:%s", test.image, test.name, test.tag, name, tag)
+			}
+			reply(http.StatusOK, test.body)(w, r)
+		})
+
+		err := c.Pull(test.image)
+		e.Close()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: Pull failed: %s", test.image, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.image, test.err, err)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	e.handle("GET", "/containers/abc/json", reply(http.StatusOK, inspectBody))
+	e.handle("GET", "/images/sha256:123/json", reply(http.StatusOK, `{"RepoDigests":[]}`))
+	e.handle("GET", "/containers/missing/json", reply(http.StatusNotFound, `{"message":"No such container: missing"}`))
+
+	container, err := c.Inspect("abc")
+	if err != nil {
+		t.Fatalf("Inspect failed: %s", err)
+	}
+	if container.Digest != "sha256:123" {
+		t.Errorf("Expected the image ID for an image without a repository digest, got %s", container.Digest)
+	}
+
+	if _, err := c.Inspect("missing"); !IsNotFound(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	exitCode := 0
+	e.handle("POST", "/containers/abc/exec", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Cmd []string
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if strings.Join(body.Cmd, " ") != "tc qdisc show" {
+			t.Errorf("Unexpected command %v", body.Cmd)
+		}
+		reply(http.StatusCreated, `{"Id":"exec1"}`)(w, r)
+	})
+	e.handle("POST", "/exec/exec1/start", reply(http.StatusOK, stream("qdisc netem ", "delay 10ms\n")))
+	e.handle("GET", "/exec/exec1/json", func(w http.ResponseWriter, r *http.Request) {
+		reply(http.StatusOK, fmt.Sprintf(`{"ExitCode":%d}`, exitCode))(w, r)
+	})
+
+	output, err := c.Exec("abc", []string{"tc", "qdisc", "show"})
+	if err != nil {
+		t.Fatalf("Exec failed: %s", err)
+	}
+	if output != "qdisc netem delay 10ms\n" {
+		t.Errorf("Unexpected output %q", output)
+	}
+
+	exitCode = 2
+	output, err = c.Exec("abc", []string{"tc", "qdisc", "show"})
+	if err == nil || !strings.Contains(err.Error(), "exited with status 2") {
+		t.Fatalf("Expected non-zero exit status to fail, got %v", err)
+	}
+	if output != "qdisc netem delay 10ms\n" {
+		t.Errorf("Expected output of the failed command, got %q", output)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	e, c := newEngine(t)
+	defer e.Close()
+
+	e.handle("DELETE", "/containers/abc", func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.Query(); q.Get("force") != "1" || q.Get("v") != "1" {
+			t.Errorf("Expected forced removal with volumes, got %s", r.URL.RawQuery)
+		}
+		reply(http.StatusNoContent, "")(w, r)
+	})
+	e.handle("DELETE", "/containers/missing", reply(http.StatusNotFound, `{"message":"No such container: missing"}`))
+
+	if err := c.Remove("abc"); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	if err := c.Remove("missing"); !IsNotFound(err) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		code    int
+		body    string
+		message string
+	}{
+		{http.StatusNotFound, `{"message":"No such container: abc"}`, "No such container: abc"},
+		{http.StatusInternalServerError, "plain text failure\n", "plain text failure"},
+		{http.StatusConflict, `{"message":""}`, `{"message":""}`},
+		{http.StatusBadRequest, "", ""},
+	}
+
+	for _, test := range tests {
+		e, c := newEngine(t)
+		e.handle("POST", "/containers/abc/kill", reply(test.code, test.body))
+		err := c.Kill("abc")
+		e.Close()
+
+		dockerErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%d: expected *Error, got %v", test.code, err)
+			continue
+		}
+		if dockerErr.StatusCode != test.code || dockerErr.Message != test.message || dockerErr.Op != "kill container abc" {
+			t.Errorf("%d: unexpected error %+v", test.code, dockerErr)
+		}
+		if IsNotFound(err) != (test.code == http.StatusNotFound) {
+			t.Errorf("%d: IsNotFound returned %v", test.code, IsNotFound(err))
+		}
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	output, err := readStream(strings.NewReader(stream("out", "err", "")))
+	if err != nil || output != "outerr" {
+		t.Fatalf("Expected %q, got %q (%v)", "outerr", output, err)
+	}
+
+	// A frame cut short is an error, but the output so far is kept.
+	truncated := stream("out", "truncated")
+	output, err = readStream(strings.NewReader(truncated[:len(truncated)-3]))
+	if err == nil || output != "outtrunca" {
+		t.Fatalf("Expected truncated stream to fail, got %q (%v)", output, err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		baseURL  string
+	}{
+		{"unix:///var/run/docker.sock", unixBaseURL},
+		{"tcp://10.0.0.1:2375", "http://10.0.0.1:2375"},
+		{"http://localhost:2375/", "http://localhost:2375"},
+	}
+	for _, test := range tests {
+		c, err := NewClient(test.endpoint)
+		if err != nil {
+			t.Errorf("%s: NewClient failed: %s", test.endpoint, err)
+			continue
+		}
+		if c.baseURL != test.baseURL {
+			t.Errorf("%s: expected base URL %s, got %s", test.endpoint, test.baseURL, c.baseURL)
+		}
+	}
+
+	if _, err := NewClient("ftp://localhost"); err == nil {
+		t.Error("Expected invalid endpoint to fail")
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	tests := []struct {
+		version, min string
+		expected     string
+	}{
+		{"1.47", "1.24", "1.47"},
+		{"1.52", "1.44", "1.47"},
+		{"1.30", "1.12", "1.30"},
+		{"", "", maxAPIVersion},
+		{"1.23", "1.12", ""},
+		{"1.60", "1.50", ""},
+	}
+
+	for _, test := range tests {
+		var calls int
+		e, c := newEngine(t)
+		e.handle("GET", "/version", func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			reply(http.StatusOK, `{"ApiVersion":"`+test.version+`","MinAPIVersion":"`+test.min+`"}`)(w, r)
+		})
+
+		version, err := c.apiVersion()
+		if test.expected == "" && err == nil {
+			t.Errorf("%s to %s: expected the engine to be unsupported, got %s", test.min, test.version, version)
+		}
+		if test.expected != "" && (err != nil || version != test.expected) {
+			t.Errorf("%s to %s: expected %s, got %s, %v", test.min, test.version, test.expected, version, err)
+		}
+		if test.expected != "" {
+			c.apiVersion()
+			if calls != 1 {
+				t.Errorf("%s to %s: expected the version to be negotiated once, got %d", test.min, test.version, calls)
+			}
+		}
+		e.Close()
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	less := [][2]string{{"1.9", "1.24"}, {"1.24", "1.47"}, {"1", "1.0"}, {"1.47", "2.0"}}
+	for _, versions := range less {
+		if !versionLess(versions[0], versions[1]) || versionLess(versions[1], versions[0]) {
+			t.Errorf("Expected %s to be older than %s", versions[0], versions[1])
+		}
+	}
+	if versionLess("1.24", "1.24") {
+		t.Error("Expected a version not to be older than itself")
+	}
+}
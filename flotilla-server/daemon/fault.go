@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"log"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// containerized is implemented by brokers which run their node in a Docker
+// container, which allows faults to be injected into it.
+type containerized interface {
+	// Container returns the ID of the container running the broker node.
+	Container() string
+}
+
+// processFaults schedules the faults against the session's broker node. Any
+// previously scheduled faults which haven't happened yet are cancelled.
+func (d *Daemon) processFaults(s *session, req request) error {
+	if err := s.brokerRunning(); err != nil {
+		return err
+	}
+
+	node, ok := s.broker.(containerized)
+	if !ok {
+		return invalidRequest("Fault injection is not supported for %s", req.Broker)
+	}
+
+	for _, f := range req.Faults {
+		if f.Action != protocol.FaultKill && f.Action != protocol.FaultRestart {
+			return invalidRequest("Invalid fault action %s", f.Action)
+		}
+		if f.After < 0 {
+			return invalidRequest("Invalid fault offset %d", f.After)
+		}
+	}
+
+	d.cancelFaults(s)
+	container := node.Container()
+	for _, f := range req.Faults {
+		f := f
+		timer := time.AfterFunc(time.Duration(f.After)*time.Millisecond, func() {
+			d.injectFault(container, f)
+		})
+		s.faults = append(s.faults, timer)
+	}
+
+	log.Printf("Scheduled %d faults", len(req.Faults))
+	return nil
+}
+
+func (d *Daemon) injectFault(container string, f *protocol.Fault) {
+	var err error
+	switch f.Action {
+	case protocol.FaultKill:
+		err = d.docker.Kill(container)
+	case protocol.FaultRestart:
+		err = d.docker.Restart(container)
+	}
+
+	if err != nil {
+		log.Printf("Failed to %s broker node: %s", f.Action, err.Error())
+		return
+	}
+	log.Printf("Injected fault: %s broker node %s", f.Action, container)
+}
+
+// cancelFaults stops any of the session's scheduled faults which haven't
+// happened yet.
+func (d *Daemon) cancelFaults(s *session) {
+	for _, timer := range s.faults {
+		timer.Stop()
+	}
+	s.faults = s.faults[:0]
+}
@@ -0,0 +1,51 @@
+package daemon
+
+import "github.com/tylertreat/Flotilla/protocol"
+
+// Version is the daemon's release, which is reported by the hello operation.
+// It's set when building releases with
+// -ldflags "-X github.com/tylertreat/Flotilla/flotilla-server/daemon.Version=<release>".
+var Version = "dev"
+
+// processHello reports the protocol version the daemon speaks and the
+// operations, brokers and features it supports, which clients check before
+// starting a benchmark.
+func (d *Daemon) processHello() *protocol.HelloResult {
+	result := &protocol.HelloResult{
+		Version:    protocol.Version,
+		Daemon:     Version,
+		Operations: operations,
+		Features: []string{
+			protocol.FeatureSessions,
+			protocol.FeatureFaults,
+			protocol.FeatureImpairment,
+			protocol.FeatureUsage,
+			protocol.FeatureLogs,
+			protocol.FeatureSessionLogs,
+			protocol.FeatureBrokerSecurity,
+		},
+	}
+
+	// Brokers which can't be launched, such as Kestrel with the native
+	// launcher, aren't supported.
+	for _, name := range brokerNames {
+		if _, err := d.newBroker(name); err == nil {
+			result.Brokers = append(result.Brokers, name)
+		}
+	}
+
+	if d.config.Launcher == NativeLauncher {
+		result.Features = append(result.Features, protocol.FeatureNative)
+	}
+	if d.tls {
+		result.Features = append(result.Features, protocol.FeatureTLS)
+	}
+	if len(d.config.Tokens) > 0 {
+		result.Features = append(result.Features, protocol.FeatureAuth)
+	}
+	if d.progress != nil {
+		result.Features = append(result.Features, protocol.FeatureProgress)
+		result.ProgressPort = d.config.ProgressPort
+	}
+	return result
+}
@@ -0,0 +1,187 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// These are the headers HTTP requests are authenticated with. The signature
+// is the hex-encoded HMAC-SHA256, keyed with the token's secret, of the Unix
+// timestamp in seconds, a newline, the method and request URI separated by a
+// space, a newline and the body.
+const (
+	tokenHeader     = "X-Flotilla-Token"
+	timestampHeader = "X-Flotilla-Timestamp"
+	signatureHeader = "X-Flotilla-Signature"
+)
+
+const (
+	// apiPrefix prefixes the paths of the HTTP API.
+	apiPrefix = "/v1/"
+
+	// maxBodySize limits the size of HTTP request bodies, which is enough
+	// for certificates and fault schedules.
+	maxBodySize = 4 << 20
+)
+
+// routes maps the paths of the HTTP API, without apiPrefix, to the operation
+// performed for each method. killRoute is used for sessions/<id>, which kills
+// the session.
+var (
+	killRoute = map[string]protocol.Operation{"DELETE": sessions}
+	routes    = map[string]map[string]protocol.Operation{
+		"hello":       {"GET": hello},
+		"heartbeat":   {"GET": heartbeat},
+		"broker":      {"POST": start, "DELETE": stop},
+		"publishers":  {"POST": pub},
+		"subscribers": {"POST": sub},
+		"run":         {"POST": run},
+		"results":     {"GET": results},
+		"teardown":    {"POST": teardown},
+		"faults":      {"POST": faults},
+		"impairment":  {"POST": impair},
+		"logs":        {"GET": logs},
+		"reap":        {"POST": reap},
+		"sessions":    {"GET": sessions},
+		"status":      {"GET": status},
+	}
+)
+
+// listenHTTP starts serving the HTTP API, if it's enabled.
+func (d *Daemon) listenHTTP() error {
+	if d.http == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", d.config.HTTPPort))
+	if err != nil {
+		return err
+	}
+	if d.http.TLSConfig != nil {
+		ln = tls.NewListener(ln, d.http.TLSConfig)
+	}
+
+	go func() {
+		if err := d.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP API stopped: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
+// ServeHTTP performs the operation for the request's method and path. The
+// body of a POST contains the request's fields, as sent to the daemon's
+// socket without the operation, and the session may be given with the
+// session query parameter instead. The response is the same as on the socket,
+// with the status reflecting whether the operation succeeded: 400, 404 or 409
+// if the request was at fault, such as stopping a broker which isn't running,
+// and 500 if the daemon failed.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+
+	var (
+		req  request
+		kill string
+	)
+	methods, ok := routes[path]
+	if strings.HasPrefix(path, "sessions/") {
+		kill = strings.TrimPrefix(path, "sessions/")
+		methods, ok = killRoute, true
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	op, ok := methods[r.Method]
+	if !ok {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+	if err := d.authenticateHTTP(r, body, op); err != nil {
+		log.Printf("Rejected HTTP %s request: %s", op, err.Error())
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err.Error()))
+		return
+	}
+
+	if r.Method == "POST" && len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+			return
+		}
+	}
+	req.Operation = op
+	req.Kill = kill
+	if session := r.URL.Query().Get("session"); session != "" {
+		req.Session = session
+	}
+
+	if err := req.validate(); err != nil {
+		log.Printf("Invalid HTTP %s request: %s", op, err.Error())
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err.Error()))
+		return
+	}
+
+	resp := d.process(req)
+	code := http.StatusOK
+	if !resp.Success {
+		code = resp.status
+	}
+	writeResponse(w, code, resp)
+}
+
+// authenticateHTTP verifies the signature in the request's headers and that
+// its token may perform the operation. Every request is allowed if the daemon
+// has no tokens.
+func (d *Daemon) authenticateHTTP(r *http.Request, body []byte, op protocol.Operation) error {
+	if len(d.config.Tokens) == 0 {
+		return nil
+	}
+
+	a := &auth{Token: r.Header.Get(tokenHeader), Signature: r.Header.Get(signatureHeader)}
+	if a.Token == "" {
+		return errors.New("Request is not authenticated")
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp: %s", err.Error())
+	}
+	a.Timestamp = timestamp
+
+	signed := append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...)
+	return d.verify(a, signed, op)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeResponse(w, code, response{Response: protocol.Response{Message: message}})
+}
+
+func writeResponse(w http.ResponseWriter, code int, resp response) {
+	respJSON, err := json.Marshal(resp)
+	if err != nil {
+		// This is not recoverable.
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respJSON)
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve performs the HTTP request against the daemon and returns the status
+// and response message.
+func serve(t *testing.T, d *Daemon, method, target, body string) (int, string) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+
+	var resp response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %q: %s", w.Body.String(), err)
+	}
+	return w.Code, resp.Message
+}
+
+func TestHTTPStatus(t *testing.T) {
+	d := newTestDaemon(t)
+	starting := startSlowly(d, "starting")
+	defer d.release(starting)
+	started := startSlowly(d, "started")
+	defer d.release(started)
+	finishStart(started)
+
+	tests := []struct {
+		method, target, body string
+		status               int
+		message              string
+	}{
+		{"GET", "/v1/hello", "", http.StatusOK, ""},
+		{"GET", "/v1/bogus", "", http.StatusNotFound, "Not found"},
+		{"PUT", "/v1/broker", "", http.StatusMethodNotAllowed, "PUT is not allowed on /v1/broker"},
+		{"POST", "/v1/run", "{", http.StatusBadRequest, "Invalid request"},
+		{"GET", "/v1/hello?session=a+b", "", http.StatusBadRequest, "Invalid request"},
+		{"POST", "/v1/broker", `{"broker": "bogus", "host": "localhost", "port": "4222"}`,
+			http.StatusBadRequest, "Invalid broker bogus"},
+		{"POST", "/v1/impairment", "", http.StatusBadRequest, "No impairment provided"},
+		{"POST", "/v1/faults?session=started", `{"faults": [{"after": 0, "action": "kill"}]}`,
+			http.StatusBadRequest, "Fault injection is not supported for "},
+		{"DELETE", "/v1/broker", "", http.StatusNotFound, "No broker running"},
+		{"DELETE", "/v1/sessions/bogus", "", http.StatusNotFound, "No such session bogus"},
+		{"DELETE", "/v1/broker?session=starting", "", http.StatusConflict, "Broker is still starting"},
+		{"POST", "/v1/broker?session=started", `{"broker": "nats", "host": "localhost", "port": "4222"}`,
+			http.StatusConflict, "Broker already running"},
+		{"POST", "/v1/reap", "", http.StatusConflict, "Session starting is starting a broker"},
+		{"POST", "/v1/broker?session=a", `{"broker": "inmem", "host": "localhost", "port": "9013"}`,
+			http.StatusOK, ""},
+		// The address is taken by the first session's broker, so the broker
+		// fails to start.
+		{"POST", "/v1/broker?session=b", `{"broker": "inmem", "host": "localhost", "port": "9013"}`,
+			http.StatusInternalServerError, ""},
+		{"DELETE", "/v1/broker?session=a", "", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		status, message := serve(t, d, test.method, test.target, test.body)
+		if status != test.status || !strings.HasPrefix(message, test.message) {
+			t.Errorf("%s %s: expected %d %q, got %d %q",
+				test.method, test.target, test.status, test.message, status, message)
+		}
+	}
+}
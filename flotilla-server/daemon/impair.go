@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"log"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/netem"
+)
+
+// These are the targets network impairments can be applied to.
+const (
+	hostTarget   = "host"
+	brokerTarget = "broker"
+)
+
+// processImpair applies the requested network impairment to the daemon's host
+// or to the broker node's container. It's reverted on teardown or when the
+// broker is stopped.
+func (d *Daemon) processImpair(s *session, req request) error {
+	if req.Impairment == nil {
+		return invalidRequest("No impairment provided")
+	}
+
+	pid := 0
+	switch req.Target {
+	case "", hostTarget:
+	case brokerTarget:
+		if err := s.brokerRunning(); err != nil {
+			return err
+		}
+
+		node, ok := s.broker.(containerized)
+		if !ok {
+			return invalidRequest("Network impairment is not supported for %s", req.Broker)
+		}
+
+		container, err := d.docker.Inspect(node.Container())
+		if err != nil {
+			return err
+		}
+		pid = container.Pid
+		if pid == 0 {
+			return conflict("Broker node is not running")
+		}
+	default:
+		return invalidRequest("Invalid impairment target %s", req.Target)
+	}
+
+	target := netem.Target(req.Impairment, pid)
+	if err := d.claimImpairment(s, target); err != nil {
+		return err
+	}
+
+	// An impairment the session already applied to the device is changed
+	// rather than added again.
+	if applied := s.impairment(target); applied != nil {
+		if err := applied.Change(req.Impairment); err != nil {
+			return err
+		}
+		log.Printf("Changed network impairment to %s", applied)
+		return nil
+	}
+
+	applied, err := netem.Apply(req.Impairment, pid)
+	if err != nil {
+		d.releaseImpairment(target)
+		return err
+	}
+
+	s.impairments = append(s.impairments, applied)
+	log.Printf("Applied network impairment to %s", applied)
+	return nil
+}
+
+// impairment returns the network impairment the session applied to the
+// target, if any.
+func (s *session) impairment(target string) *netem.Applied {
+	for _, applied := range s.impairments {
+		if applied.String() == target {
+			return applied
+		}
+	}
+	return nil
+}
+
+// claimImpairment records that the session impairs the target, returning a
+// conflict if another session already does.
+func (d *Daemon) claimImpairment(s *session, target string) error {
+	d.impairedMu.Lock()
+	defer d.impairedMu.Unlock()
+	if owner, ok := d.impaired[target]; ok && owner != s.id {
+		return conflict("%s is impaired by session %s", target, owner)
+	}
+	d.impaired[target] = s.id
+	return nil
+}
+
+// releaseImpairment records that the target is no longer impaired.
+func (d *Daemon) releaseImpairment(target string) {
+	d.impairedMu.Lock()
+	defer d.impairedMu.Unlock()
+	delete(d.impaired, target)
+}
+
+// revertImpairments reverts every network impairment applied for the
+// session.
+func (d *Daemon) revertImpairments(s *session) {
+	for _, applied := range s.impairments {
+		if err := applied.Revert(); err != nil {
+			log.Printf("Failed to revert network impairment: %s", err.Error())
+		} else {
+			log.Printf("Reverted network impairment to %s", applied)
+		}
+		d.releaseImpairment(applied.String())
+	}
+	s.impairments = s.impairments[:0]
+}
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// maxLogSize is the most daemon output kept for each session. Older output is
+// discarded.
+const maxLogSize = 4 << 20
+
+var (
+	// sessionLogs copies everything the daemon package and the brokers log to
+	// the buffer of each open session, so that the client can fetch the output
+	// of its benchmark. Daemons in the same process share it, and output
+	// logged while several sessions are open goes to each of them.
+	sessionLogs   = &logSinks{buffers: make(map[*logBuffer]bool)}
+	installLogger sync.Once
+)
+
+// logSinks is an io.Writer which copies everything written to it to a set of
+// logBuffers.
+type logSinks struct {
+	buffers map[*logBuffer]bool
+	mu      sync.Mutex
+}
+
+func (l *logSinks) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for buffer := range l.buffers {
+		buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+func (l *logSinks) add(buffer *logBuffer) {
+	l.mu.Lock()
+	l.buffers[buffer] = true
+	l.mu.Unlock()
+}
+
+func (l *logSinks) remove(buffer *logBuffer) {
+	l.mu.Lock()
+	delete(l.buffers, buffer)
+	l.mu.Unlock()
+}
+
+// logBuffer is an io.Writer which keeps the most recent maxLogSize bytes
+// written to it.
+type logBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if overflow := l.buf.Len() + len(p) - maxLogSize; overflow > 0 {
+		if overflow > l.buf.Len() {
+			overflow = l.buf.Len()
+		}
+		l.buf.Next(overflow)
+	}
+	return l.buf.Write(p)
+}
+
+// String returns the buffered output.
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// Drain returns the buffered output and empties the buffer.
+func (l *logBuffer) Drain() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	output := l.buf.String()
+	l.buf.Reset()
+	return output
+}
+
+// captureLogs tees the standard logger's output into sessionLogs.
+func captureLogs() {
+	installLogger.Do(func() {
+		log.SetOutput(io.MultiWriter(os.Stderr, sessionLogs))
+	})
+}
+
+// processLogs returns the daemon output logged for the session since it was
+// last torn down or its broker stopped, which covers its current benchmark.
+// Fetching it doesn't clear it.
+func (d *Daemon) processLogs(s *session) map[string]string {
+	return map[string]string{"daemon": s.logs.String()}
+}
+
+// logged is implemented by brokers which keep their own output, such as
+// brokers run as native processes.
+type logged interface {
+	// Logs returns the broker's output keyed by source.
+	Logs() map[string]string
+}
+
+// collectBrokerLogs returns the output of each of the session's broker
+// containers or processes, keyed by source. It must be called before the
+// broker is stopped.
+func (d *Daemon) collectBrokerLogs(s *session) map[string]string {
+	logs := make(map[string]string, len(s.containers))
+	if b, ok := s.broker.(logged); ok {
+		for name, output := range b.Logs() {
+			logs[name] = output
+		}
+	}
+	for _, container := range s.containers {
+		name := fmt.Sprintf("%s-%.12s", container.Image, container.ID)
+		output, err := d.docker.Logs(container.ID)
+		if err != nil {
+			log.Printf("Failed to collect logs for container %s: %s", container.ID, err.Error())
+			output += fmt.Sprintf("\n[flotilla] failed to collect logs: %s\n", err.Error())
+		}
+		logs[name] = output
+	}
+	return logs
+}
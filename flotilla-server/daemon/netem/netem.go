@@ -0,0 +1,163 @@
+// Package netem emulates network conditions, such as added latency, packet
+// loss and limited bandwidth, using the Linux tc netem queueing discipline.
+// Impairments can be applied to the host or to the network namespace of a
+// process, such as a container's. Applying them requires the tc and nsenter
+// commands and root privileges.
+package netem
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// DefaultDevice is the network interface impaired if none is given.
+const DefaultDevice = "eth0"
+
+// devicePattern matches network interface names. Linux limits them to 15
+// characters; the first must be alphanumeric so the name can't be taken for
+// an option by tc.
+var devicePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,14}$`)
+
+// Impairment describes the network conditions to emulate. It's the
+// protocol's Impairment, with the methods to apply it. DefaultDevice is
+// impaired if no device is given.
+type Impairment protocol.Impairment
+
+// Validate returns an error if the Impairment is invalid.
+func (i *Impairment) Validate() error {
+	if i.Delay < 0 || i.Jitter < 0 || i.Rate < 0 {
+		return errors.New("Delay, jitter and rate must not be negative")
+	}
+	if i.Jitter > 0 && i.Delay == 0 {
+		return errors.New("Jitter requires a delay")
+	}
+	if i.Loss < 0 || i.Loss > 100 {
+		return fmt.Errorf("Invalid loss %g%%", i.Loss)
+	}
+	if i.Delay == 0 && i.Loss == 0 && i.Rate == 0 {
+		return errors.New("Impairment has no effect")
+	}
+	if !devicePattern.MatchString(i.device()) {
+		return fmt.Errorf("Invalid device %q", i.device())
+	}
+	return nil
+}
+
+func (i *Impairment) device() string {
+	if i.Device == "" {
+		return DefaultDevice
+	}
+	return i.Device
+}
+
+// netemArgs returns the netem parameters for the Impairment.
+func (i *Impairment) netemArgs() []string {
+	args := []string{"netem"}
+	if i.Delay > 0 {
+		args = append(args, "delay", strconv.FormatInt(i.Delay, 10)+"ms")
+		if i.Jitter > 0 {
+			args = append(args, strconv.FormatInt(i.Jitter, 10)+"ms")
+		}
+	}
+	if i.Loss > 0 {
+		args = append(args, "loss", strconv.FormatFloat(i.Loss, 'f', -1, 64)+"%")
+	}
+	if i.Rate > 0 {
+		args = append(args, "rate", strconv.Itoa(i.Rate)+"kbit")
+	}
+	return args
+}
+
+// lastHandle is the handle of the last qdisc added. Each impairment's qdisc
+// gets its own handle, so reverting it can't remove another's.
+var lastHandle uint32
+
+// Applied is an Impairment which has been applied and can be changed or
+// reverted.
+type Applied struct {
+	device string
+	pid    int
+	handle string
+}
+
+// Apply applies the Impairment to the host if pid is zero, otherwise to the
+// network namespace of the process with the given pid. It fails if the device
+// already has a queueing discipline other than its default, such as another
+// impairment, rather than replacing it.
+func Apply(i *Impairment, pid int) (*Applied, error) {
+	if err := i.Validate(); err != nil {
+		return nil, err
+	}
+
+	handle := atomic.AddUint32(&lastHandle, 1)%0xffff + 1
+	applied := &Applied{
+		device: i.device(),
+		pid:    pid,
+		handle: strconv.FormatUint(uint64(handle), 16) + ":",
+	}
+	if err := tc(pid, applied.qdiscArgs("add", i)); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Change replaces the applied impairment's network conditions with the
+// Impairment's, which must be for the same device.
+func (a *Applied) Change(i *Impairment) error {
+	if err := i.Validate(); err != nil {
+		return err
+	}
+	if i.device() != a.device {
+		return fmt.Errorf("Impairment of %s can't be changed to %s", a.device, i.device())
+	}
+	return tc(a.pid, a.qdiscArgs("change", i))
+}
+
+// Revert removes the applied impairment, restoring the device's default
+// queueing discipline. It fails without removing anything if the impairment
+// has since been replaced.
+func (a *Applied) Revert() error {
+	return tc(a.pid, []string{"qdisc", "del", "dev", a.device, "root", "handle", a.handle})
+}
+
+// String returns a description of where the impairment was applied.
+func (a *Applied) String() string {
+	return Target(&Impairment{Device: a.device}, a.pid)
+}
+
+// Target returns a description of where the Impairment is applied for the
+// given pid. Impairments with the same target impair the same device.
+func Target(i *Impairment, pid int) string {
+	if pid == 0 {
+		return i.device()
+	}
+	return fmt.Sprintf("%s (pid %d)", i.device(), pid)
+}
+
+// qdiscArgs returns the tc arguments to add or change the applied netem
+// qdisc with the Impairment's parameters.
+func (a *Applied) qdiscArgs(command string, i *Impairment) []string {
+	return append([]string{"qdisc", command, "dev", a.device, "root", "handle", a.handle}, i.netemArgs()...)
+}
+
+func tc(pid int, args []string) error {
+	name := "tc"
+	if pid != 0 {
+		name = "nsenter"
+		args = append([]string{"-t", strconv.Itoa(pid), "-n", "tc"}, args...)
+	}
+
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err.Error(),
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
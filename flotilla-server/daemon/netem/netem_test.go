@@ -0,0 +1,76 @@
+package netem
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDevice(t *testing.T) {
+	valid := []string{"", "eth0", "ens3", "enp0s31f6", "br-1a2b3c4d5e6f", "veth_1.100", "wlp2s0"}
+	invalid := []string{
+		" eth0",
+		"eth0 ",
+		"eth 0",
+		"eth0\n",
+		"eth0\x00",
+		"a/b",
+		"../x",
+		".",
+		"..",
+		"-eth0",
+		"eth0;id",
+		"$(id)",
+		"`id`",
+		"eth0:1",
+		strings.Repeat("a", 16),
+	}
+
+	for _, device := range valid {
+		i := &Impairment{Delay: 10, Device: device}
+		if err := i.Validate(); err != nil {
+			t.Errorf("Expected %q to be valid, got %s", device, err)
+		}
+	}
+	for _, device := range invalid {
+		i := &Impairment{Delay: 10, Device: device}
+		if err := i.Validate(); err == nil {
+			t.Errorf("Expected %q to be invalid", device)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := map[string]*Impairment{
+		"no effect":        {},
+		"negative delay":   {Delay: -1},
+		"negative rate":    {Rate: -1},
+		"negative jitter":  {Delay: 10, Jitter: -1},
+		"jitter alone":     {Jitter: 10},
+		"negative loss":    {Loss: -1},
+		"loss over 100":    {Loss: 100.5},
+		"zero with device": {Device: "eth0"},
+	}
+
+	if err := (&Impairment{Delay: 100, Jitter: 10, Loss: 0.5, Rate: 1024}).Validate(); err != nil {
+		t.Errorf("Expected impairment to be valid, got %s", err)
+	}
+	for name, i := range invalid {
+		if err := i.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
+
+func TestQdiscArgs(t *testing.T) {
+	i := &Impairment{Delay: 100, Jitter: 10, Loss: 0.5, Rate: 1024, Device: "eth1"}
+	first := &Applied{device: "eth1", handle: "1a:"}
+	expected := "qdisc add dev eth1 root handle 1a: netem delay 100ms 10ms loss 0.5% rate 1024kbit"
+	if args := strings.Join(first.qdiscArgs("add", i), " "); args != expected {
+		t.Errorf("Expected %q, got %q", expected, args)
+	}
+
+	second := &Applied{device: "eth1", pid: 42, handle: "1b:"}
+	if first.String() != Target(i, 0) || second.String() != Target(i, 42) || first.String() == second.String() {
+		t.Errorf("Unexpected targets %s and %s", first, second)
+	}
+}
@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	pubsocket "github.com/go-mangos/mangos/protocol/pub"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+const progressInterval = time.Second
+
+// progressMark is the progress last published for a session.
+type progressMark struct {
+	published int64
+	received  int64
+	time      time.Time
+}
+
+// newProgressSocket returns the PUB socket progress is published on.
+func newProgressSocket(tlsConfig *tls.Config) (mangos.Socket, error) {
+	s, err := pubsocket.NewSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := addTransport(s, tlsConfig); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// listenProgress listens for progress subscribers and starts publishing, if
+// progress is enabled.
+func (d *Daemon) listenProgress() error {
+	if d.progress == nil {
+		return nil
+	}
+	if err := d.progress.Listen(d.URL(fmt.Sprintf(":%d", d.config.ProgressPort))); err != nil {
+		return err
+	}
+	go d.publishProgress()
+	return nil
+}
+
+// publishProgress periodically publishes the progress of every session with
+// peers until the Daemon is closed. Each session's progress is published
+// under its topic, so clients only receive their own.
+func (d *Daemon) publishProgress() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-d.closed:
+			return
+		case now = <-ticker.C:
+		}
+
+		updates := d.sessionProgress(now)
+
+		for _, p := range updates {
+			msg, err := protocol.EncodeProgress(p)
+			if err != nil {
+				log.Printf("Failed to encode progress: %s", err.Error())
+				continue
+			}
+			if err := d.progress.Send(msg); err == mangos.ErrClosed {
+				return
+			} else if err != nil {
+				log.Printf("Failed to publish progress: %s", err.Error())
+			}
+		}
+	}
+}
+
+// sessionProgress returns the progress of each session with peers.
+func (d *Daemon) sessionProgress(now time.Time) []*protocol.Progress {
+	var updates []*protocol.Progress
+	for _, s := range d.allSessions() {
+		if p := s.progressUpdate(now); p != nil {
+			updates = append(updates, p)
+		}
+	}
+	return updates
+}
+
+// progressUpdate returns the session's progress, or nil if it has no peers.
+// Rates are computed from its previous progress.
+func (s *session) progressUpdate(now time.Time) *protocol.Progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.publishers) == 0 && len(s.subscribers) == 0 {
+		s.progress = nil
+		return nil
+	}
+
+	p := &protocol.Progress{Session: s.id, Done: true}
+	var results []*protocol.Result
+	for _, publisher := range s.publishers {
+		p.Published += atomic.LoadInt64(&publisher.sent)
+		r, _ := publisher.getResults()
+		results = append(results, r)
+	}
+	for _, subscriber := range s.subscribers {
+		p.Received += atomic.LoadInt64(&subscriber.received)
+		r, _ := subscriber.getResults()
+		results = append(results, r)
+	}
+	for _, r := range results {
+		if r == nil {
+			p.Done = false
+		} else if r.Err != "" {
+			p.Errors++
+		}
+	}
+
+	if last := s.progress; last != nil {
+		if elapsed := now.Sub(last.time).Seconds(); elapsed > 0 {
+			p.PublishRate = float64(p.Published-last.published) / elapsed
+			p.ReceiveRate = float64(p.Received-last.received) / elapsed
+		}
+	}
+	s.progress = &progressMark{published: p.Published, received: p.Received, time: now}
+	return p
+}
@@ -1,37 +1,75 @@
 package daemon
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+const (
+	// sequenceOffset is where the publisher's tag and the message's sequence
+	// number are written, following the varint timestamp.
+	sequenceOffset = binary.MaxVarintLen64
+
+	// sequencedSize is the smallest message which can be sequenced.
+	// Subscribers can only count lost and duplicate messages if they're
+	// sequenced.
+	sequencedSize = sequenceOffset + 8
 )
 
 type publisher struct {
+	// sent is the number of messages sent so far, accessed atomically. It's
+	// first for 64-bit alignment.
+	sent int64
+
 	peer
 	id          int
+	tag         uint32
 	numMessages int
 	messageSize int64
-	results     *result
+	results     *protocol.Result
 	mu          sync.Mutex
 }
 
+// newTag returns a random tag identifying a publisher's messages. It's random
+// so that publishers on different daemons don't collide.
+func newTag() (uint32, error) {
+	tag := make([]byte, 4)
+	if _, err := rand.Read(tag); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(tag), nil
+}
+
 func (p *publisher) start() {
 	p.Setup()
 	defer p.Done()
 
 	var (
-		send    = p.Send()
-		errors  = p.Errors()
-		message = make([]byte, p.messageSize)
-		start   = time.Now().UnixNano()
+		send   = p.Send()
+		errors = p.Errors()
+		start  = time.Now().UnixNano()
 	)
 
+	sequenced := p.messageSize >= sequencedSize
 	for i := 0; i < p.numMessages; i++ {
+		// Peers may still be publishing a message after taking it from the
+		// channel, so each one gets its own buffer.
+		message := make([]byte, p.messageSize)
 		binary.PutVarint(message, time.Now().UnixNano())
+		if sequenced {
+			binary.BigEndian.PutUint32(message[sequenceOffset:], p.tag)
+			binary.BigEndian.PutUint32(message[sequenceOffset+4:], uint32(i))
+		}
 		select {
 		case send <- message:
+			atomic.AddInt64(&p.sent, 1)
 			continue
 		case err := <-errors:
 			// TODO: If a publish fails, a subscriber will probably deadlock.
@@ -39,7 +77,7 @@ func (p *publisher) start() {
 			// a publisher failed so it can orchestrate a shutdown.
 			log.Printf("Failed to send message: %s", err.Error())
 			p.mu.Lock()
-			p.results = &result{Err: err.Error()}
+			p.results = &protocol.Result{Err: err.Error()}
 			p.mu.Unlock()
 			return
 		}
@@ -47,7 +85,7 @@ func (p *publisher) start() {
 	stop := time.Now().UnixNano()
 	ms := float32(stop-start) / 1000000
 	p.mu.Lock()
-	p.results = &result{
+	p.results = &protocol.Result{
 		Duration:   ms,
 		Throughput: 1000 * float32(p.numMessages) / ms,
 	}
@@ -55,7 +93,7 @@ func (p *publisher) start() {
 	log.Println("Publisher completed")
 }
 
-func (p *publisher) getResults() (*result, error) {
+func (p *publisher) getResults() (*protocol.Result, error) {
 	p.mu.Lock()
 	r := p.results
 	p.mu.Unlock()
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/broker/inmem"
+)
+
+// TestPublisherMessages checks the payload of every message a publisher sends.
+// Run it with -race to catch the publisher modifying a message a peer is
+// still publishing.
+func TestPublisherMessages(t *testing.T) {
+	b := &inmem.Broker{}
+	if _, err := b.Start("localhost", "9014", nil); err != nil {
+		t.Fatalf("Start failed: %s", err)
+	}
+	defer b.Stop()
+
+	receiver, err := inmem.NewPeer("localhost:9014", nil)
+	if err != nil {
+		t.Fatalf("NewPeer failed: %s", err)
+	}
+	if err := receiver.Subscribe(); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	defer receiver.Teardown()
+
+	sender, err := inmem.NewPeer("localhost:9014", nil)
+	if err != nil {
+		t.Fatalf("NewPeer failed: %s", err)
+	}
+	defer sender.Teardown()
+
+	const numMessages = 5000
+	p := &publisher{
+		peer:        sender,
+		tag:         42,
+		numMessages: numMessages,
+		messageSize: sequencedSize,
+	}
+	start := time.Now().UnixNano()
+	go p.start()
+
+	var sent int64
+	for i := 0; i < numMessages; i++ {
+		msg, err := receiver.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %s", err)
+		}
+		if len(msg) != sequencedSize {
+			t.Fatalf("Message %d: expected %d bytes, got %d", i, sequencedSize, len(msg))
+		}
+		if tag := binary.BigEndian.Uint32(msg[sequenceOffset:]); tag != p.tag {
+			t.Fatalf("Message %d: expected tag %d, got %d", i, p.tag, tag)
+		}
+		if n := binary.BigEndian.Uint32(msg[sequenceOffset+4:]); n != uint32(i) {
+			t.Fatalf("Message %d: got sequence number %d", i, n)
+		}
+		timestamp, _ := binary.Varint(msg)
+		if timestamp < start || timestamp < sent || timestamp > time.Now().UnixNano() {
+			t.Fatalf("Message %d: invalid timestamp %d", i, timestamp)
+		}
+		sent = timestamp
+	}
+}
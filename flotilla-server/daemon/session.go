@@ -0,0 +1,236 @@
+package daemon
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/netem"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/usage"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// defaultSession is the session used by requests which don't provide one.
+const defaultSession = "default"
+
+// session is the broker and peer state of one benchmark. Each session is
+// isolated, so several benchmarks can share a daemon without one's teardown
+// affecting another's peers or broker.
+type session struct {
+	// mu serializes the session's requests and guards its state. It's never
+	// held while acquiring the Daemon's lock.
+	mu sync.Mutex
+
+	// refs counts the requests using the session, which isn't discarded
+	// until none are, and acquired counts the requests which have used it.
+	// They're guarded by the Daemon's lock.
+	refs     int
+	acquired int
+
+	id          string
+	broker      broker
+	publishers  []*publisher
+	subscribers []*subscriber
+	faults      []*time.Timer
+	impairments []*netem.Applied
+	containers  []*docker.Container
+	started     *request
+	startResult interface{}
+	launched    time.Time
+	sampler     *usage.Sampler
+	usage       map[string]*protocol.Usage
+	created     time.Time
+	active      time.Time
+
+	// progress is the session's last published progress, which rates are
+	// computed from.
+	progress *progressMark
+
+	// running is true once the session's publishers have been told to run,
+	// until its peers are torn down.
+	running bool
+
+	// logs contains the daemon output logged while the session is open. It's
+	// returned and cleared when the session's peers are torn down or its
+	// broker is stopped.
+	logs *logBuffer
+
+	// starting is closed once the broker being started is ready or has
+	// failed to start. It's nil unless the broker is starting.
+	starting chan struct{}
+}
+
+// sessionInfo describes a session in response to a sessions request.
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	Broker      string    `json:"broker,omitempty"`
+	Containers  []string  `json:"containers,omitempty"`
+	Publishers  int       `json:"publishers"`
+	Subscribers int       `json:"subscribers"`
+	Created     time.Time `json:"created"`
+	Active      time.Time `json:"active"`
+}
+
+// idle returns true if the session has no broker or peers, in which case it
+// can be discarded.
+func (s *session) idle() bool {
+	return s.broker == nil && len(s.publishers) == 0 && len(s.subscribers) == 0 &&
+		len(s.impairments) == 0 && s.sampler == nil
+}
+
+// brokerRunning returns an error unless the session's broker has started and
+// is ready.
+func (s *session) brokerRunning() error {
+	if s.broker == nil {
+		return notFound("No broker running")
+	}
+	if s.starting != nil {
+		return conflict("Broker is still starting")
+	}
+	return nil
+}
+
+func (s *session) info() *sessionInfo {
+	info := &sessionInfo{
+		ID:          s.id,
+		Publishers:  len(s.publishers),
+		Subscribers: len(s.subscribers),
+		Created:     s.created,
+		Active:      s.active,
+	}
+	if s.started != nil {
+		info.Broker = s.started.Broker
+	}
+	for _, container := range s.containers {
+		info.Containers = append(info.Containers, container.ID)
+	}
+	return info
+}
+
+// session returns the session for the request, creating it if needed. It must
+// be released once the request is performed.
+func (d *Daemon) session(req request) *session {
+	id := req.Session
+	if id == "" {
+		id = defaultSession
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sessions[id]
+	if !ok {
+		s = &session{
+			id:          id,
+			publishers:  []*publisher{},
+			subscribers: []*subscriber{},
+			created:     time.Now(),
+			logs:        &logBuffer{},
+		}
+		sessionLogs.add(s.logs)
+		d.sessions[id] = s
+	}
+	s.refs++
+	s.acquired++
+	s.active = time.Now()
+	return s
+}
+
+// existingSession returns the session with the given ID, if there is one. It
+// must be released once the request is performed.
+func (d *Daemon) existingSession(id string) (*session, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sessions[id]
+	if ok {
+		s.refs++
+		s.acquired++
+	}
+	return s, ok
+}
+
+// release discards the session if it's idle and no other requests are using
+// it. The Daemon's lock isn't held while the session's is acquired, so the
+// session is only discarded if no request has acquired it in between.
+func (d *Daemon) release(s *session) {
+	d.mu.Lock()
+	s.refs--
+	last, acquired := s.refs == 0, s.acquired
+	d.mu.Unlock()
+	if !last {
+		return
+	}
+
+	s.mu.Lock()
+	idle := s.idle()
+	s.mu.Unlock()
+	if !idle {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s.acquired == acquired && d.sessions[s.id] == s {
+		delete(d.sessions, s.id)
+		sessionLogs.remove(s.logs)
+	}
+}
+
+// allSessions returns the daemon's sessions. They must be locked before their
+// state is read.
+func (d *Daemon) allSessions() []*session {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sessions := make([]*session, 0, len(d.sessions))
+	for _, s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// processSessions lists the daemon's sessions. If the request names a session
+// to kill, its peers are torn down and its broker stopped first.
+func (d *Daemon) processSessions(req request) ([]*sessionInfo, error) {
+	if req.Kill != "" {
+		s, ok := d.existingSession(req.Kill)
+		if !ok {
+			return nil, notFound("No such session %s", req.Kill)
+		}
+		err := d.kill(s)
+		d.release(s)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Killed session %s", req.Kill)
+	}
+
+	all := d.allSessions()
+	sessions := make([]*sessionInfo, 0, len(all))
+	for _, s := range all {
+		s.mu.Lock()
+		sessions = append(sessions, s.info())
+		s.mu.Unlock()
+	}
+	sort.Sort(byCreated(sessions))
+	return sessions, nil
+}
+
+// kill tears down the session's peers and stops its broker.
+func (d *Daemon) kill(s *session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.processTeardown(s)
+	if s.broker != nil {
+		if _, _, err := d.processBrokerStop(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byCreated []*sessionInfo
+
+func (b byCreated) Len() int           { return len(b) }
+func (b byCreated) Less(i, j int) bool { return b[i].Created.Before(b[j].Created) }
+func (b byCreated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
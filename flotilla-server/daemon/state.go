@@ -0,0 +1,188 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+)
+
+// These label the containers a daemon launches so that they can be found and
+// reaped if the daemon exits without stopping the broker.
+const (
+	managedLabel = "io.flotilla.managed"
+	daemonLabel  = "io.flotilla.daemon"
+	defaultID    = "default"
+)
+
+// brokerState is the state of a session's broker, which is persisted to the
+// daemon's state file while the broker is running.
+type brokerState struct {
+	Request    request   `json:"request"`
+	Containers []string  `json:"containers"`
+	Started    time.Time `json:"started"`
+}
+
+// labels returns the labels identifying the daemon's containers.
+func (d *Daemon) labels() map[string]string {
+	id := d.config.ID
+	if id == "" {
+		id = defaultID
+	}
+	return map[string]string{managedLabel: "true", daemonLabel: id}
+}
+
+// sameStart returns true if the start requests would start the same broker,
+// in which case a retried request can be answered with the running broker.
+func sameStart(a, b request) bool {
+	return a.Broker == b.Broker && a.Host == b.Host && a.Port == b.Port &&
+		reflect.DeepEqual(a.Options, b.Options)
+}
+
+// saveState records the state of the session's broker, if it's running, and
+// persists the state of every session's broker, if the daemon has a state
+// file. The file is removed once no brokers are running. If the session is
+// nil, the recorded state is persisted again. The session must be locked.
+func (d *Daemon) saveState(s *session) {
+	if d.config.StateFile == "" {
+		return
+	}
+
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if s != nil {
+		delete(d.states, s.id)
+		if s.broker != nil && s.started != nil {
+			d.states[s.id] = s.brokerState()
+		}
+	}
+
+	if len(d.states) == 0 {
+		if err := os.Remove(d.config.StateFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to clear broker state: %s", err.Error())
+		}
+		return
+	}
+
+	stateJSON, err := json.Marshal(d.states)
+	if err == nil {
+		err = ioutil.WriteFile(d.config.StateFile, stateJSON, 0600)
+	}
+	if err != nil {
+		log.Printf("Failed to save broker state: %s", err.Error())
+	}
+}
+
+// brokerState returns the state of the session's broker.
+func (s *session) brokerState() *brokerState {
+	state := &brokerState{Request: *s.started, Started: s.launched}
+	if state.Request.Options.Secured() {
+		// The broker's key and credentials aren't persisted.
+		options := *state.Request.Options
+		options.Security = nil
+		state.Request.Options = &options
+	}
+	for _, container := range s.containers {
+		state.Containers = append(state.Containers, container.ID)
+	}
+	return state
+}
+
+// loadState returns the persisted broker state keyed by session, or nil if
+// there is none.
+func (d *Daemon) loadState() (map[string]*brokerState, error) {
+	if d.config.StateFile == "" {
+		return nil, nil
+	}
+
+	stateJSON, err := ioutil.ReadFile(d.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var states map[string]*brokerState
+	if err := json.Unmarshal(stateJSON, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Recover reaps any containers left behind by a previous daemon which exited
+// without stopping its brokers. It should be called before the daemon starts
+// processing requests.
+func (d *Daemon) Recover() error {
+	states, err := d.loadState()
+	if err != nil {
+		log.Printf("Ignoring invalid broker state: %s", err.Error())
+	}
+	for id, state := range states {
+		log.Printf("Recovering from session %s's %s broker started at %s which was not stopped",
+			id, state.Request.Broker, state.Started.Format(time.RFC3339))
+	}
+
+	reaped, err := d.processReap()
+	if err != nil {
+		return err
+	}
+	if len(reaped) > 0 {
+		log.Printf("Reaped %d orphaned containers", len(reaped))
+	}
+	return nil
+}
+
+// processReap removes the daemon's containers which don't belong to a
+// session's running broker, including any recorded in the state file by a
+// previous daemon. It returns the IDs of the removed containers.
+func (d *Daemon) processReap() ([]string, error) {
+	owned := make(map[string]bool)
+	for _, s := range d.allSessions() {
+		s.mu.Lock()
+		starting := s.starting != nil
+		for _, container := range s.containers {
+			owned[container.ID] = true
+		}
+		s.mu.Unlock()
+		if starting {
+			// The broker's containers aren't known until it has started.
+			return nil, conflict("Session %s is starting a broker", s.id)
+		}
+	}
+
+	ids, err := d.docker.List(d.labels())
+	if err != nil {
+		return nil, err
+	}
+	if states, _ := d.loadState(); states != nil {
+		for _, state := range states {
+			ids = append(ids, state.Containers...)
+		}
+	}
+
+	reaped := []string{}
+	for _, id := range ids {
+		if owned[id] {
+			continue
+		}
+		owned[id] = true
+
+		if err := d.docker.Remove(id); err != nil {
+			if !docker.IsNotFound(err) {
+				log.Printf("Failed to reap container %s: %s", id, err.Error())
+			}
+			continue
+		}
+		log.Printf("Reaped orphaned container %s", id)
+		reaped = append(reaped, id)
+	}
+
+	// Drop any state left behind by a previous daemon.
+	d.saveState(nil)
+	return reaped, nil
+}
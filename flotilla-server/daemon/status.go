@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// processStatus reports the daemon's release and uptime, and the broker and
+// peers of each session. Idle sessions are left out.
+func (d *Daemon) processStatus() *protocol.StatusResult {
+	now := time.Now()
+	result := &protocol.StatusResult{
+		Version:  protocol.Version,
+		Daemon:   Version,
+		Started:  d.started,
+		Uptime:   now.Sub(d.started).Seconds(),
+		Sessions: []*protocol.SessionStatus{},
+	}
+
+	for _, s := range d.allSessions() {
+		s.mu.Lock()
+		if !s.idle() {
+			result.Sessions = append(result.Sessions, s.status())
+		}
+		s.mu.Unlock()
+	}
+	sort.Sort(byCreatedStatus(result.Sessions))
+	return result
+}
+
+// status describes the session's broker and the state of its peers.
+func (s *session) status() *protocol.SessionStatus {
+	info := s.info()
+	st := &protocol.SessionStatus{
+		ID:          info.ID,
+		Broker:      info.Broker,
+		Containers:  info.Containers,
+		Publishers:  info.Publishers,
+		Subscribers: info.Subscribers,
+		Created:     info.Created,
+		Active:      info.Active,
+	}
+
+	for _, publisher := range s.publishers {
+		sent := atomic.LoadInt64(&publisher.sent)
+		r, _ := publisher.getResults()
+		st.Peers = append(st.Peers, &protocol.PeerStatus{
+			Role:     protocol.RolePublisher,
+			ID:       publisher.id,
+			State:    peerState(r, s.running || sent > 0),
+			Messages: sent,
+			Expected: publisher.numMessages,
+			Err:      resultErr(r),
+		})
+	}
+	for _, subscriber := range s.subscribers {
+		received := atomic.LoadInt64(&subscriber.received)
+		r, _ := subscriber.getResults()
+		st.Peers = append(st.Peers, &protocol.PeerStatus{
+			Role:     protocol.RoleSubscriber,
+			ID:       subscriber.id,
+			State:    peerState(r, s.running || received > 0),
+			Messages: received,
+			Expected: subscriber.numMessages,
+			Err:      resultErr(r),
+		})
+	}
+	return st
+}
+
+// peerState returns the state of a peer with the given results, which are nil
+// until it completes.
+func peerState(r *protocol.Result, running bool) protocol.PeerState {
+	switch {
+	case r != nil && r.Err != "":
+		return protocol.PeerErrored
+	case r != nil:
+		return protocol.PeerDone
+	case running:
+		return protocol.PeerRunning
+	default:
+		return protocol.PeerIdle
+	}
+}
+
+func resultErr(r *protocol.Result) string {
+	if r == nil {
+		return ""
+	}
+	return r.Err
+}
+
+type byCreatedStatus []*protocol.SessionStatus
+
+func (b byCreatedStatus) Len() int           { return len(b) }
+func (b byCreatedStatus) Less(i, j int) bool { return b[i].Created.Before(b[j].Created) }
+func (b byCreatedStatus) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
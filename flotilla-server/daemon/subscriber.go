@@ -3,11 +3,14 @@ package daemon
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codahale/hdrhistogram"
+	"github.com/tylertreat/Flotilla/protocol"
 )
 
 const (
@@ -15,44 +18,91 @@ const (
 	sigFigs                = 5
 )
 
+var errIdle = errors.New("Timed out waiting for messages")
+
 type subscriber struct {
+	// received is the number of messages received so far, accessed
+	// atomically. It's first for 64-bit alignment.
+	received int64
+
 	peer
 	id          int
 	numMessages int
 	messageSize int64
+	idleTimeout time.Duration
 	hasStarted  bool
 	started     int64
 	stopped     int64
 	counter     int
-	results     *result
+	unique      int
+	duplicates  int
+	sequences   map[uint32]*sequence
+	timeline    []*protocol.Interval
+	results     *protocol.Result
 	mu          sync.Mutex
 }
 
-type latencyResults struct {
-	Min    int64   `json:"min"`
-	Q1     int64   `json:"q1"`
-	Q2     int64   `json:"q2"`
-	Q3     int64   `json:"q3"`
-	Max    int64   `json:"max"`
-	Mean   float64 `json:"mean"`
-	StdDev float64 `json:"std_dev"`
+// sequence tracks the messages received from a single publisher, which sends
+// expected messages.
+type sequence struct {
+	seen     []uint64
+	expected uint32
+}
+
+// add records the message with the given sequence number. It returns false if
+// the message was already received, and an error if the publisher doesn't
+// send a message with the sequence number, so the message can't be counted.
+func (s *sequence) add(n uint32) (bool, error) {
+	if n >= s.expected {
+		return false, fmt.Errorf("Sequence number %d out of range", n)
+	}
+
+	word, bit := n/64, uint64(1)<<(n%64)
+	for int(word) >= len(s.seen) {
+		s.seen = append(s.seen, 0)
+	}
+	if s.seen[word]&bit != 0 {
+		return false, nil
+	}
+	s.seen[word] |= bit
+	return true, nil
 }
 
 func (s *subscriber) start() {
-	latencies := hdrhistogram.New(0, maxRecordableLatencyMS, sigFigs)
+	var (
+		latencies = hdrhistogram.New(0, maxRecordableLatencyMS, sigFigs)
+		recv      = s.Recv
+	)
+	s.sequences = make(map[uint32]*sequence)
+	if s.idleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		recv = s.idleRecv(done)
+	}
+
 	for {
-		message, err := s.Recv()
+		message, err := recv()
 		now := time.Now().UnixNano()
+		if err == errIdle && s.counter > 0 {
+			log.Printf("Subscriber idle after %d messages", s.counter)
+			s.complete(latencies)
+			return
+		}
 		if err != nil {
 			log.Printf("Subscriber error: %s", err.Error())
 			s.mu.Lock()
-			s.results = &result{Err: err.Error()}
+			s.results = &protocol.Result{Err: err.Error()}
 			s.mu.Unlock()
 			return
 		}
 
 		then, _ := binary.Varint(message)
-		latencies.RecordValue((now - then) / 1000000)
+		latency := (now - then) / 1000000
+		latencies.RecordValue(latency)
+		s.record(now, latency)
+		if s.track(message) {
+			s.unique++
+		}
 
 		if !s.hasStarted {
 			s.hasStarted = true
@@ -60,31 +110,126 @@ func (s *subscriber) start() {
 		}
 
 		s.counter++
-		if s.counter == s.numMessages {
-			s.stopped = time.Now().UnixNano()
-			durationMS := float32(s.stopped-s.started) / 1000000.0
-			s.mu.Lock()
-			s.results = &result{
-				Duration:   durationMS,
-				Throughput: 1000 * float32(s.numMessages) / durationMS,
-				Latency: &latencyResults{
-					Min:    latencies.Min(),
-					Q1:     latencies.ValueAtQuantile(25),
-					Q2:     latencies.ValueAtQuantile(50),
-					Q3:     latencies.ValueAtQuantile(75),
-					Max:    latencies.Max(),
-					Mean:   latencies.Mean(),
-					StdDev: latencies.StdDev(),
-				},
-			}
-			s.mu.Unlock()
-			log.Println("Subscriber completed")
+		atomic.AddInt64(&s.received, 1)
+		s.stopped = now
+		if s.unique == s.numMessages {
+			s.complete(latencies)
 			return
 		}
 	}
 }
 
-func (s *subscriber) getResults() (*result, error) {
+// idleRecv returns a receive function which fails with errIdle if no message
+// arrives within the idle timeout. Messages are received in the background
+// until done is closed, so only the header of each is kept.
+func (s *subscriber) idleRecv(done <-chan struct{}) func() ([]byte, error) {
+	type received struct {
+		message []byte
+		err     error
+	}
+
+	messages := make(chan received)
+	go func() {
+		for {
+			message, err := s.Recv()
+			if err == nil && len(message) > sequencedSize {
+				message = message[:sequencedSize]
+			}
+			select {
+			case messages <- received{append([]byte(nil), message...), err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() ([]byte, error) {
+		select {
+		case r := <-messages:
+			return r.message, r.err
+		case <-time.After(s.idleTimeout):
+			return nil, errIdle
+		}
+	}
+}
+
+// record adds the message to the timeline.
+func (s *subscriber) record(now, latency int64) {
+	second := now / int64(time.Second)
+	var current *protocol.Interval
+	if n := len(s.timeline); n > 0 && s.timeline[n-1].Time == second {
+		current = s.timeline[n-1]
+	} else {
+		current = &protocol.Interval{Time: second}
+		s.timeline = append(s.timeline, current)
+	}
+
+	current.MeanLatency += (float64(latency) - current.MeanLatency) / float64(current.Messages+1)
+	current.Messages++
+	if latency > current.MaxLatency {
+		current.MaxLatency = latency
+	}
+}
+
+// track counts the message against its publisher's sequence if it's
+// sequenced. It returns true if the message is one the subscriber expects
+// which it hasn't already received.
+func (s *subscriber) track(message []byte) bool {
+	if s.messageSize < sequencedSize || len(message) < sequencedSize {
+		return true
+	}
+
+	tag := binary.BigEndian.Uint32(message[sequenceOffset:])
+	seq, ok := s.sequences[tag]
+	if !ok {
+		seq = &sequence{expected: uint32(s.numMessages)}
+		s.sequences[tag] = seq
+	}
+	unique, err := seq.add(binary.BigEndian.Uint32(message[sequenceOffset+4:]))
+	if err != nil {
+		return false
+	}
+	if !unique {
+		s.duplicates++
+	}
+	return unique
+}
+
+// complete records the subscriber's results. Messages it expected but didn't
+// receive, including any after the last one received, are counted as lost.
+func (s *subscriber) complete(latencies *hdrhistogram.Histogram) {
+	lost := s.numMessages - s.unique
+	if lost < 0 {
+		lost = 0
+	}
+
+	durationMS := float32(s.stopped-s.started) / 1000000.0
+	s.mu.Lock()
+	s.results = &protocol.Result{
+		Duration:   durationMS,
+		Throughput: 1000 * float32(s.counter) / durationMS,
+		Latency: &protocol.LatencyResults{
+			Min:    latencies.Min(),
+			Q1:     latencies.ValueAtQuantile(25),
+			Q2:     latencies.ValueAtQuantile(50),
+			Q3:     latencies.ValueAtQuantile(75),
+			Max:    latencies.Max(),
+			Mean:   latencies.Mean(),
+			StdDev: latencies.StdDev(),
+		},
+		Received:   s.counter,
+		Lost:       lost,
+		Duplicates: s.duplicates,
+		Timeline:   s.timeline,
+	}
+	s.mu.Unlock()
+	log.Println("Subscriber completed")
+}
+
+func (s *subscriber) getResults() (*protocol.Result, error) {
 	s.mu.Lock()
 	r := s.results
 	s.mu.Unlock()
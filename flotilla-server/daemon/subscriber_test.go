@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// queuedPeer is a peer which receives the messages queued on it.
+type queuedPeer struct {
+	messages chan []byte
+}
+
+func (p *queuedPeer) Subscribe() error { return nil }
+
+func (p *queuedPeer) Recv() ([]byte, error) {
+	message, ok := <-p.messages
+	if !ok {
+		return nil, errors.New("Peer closed")
+	}
+	return message, nil
+}
+
+func (p *queuedPeer) Send() chan<- []byte { return nil }
+
+func (p *queuedPeer) Errors() <-chan error { return nil }
+
+func (p *queuedPeer) Done() {}
+
+func (p *queuedPeer) Setup() {}
+
+func (p *queuedPeer) Teardown() { close(p.messages) }
+
+// receive runs a subscriber expecting numMessages which receives the messages
+// with the given sequence numbers, and returns its results.
+func receive(t *testing.T, numMessages int, sequence ...uint32) *subscriberResults {
+	p := &queuedPeer{messages: make(chan []byte, len(sequence))}
+	defer p.Teardown()
+	for _, n := range sequence {
+		message := make([]byte, sequencedSize)
+		binary.PutVarint(message, time.Now().UnixNano())
+		binary.BigEndian.PutUint32(message[sequenceOffset:], 42)
+		binary.BigEndian.PutUint32(message[sequenceOffset+4:], n)
+		p.messages <- message
+	}
+
+	s := &subscriber{
+		peer:        p,
+		numMessages: numMessages,
+		messageSize: sequencedSize,
+		idleTimeout: 100 * time.Millisecond,
+	}
+	s.start()
+	results, err := s.getResults()
+	if err != nil {
+		t.Fatalf("Subscriber didn't complete: %s", err)
+	}
+	return &subscriberResults{results.Received, results.Lost, results.Duplicates}
+}
+
+type subscriberResults struct {
+	received, lost, duplicates int
+}
+
+func TestSubscriberDuplicate(t *testing.T) {
+	// The duplicate doesn't complete the subscriber before the last message
+	// arrives.
+	results := receive(t, 3, 0, 1, 1, 2)
+	if expected := (subscriberResults{4, 0, 1}); *results != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *results)
+	}
+}
+
+func TestSubscriberLostLast(t *testing.T) {
+	results := receive(t, 3, 0, 1)
+	if expected := (subscriberResults{2, 1, 0}); *results != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *results)
+	}
+}
+
+func TestSequenceAdd(t *testing.T) {
+	seq := &sequence{expected: 100}
+	for _, n := range []uint32{0, 63, 64, 99} {
+		if unique, err := seq.add(n); !unique || err != nil {
+			t.Errorf("Expected %d to be unique, got %t, %v", n, unique, err)
+		}
+	}
+	if unique, err := seq.add(64); unique || err != nil {
+		t.Errorf("Expected 64 to be a duplicate, got %t, %v", unique, err)
+	}
+
+	// A sequence number beyond the publisher's messages mustn't grow the
+	// bitmap.
+	for _, n := range []uint32{100, 1 << 31, ^uint32(0)} {
+		if _, err := seq.add(n); err == nil {
+			t.Errorf("Expected %d to be out of range", n)
+		}
+	}
+	if len(seq.seen) != 2 {
+		t.Errorf("Expected the bitmap to have 2 words, got %d", len(seq.seen))
+	}
+}
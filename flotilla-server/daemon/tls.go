@@ -0,0 +1,84 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+)
+
+// These are the schemes of the transports the daemon listens with.
+const (
+	tcpScheme = "tcp://"
+	tlsScheme = "tls+tcp://"
+)
+
+// tlsConfig returns the TLS configuration for the daemon's socket, or nil if
+// TLS isn't configured. If a CA is configured, clients must present a
+// certificate signed by it.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" && c.TLSCA == "" {
+		return nil, nil
+	}
+	if c.TLSCert == "" || c.TLSKey == "" {
+		return nil, errors.New("TLS requires both a certificate and a key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.TLSCA != "" {
+		pool, err := loadCA(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCA returns a pool containing the PEM-encoded certificates in the file.
+func loadCA(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// addTransport adds the transport the socket listens with, which is TLS if
+// there's a configuration for it.
+func addTransport(s mangos.Socket, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		s.AddTransport(tcp.NewTransport())
+		return nil
+	}
+	s.AddTransport(tlstcp.NewTransport())
+	return s.SetOption(mangos.OptionTLSConfig, tlsConfig)
+}
+
+// URL returns the URL the Daemon's socket listens on for the given address,
+// such as tls+tcp://:9500 if TLS is configured.
+func (d *Daemon) URL(addr string) string {
+	if d.tls {
+		return tlsScheme + addr
+	}
+	return tcpScheme + addr
+}
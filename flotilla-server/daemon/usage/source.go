@@ -0,0 +1,176 @@
+package usage
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/docker"
+)
+
+const (
+	// userHZ is the kernel's clock tick rate, which /proc/stat CPU times are
+	// reported in. It's 100 on virtually every Linux system.
+	userHZ = 100
+
+	sectorSize = 512
+)
+
+// Host returns a Source which reads the host's resource usage from procfs,
+// which is usually mounted at /proc.
+func Host(procfs string) Source {
+	return &host{procfs: procfs}
+}
+
+type host struct {
+	procfs string
+}
+
+// Read returns the host's CPU time spent doing work, memory in use excluding
+// caches, bytes transferred on every network interface but loopback and bytes
+// transferred to and from whole disks.
+func (h *host) Read() (*Counters, error) {
+	counters := &Counters{}
+	if err := h.readCPU(counters); err != nil {
+		return nil, err
+	}
+	if err := h.readMemory(counters); err != nil {
+		return nil, err
+	}
+	if err := h.readNet(counters); err != nil {
+		return nil, err
+	}
+	if err := h.readDisk(counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+func (h *host) readCPU(counters *Counters) error {
+	return h.scan("stat", func(fields []string) bool {
+		if len(fields) < 9 || fields[0] != "cpu" {
+			return true
+		}
+
+		// user, nice, system, idle, iowait, irq, softirq, steal.
+		var ticks uint64
+		for i, field := range fields[1:9] {
+			if i == 3 || i == 4 {
+				continue
+			}
+			n, _ := strconv.ParseUint(field, 10, 64)
+			ticks += n
+		}
+		counters.CPU = time.Duration(ticks) * time.Second / userHZ
+		return false
+	})
+}
+
+func (h *host) readMemory(counters *Counters) error {
+	var total, available uint64
+	err := h.scan("meminfo", func(fields []string) bool {
+		if len(fields) < 2 {
+			return true
+		}
+		n, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = n * 1024
+		case "MemAvailable:":
+			available = n * 1024
+		}
+		return true
+	})
+	counters.Memory = total - available
+	return err
+}
+
+func (h *host) readNet(counters *Counters) error {
+	return h.scan("net/dev", func(fields []string) bool {
+		if len(fields) < 10 || !strings.HasSuffix(fields[0], ":") || fields[0] == "lo:" {
+			return true
+		}
+		rx, _ := strconv.ParseUint(fields[1], 10, 64)
+		tx, _ := strconv.ParseUint(fields[9], 10, 64)
+		counters.NetRx += rx
+		counters.NetTx += tx
+		return true
+	})
+}
+
+func (h *host) readDisk(counters *Counters) error {
+	return h.scan("diskstats", func(fields []string) bool {
+		if len(fields) < 10 || !isDisk(fields[2]) {
+			return true
+		}
+		read, _ := strconv.ParseUint(fields[5], 10, 64)
+		written, _ := strconv.ParseUint(fields[9], 10, 64)
+		counters.DiskRead += read * sectorSize
+		counters.DiskWrite += written * sectorSize
+		return true
+	})
+}
+
+// isDisk returns true if the block device is a whole disk rather than a
+// partition or a virtual device, so IO isn't counted more than once.
+func isDisk(name string) bool {
+	if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") ||
+		strings.HasPrefix(name, "dm-") {
+		return false
+	}
+	_, err := os.Stat(filepath.Join("/sys/block", name))
+	return err == nil
+}
+
+// scan calls fn with the fields of each line of the procfs file until it
+// returns false.
+func (h *host) scan(name string, fn func([]string) bool) error {
+	file, err := os.Open(filepath.Join(h.procfs, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !fn(strings.Fields(scanner.Text())) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// Container returns a Source which reads the resource usage of the container
+// with the given id.
+func Container(client *docker.Client, id string) Source {
+	return &container{client: client, id: id}
+}
+
+type container struct {
+	client *docker.Client
+	id     string
+}
+
+// Read returns the container's resource usage.
+func (c *container) Read() (*Counters, error) {
+	stats, err := c.client.Stats(c.id)
+	if err != nil {
+		return nil, err
+	}
+	if stats.CPU == 0 {
+		return nil, errors.New("Container is not running")
+	}
+
+	return &Counters{
+		CPU:       stats.CPU,
+		Memory:    stats.Memory,
+		NetRx:     stats.NetRx,
+		NetTx:     stats.NetTx,
+		DiskRead:  stats.DiskRead,
+		DiskWrite: stats.DiskWrite,
+	}, nil
+}
@@ -0,0 +1,161 @@
+// Package usage samples the resource usage of the daemon's host and of the
+// broker containers it started while a benchmark runs. Host usage is read
+// from /proc, so it's only available on Linux.
+package usage
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// Counters is a snapshot of resource usage. Everything but Memory is
+// cumulative.
+type Counters struct {
+	CPU       time.Duration
+	Memory    uint64
+	NetRx     uint64
+	NetTx     uint64
+	DiskRead  uint64
+	DiskWrite uint64
+}
+
+// Source reads the resource usage of something, such as the host or a
+// container.
+type Source interface {
+	Read() (*Counters, error)
+}
+
+// Sampler periodically reads a set of Sources.
+type Sampler struct {
+	interval time.Duration
+	sources  map[string]Source
+	usage    map[string]*protocol.Usage
+	last     map[string]*Counters
+	read     map[string]time.Time
+	started  time.Time
+	done     chan struct{}
+	stopped  chan struct{}
+	mu       sync.Mutex
+}
+
+// NewSampler creates and returns a new Sampler which reads the named Sources
+// at the given interval.
+func NewSampler(interval time.Duration, sources map[string]Source) *Sampler {
+	return &Sampler{
+		interval: interval,
+		sources:  sources,
+		usage:    make(map[string]*protocol.Usage, len(sources)),
+		last:     make(map[string]*Counters, len(sources)),
+		read:     make(map[string]time.Time, len(sources)),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start begins sampling in the background.
+func (s *Sampler) Start() {
+	s.started = time.Now()
+	for name, source := range s.sources {
+		s.usage[name] = &protocol.Usage{Samples: []*protocol.UsageSample{}}
+		counters, err := source.Read()
+		if err != nil {
+			log.Printf("Failed to read %s usage: %s", name, err.Error())
+			s.usage[name].Err = err.Error()
+			continue
+		}
+		s.last[name] = counters
+		s.read[name] = time.Now()
+	}
+
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sampling and returns the usage of each Source, keyed by name.
+func (s *Sampler) Stop() map[string]*protocol.Usage {
+	close(s.done)
+	<-s.stopped
+	s.sample()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	duration := time.Since(s.started).Seconds()
+	for _, usage := range s.usage {
+		usage.Duration = duration
+	}
+	return s.usage
+}
+
+func (s *Sampler) sample() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, source := range s.sources {
+		last := s.last[name]
+		if last == nil {
+			continue
+		}
+
+		counters, err := source.Read()
+		if err != nil {
+			// Sources like a killed broker container can fail temporarily, so
+			// keep sampling.
+			continue
+		}
+
+		now := time.Now()
+		elapsed := now.Sub(s.read[name])
+		if elapsed <= 0 {
+			continue
+		}
+
+		var (
+			usage  = s.usage[name]
+			sample = &protocol.UsageSample{
+				Time:      now.Unix(),
+				Memory:    counters.Memory,
+				NetRx:     delta(last.NetRx, counters.NetRx),
+				NetTx:     delta(last.NetTx, counters.NetTx),
+				DiskRead:  delta(last.DiskRead, counters.DiskRead),
+				DiskWrite: delta(last.DiskWrite, counters.DiskWrite),
+			}
+			cpu = time.Duration(delta(uint64(last.CPU), uint64(counters.CPU)))
+		)
+		sample.CPU = cpu.Seconds() / elapsed.Seconds()
+		usage.Samples = append(usage.Samples, sample)
+
+		usage.CPUSeconds += cpu.Seconds()
+		usage.NetRx += sample.NetRx
+		usage.NetTx += sample.NetTx
+		usage.DiskRead += sample.DiskRead
+		usage.DiskWrite += sample.DiskWrite
+		if counters.Memory > usage.MaxMemory {
+			usage.MaxMemory = counters.Memory
+		}
+		s.last[name] = counters
+		s.read[name] = now
+	}
+}
+
+// delta returns the difference between two cumulative counters, which is zero
+// if the counter was reset, such as when a container restarts.
+func delta(before, after uint64) uint64 {
+	if after < before {
+		return 0
+	}
+	return after - before
+}
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"fmt"
+	"regexp"
+
+	brokers "github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+// sessionPattern matches session IDs, which are used in logs and the state
+// file.
+var sessionPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{0,64}$`)
+
+// validate returns an error if any of the request's values are malformed.
+// Hosts, ports and broker options end up in container and process arguments
+// and configuration files, so they're checked strictly before anything is
+// done with them.
+func (r *request) validate() error {
+	// Hello is answered regardless of the version so that newer clients can
+	// find out which version the daemon speaks.
+	if r.Version > protocol.Version && r.Operation != hello {
+		return fmt.Errorf("Unsupported protocol version %d, the daemon speaks version %d",
+			r.Version, protocol.Version)
+	}
+	if !sessionPattern.MatchString(r.Session) {
+		return fmt.Errorf("Invalid session %q", r.Session)
+	}
+	if !sessionPattern.MatchString(r.Kill) {
+		return fmt.Errorf("Invalid session %q", r.Kill)
+	}
+
+	switch r.Operation {
+	case start:
+		if err := brokers.ValidateHost(r.Host); err != nil {
+			return err
+		}
+		if err := brokers.ValidatePort(r.Port); err != nil {
+			return err
+		}
+		return r.Options.Validate()
+	case pub, sub:
+		if err := brokers.ValidateAddrs(r.Host); err != nil {
+			return err
+		}
+		return r.Security.Validate()
+	case impair:
+		if r.Impairment != nil {
+			return r.Impairment.Validate()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+
+	brokers "github.com/tylertreat/Flotilla/flotilla-server/daemon/broker"
+	"github.com/tylertreat/Flotilla/flotilla-server/daemon/netem"
+	"github.com/tylertreat/Flotilla/protocol"
+)
+
+func TestValidateRequest(t *testing.T) {
+	withSession := newRequest
+	withHost := func(op protocol.Operation, host, port string) request {
+		req := newRequest(op, "session")
+		req.Host = host
+		req.Port = port
+		return req
+	}
+	withOptions := func(options *brokers.Options) request {
+		req := newRequest(start, "session")
+		req.Options = options
+		return req
+	}
+	withKill := func(kill string) request {
+		req := newRequest(teardown, "session")
+		req.Kill = kill
+		return req
+	}
+	withImpairment := func(device string) request {
+		req := newRequest(impair, "session")
+		req.Impairment = &netem.Impairment{Delay: 10, Device: device}
+		return req
+	}
+
+	valid := []request{
+		withSession(start, ""),
+		withSession(start, "run-1.2_3"),
+		withHost(start, "10.0.0.1", "4222"),
+		withHost(pub, "a:4222,b:4222", ""),
+		withOptions(&brokers.Options{Image: ":0.7.2", Env: map[string]string{"KEY": "value"}}),
+		withKill("other"),
+		withImpairment("eth1"),
+	}
+	invalid := map[string]request{
+		"session with space":    withSession(start, "a b"),
+		"session with slash":    withSession(start, "../state"),
+		"session with newline":  withSession(start, "a\n"),
+		"long session":          withSession(start, strings.Repeat("a", 65)),
+		"kill":                  withKill("$(id)"),
+		"host command":          withHost(start, "a;rm -rf /", "4222"),
+		"host substitution":     withHost(start, "$(id)", "4222"),
+		"host newline":          withHost(start, "localhost\n", "4222"),
+		"port zero":             withHost(start, "localhost", "0"),
+		"port too large":        withHost(start, "localhost", "65536"),
+		"port leading zero":     withHost(start, "localhost", "080"),
+		"image slashes":         withOptions(&brokers.Options{Image: "registry//nats"}),
+		"image traversal":       withOptions(&brokers.Options{Image: "../nats"}),
+		"image uppercase":       withOptions(&brokers.Options{Image: "NATS"}),
+		"env key":               withOptions(&brokers.Options{Env: map[string]string{"KEY;id": "x"}}),
+		"env value newline":     withOptions(&brokers.Options{Env: map[string]string{"KEY": "x\nOTHER=y"}}),
+		"config key":            withOptions(&brokers.Options{Config: map[string]string{"key\nother": "x"}}),
+		"config value newline":  withOptions(&brokers.Options{Config: map[string]string{"key": "x\n"}}),
+		"cluster secret":        withOptions(&brokers.Options{Cluster: &protocol.Cluster{Secret: "a;id"}}),
+		"peer address":          withHost(sub, "a:4222,$(id)", ""),
+		"peer address newline":  withHost(pub, "a:4222\n", ""),
+		"peer security":         {Request: newRequest(pub, "session").Request, Security: &brokers.Security{Password: "x"}},
+		"impairment device":     withImpairment("eth0;id"),
+		"impairment traversal":  withImpairment("../eth0"),
+		"impairment long":       withImpairment(strings.Repeat("e", 16)),
+		"impairment option":     withImpairment("-eth0"),
+		"unsupported version":   {Request: protocol.Request{Operation: start, Version: protocol.Version + 1}},
+		"hello invalid session": withSession(hello, "a b"),
+	}
+
+	for _, req := range valid {
+		if err := req.validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %s", req, err)
+		}
+	}
+	for name, req := range invalid {
+		if err := req.validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", name)
+		}
+	}
+}
@@ -3,27 +3,136 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/tylertreat/Flotilla/discovery"
 	"github.com/tylertreat/Flotilla/flotilla-server/daemon"
 )
 
 const defaultPort = 9500
 
+// nativePaths collects repeated --native-path name=path flags.
+type nativePaths map[string]string
+
+func (n nativePaths) String() string {
+	paths := make([]string, 0, len(n))
+	for name, path := range n {
+		paths = append(paths, name+"="+path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (n nativePaths) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Invalid native path %s, expected name=path", value)
+	}
+	n[parts[0]] = parts[1]
+	return nil
+}
+
 func main() {
 	var (
-		port            = flag.Int("port", defaultPort, "daemon port")
+		port           = flag.Int("port", defaultPort, "daemon port")
+		dockerEndpoint = flag.String("docker-endpoint", "",
+			"Docker Engine API endpoint (defaults to $DOCKER_HOST or unix:///var/run/docker.sock)")
 		gCloudProjectID = flag.String("gcloud-project-id", "",
 			"Google Cloud project id (needed for Cloud Pub/Sub)")
 		gCloudJSONKey = flag.String("gcloud-json-key", "",
 			"Google Cloud project JSON key file (needed for Cloud Pub/Sub)")
+		inMemLatency = flag.Duration("inmem-latency", 0,
+			"delay added to each message by the in-memory broker")
+		inMemLoss = flag.Float64("inmem-loss", 0,
+			"probability (0-1) the in-memory broker drops a message")
+		id = flag.String("id", "",
+			"identifies the daemon's containers on a shared Docker host (defaults to the port)")
+		stateFile = flag.String("state-file", "",
+			"file the running broker's state is persisted to (defaults to flotilla-<port>.json in the temp directory)")
+		launcher = flag.String("launcher", daemon.DockerLauncher,
+			"how brokers are launched: docker or native")
+		nativeDir = flag.String("native-dir", "",
+			"directory native broker working directories are created in (defaults to the temp directory)")
+		tlsCert = flag.String("tls-cert", "",
+			"PEM certificate file to serve TLS with (requires --tls-key)")
+		tlsKey = flag.String("tls-key", "",
+			"PEM key file for --tls-cert")
+		tlsCA = flag.String("tls-ca", "",
+			"PEM CA certificate file clients must present a certificate signed by (enables mutual TLS)")
+		authFile = flag.String("auth-file", "",
+			"JSON file of tokens requests must be signed with and the operations each may perform")
+		progressPort = flag.Int("progress-port", 0,
+			"port progress is published on during runs, unauthenticated unless --tls-ca is set (0 disables)")
+		discoveryURL = flag.String("discovery", "",
+			"backend to register the daemon with, file:///dir or etcd://host:2379[,host:2379][/prefix]")
+		advertise = flag.String("advertise", "",
+			"host:port clients reach the daemon at, as registered (defaults to the hostname and --port)")
+		labels = flag.String("labels", "",
+			"labels to register the daemon with, e.g. role=worker,zone=a,instance=m4.large")
+		httpPort = flag.Int("http-port", 0,
+			"port the HTTP API is served on, with TLS if --tls-cert is set (0 disables)")
+		paths = nativePaths{}
 	)
+	flag.Var(paths, "native-path",
+		"path of a native broker binary as name=path, e.g. nats-server=/opt/nats/nats-server (repeatable)")
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	if *id == "" {
+		*id = strconv.Itoa(*port)
+	}
+	if *stateFile == "" {
+		*stateFile = filepath.Join(os.TempDir(), fmt.Sprintf("flotilla-%d.json", *port))
+	}
+
+	var tokens map[string]*daemon.Token
+	if *authFile != "" {
+		var err error
+		if tokens, err = daemon.LoadTokens(*authFile); err != nil {
+			panic(err)
+		}
+	}
+
+	var (
+		backend      discovery.Backend
+		registration *discovery.Registration
+	)
+	if *discoveryURL != "" {
+		var err error
+		if backend, err = discovery.Open(*discoveryURL); err != nil {
+			panic(err)
+		}
+		registration, err = newRegistration(*advertise, *port, *labels)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	config := &daemon.Config{
+		ID:                   *id,
+		StateFile:            *stateFile,
+		DockerEndpoint:       *dockerEndpoint,
 		GoogleCloudProjectID: *gCloudProjectID,
 		GoogleCloudJSONKey:   *gCloudJSONKey,
+		InMemLatency:         *inMemLatency,
+		InMemLoss:            *inMemLoss,
+		Launcher:             *launcher,
+		NativePaths:          paths,
+		NativeDir:            *nativeDir,
+		TLSCert:              *tlsCert,
+		TLSKey:               *tlsKey,
+		TLSCA:                *tlsCA,
+		Tokens:               tokens,
+		ProgressPort:         *progressPort,
+		Discovery:            backend,
+		Registration:         registration,
+		HTTPPort:             *httpPort,
 	}
 
 	d, err := daemon.NewDaemon(config)
@@ -31,8 +140,37 @@ func main() {
 		panic(err)
 	}
 
+	// Closing the daemon on exit removes its registration.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		d.Close()
+	}()
+
 	fmt.Printf("Flotilla daemon started on port %d...\n", *port)
 	if err := d.Start(*port); err != nil {
 		panic(err)
 	}
 }
+
+// newRegistration returns the daemon's discovery registration, advertising
+// the hostname and port if no address is given.
+func newRegistration(advertise string, port int, labels string) (*discovery.Registration, error) {
+	if advertise == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		advertise = net.JoinHostPort(hostname, strconv.Itoa(port))
+	}
+	if _, _, err := net.SplitHostPort(advertise); err != nil {
+		return nil, fmt.Errorf("Invalid advertised address %s: %s", advertise, err.Error())
+	}
+
+	parsed, err := discovery.ParseLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &discovery.Registration{Addr: advertise, Labels: parsed}, nil
+}
@@ -0,0 +1,220 @@
+package protocol
+
+// BrokerOptions contains settings which override a broker's defaults when
+// it's started. It's sent with the start operation.
+type BrokerOptions struct {
+	// Image overrides the broker's image. This can be a full image reference,
+	// such as "nats:0.7.2", or just a tag, such as ":0.7.2", to run a
+	// different version of the default image.
+	Image string `json:"image,omitempty"`
+
+	// Env contains extra environment variables for the broker.
+	Env map[string]string `json:"env,omitempty"`
+
+	// Config contains broker configuration keys and values, such as Kafka's
+	// num.io.threads. How they are applied depends on the broker.
+	Config map[string]string `json:"config,omitempty"`
+
+	// Cluster describes the cluster the broker is a node of, if any.
+	Cluster *Cluster `json:"cluster,omitempty"`
+
+	// Resources limits the host resources available to the broker node's
+	// container. Coordination services, such as ZooKeeper, are
+	// unconstrained.
+	Resources *Resources `json:"resources,omitempty"`
+
+	// Security has the broker serve TLS and authenticate peers.
+	Security *ServerSecurity `json:"security,omitempty"`
+}
+
+// Cluster describes a broker cluster spanning multiple daemons, each of which
+// runs one node.
+type Cluster struct {
+	// Nodes contains the host of each node, in order. The first node also
+	// runs any coordination services the broker needs, such as ZooKeeper.
+	Nodes []string `json:"nodes"`
+
+	// Node is the index of the node to start.
+	Node int `json:"node"`
+
+	// Secret is shared by the nodes for brokers which require one to form a
+	// cluster, such as RabbitMQ's Erlang cookie.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Resources limits the host resources a broker container can use.
+type Resources struct {
+	// CpusetCpus contains the CPUs the container can run on, such as "0-3"
+	// or "0,2".
+	CpusetCpus string `json:"cpuset_cpus,omitempty"`
+
+	// Memory is the container's memory limit in bytes.
+	Memory int64 `json:"memory,omitempty"`
+
+	// BlkioWeight is the container's relative block IO weight, between 10
+	// and 1000.
+	BlkioWeight uint16 `json:"blkio_weight,omitempty"`
+}
+
+// Security contains the TLS and authentication settings peers connect to the
+// broker with. Certificates and keys are PEM-encoded. It's sent with the
+// publishers and subscribers operations.
+type Security struct {
+	// TLS enables TLS. The broker's certificate is verified with CA, or the
+	// system's roots if it's empty, unless InsecureSkipVerify is set.
+	TLS                bool   `json:"tls,omitempty"`
+	CA                 string `json:"ca,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+
+	// Cert and Key are the client certificate presented to brokers which
+	// require one.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// Username and Password are the credentials peers authenticate with.
+	// Mechanism is the SASL mechanism for brokers which support several,
+	// such as PLAIN. If empty, the broker's default is used.
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Mechanism string `json:"mechanism,omitempty"`
+}
+
+// ServerSecurity contains the TLS and authentication settings a broker is
+// started with. Certificates and keys are PEM-encoded.
+type ServerSecurity struct {
+	// Cert and Key are the broker's certificate. If CA is set, peers must
+	// present a certificate signed by it.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca,omitempty"`
+
+	// Username and Password are the credentials peers must authenticate
+	// with. If empty, peers aren't authenticated.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Fault is an action taken against a broker node while the benchmark runs.
+// Faults are sent with the faults operation.
+type Fault struct {
+	// After is the number of milliseconds after the schedule is received to
+	// take the action.
+	After int64 `json:"after"`
+
+	// Action is FaultKill or FaultRestart.
+	Action string `json:"action"`
+}
+
+// These are the fault actions.
+const (
+	// FaultKill kills the broker node.
+	FaultKill = "kill"
+
+	// FaultRestart restarts the broker node whether it's running or not.
+	FaultRestart = "restart"
+)
+
+// Impairment describes the network conditions to emulate. It's sent with the
+// impair operation.
+type Impairment struct {
+	// Delay is the latency in milliseconds added to outgoing packets.
+	Delay int64 `json:"delay,omitempty"`
+
+	// Jitter is the random variation in milliseconds of the added delay.
+	Jitter int64 `json:"jitter,omitempty"`
+
+	// Loss is the percentage of outgoing packets dropped.
+	Loss float64 `json:"loss,omitempty"`
+
+	// Rate caps the outgoing bandwidth in kbit/s.
+	Rate int `json:"rate,omitempty"`
+
+	// Device is the network interface to impair, the daemon's default if
+	// empty.
+	Device string `json:"device,omitempty"`
+}
+
+// Result contains the results of a single publisher or subscriber, which are
+// returned by the results operation.
+type Result struct {
+	Duration   float32 `json:"duration,omitempty"`
+	Throughput float32 `json:"throughput,omitempty"`
+
+	// Latency is only reported by subscribers which completed.
+	Latency *LatencyResults `json:"latency,omitempty"`
+	Err     string          `json:"error,omitempty"`
+
+	// Received, Lost and Duplicates are only reported by subscribers. Lost
+	// counts the expected messages which weren't received before the
+	// subscriber went idle. Duplicates is zero unless messages are large
+	// enough to be sequenced, in which case duplicates don't count towards
+	// the expected messages.
+	Received   int         `json:"received,omitempty"`
+	Lost       int         `json:"lost,omitempty"`
+	Duplicates int         `json:"duplicates,omitempty"`
+	Timeline   []*Interval `json:"timeline,omitempty"`
+}
+
+// LatencyResults contains a subscriber's message latencies in milliseconds.
+type LatencyResults struct {
+	Min    int64   `json:"min"`
+	Q1     int64   `json:"q1"`
+	Q2     int64   `json:"q2"`
+	Q3     int64   `json:"q3"`
+	Max    int64   `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"std_dev"`
+}
+
+// Interval contains the messages a subscriber received during one second of
+// the benchmark.
+type Interval struct {
+	// Time is the Unix time of the start of the interval in seconds.
+	Time        int64   `json:"time"`
+	Messages    int     `json:"messages"`
+	MeanLatency float64 `json:"mean_latency"`
+	MaxLatency  int64   `json:"max_latency"`
+}
+
+// Usage is the resource usage of a host or container during the run, which is
+// returned with results if the daemon has the usage feature.
+type Usage struct {
+	// Duration is the number of seconds usage was sampled for.
+	Duration float64 `json:"duration"`
+
+	// CPUSeconds is the total CPU time used.
+	CPUSeconds float64 `json:"cpu_seconds"`
+
+	// MaxMemory is the most memory used in bytes.
+	MaxMemory uint64 `json:"max_memory"`
+
+	// NetRx, NetTx, DiskRead and DiskWrite are the total bytes transferred.
+	NetRx     uint64 `json:"net_rx"`
+	NetTx     uint64 `json:"net_tx"`
+	DiskRead  uint64 `json:"disk_read"`
+	DiskWrite uint64 `json:"disk_write"`
+
+	Samples []*UsageSample `json:"samples"`
+
+	// Err is set if usage could not be sampled.
+	Err string `json:"error,omitempty"`
+}
+
+// UsageSample is the resource usage during one sampling interval.
+type UsageSample struct {
+	// Time is the Unix time of the end of the interval in seconds.
+	Time int64 `json:"time"`
+
+	// CPU is the number of CPUs used on average during the interval.
+	CPU float64 `json:"cpu"`
+
+	// Memory is the memory used in bytes at the end of the interval.
+	Memory uint64 `json:"memory"`
+
+	// NetRx, NetTx, DiskRead and DiskWrite are the bytes transferred
+	// during the interval.
+	NetRx     uint64 `json:"net_rx"`
+	NetTx     uint64 `json:"net_tx"`
+	DiskRead  uint64 `json:"disk_read"`
+	DiskWrite uint64 `json:"disk_write"`
+}
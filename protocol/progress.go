@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// topicSeparator ends the session topic which prefixes progress messages.
+// Session IDs can't contain it, so one session's topic is never a prefix of
+// another's.
+const topicSeparator = ' '
+
+// Progress is a daemon's progress through a session's run. Daemons publish it
+// periodically on their progress socket.
+type Progress struct {
+	Session string `json:"session"`
+
+	// Published and Received are the numbers of messages the session's
+	// publishers have sent and its subscribers have received so far.
+	Published int64 `json:"published"`
+	Received  int64 `json:"received"`
+
+	// PublishRate and ReceiveRate are the numbers of messages per second
+	// sent and received since the previous update.
+	PublishRate float64 `json:"publish_rate"`
+	ReceiveRate float64 `json:"receive_rate"`
+
+	// Errors is the number of publishers and subscribers which failed.
+	Errors int `json:"errors"`
+
+	// Done is true once every publisher and subscriber has completed.
+	Done bool `json:"done"`
+}
+
+// ProgressTopic returns the prefix of the session's progress messages, which
+// clients subscribe to.
+func ProgressTopic(session string) []byte {
+	return append([]byte(session), topicSeparator)
+}
+
+// EncodeProgress returns the progress message, prefixed with its session's
+// topic.
+func EncodeProgress(p *Progress) ([]byte, error) {
+	progressJSON, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append(ProgressTopic(p.Session), progressJSON...), nil
+}
+
+// DecodeProgress parses a progress message.
+func DecodeProgress(msg []byte) (*Progress, error) {
+	i := bytes.IndexByte(msg, topicSeparator)
+	if i < 0 {
+		return nil, errors.New("Progress message has no topic")
+	}
+
+	var p Progress
+	if err := json.Unmarshal(msg[i+1:], &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
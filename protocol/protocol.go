@@ -0,0 +1,163 @@
+// Package protocol defines the messages exchanged by the Flotilla client and
+// daemons over their REQ/REP sockets. Each side embeds Request and Response in
+// its own message types, which add the payloads defined here, such as
+// BrokerOptions and Result, that its operations use.
+package protocol
+
+// Version is the version of the protocol. It's incremented whenever a change
+// would make clients and daemons built from different versions misbehave.
+const Version = 1
+
+// Operation is an action a daemon performs on request.
+type Operation string
+
+// These are the operations daemons perform.
+const (
+	Hello       Operation = "hello"
+	Start       Operation = "start"
+	Stop        Operation = "stop"
+	Subscribers Operation = "subscribers"
+	Publishers  Operation = "publishers"
+	Run         Operation = "run"
+	Results     Operation = "results"
+	Teardown    Operation = "teardown"
+	Faults      Operation = "faults"
+	Impair      Operation = "impair"
+	Logs        Operation = "logs"
+	Reap        Operation = "reap"
+	Sessions    Operation = "sessions"
+	Heartbeat   Operation = "heartbeat"
+	Status      Operation = "status"
+)
+
+// These are the optional features daemons report in their hello result.
+const (
+	// FeatureSessions isolates benchmarks sharing a daemon.
+	FeatureSessions = "sessions"
+
+	// FeatureFaults injects faults into broker nodes.
+	FeatureFaults = "faults"
+
+	// FeatureImpairment emulates network conditions.
+	FeatureImpairment = "impairment"
+
+	// FeatureUsage reports resource usage with results.
+	FeatureUsage = "usage"
+
+	// FeatureLogs returns broker and daemon output.
+	FeatureLogs = "logs"
+
+	// FeatureSessionLogs returns each session's daemon output when its peers
+	// are torn down or its broker is stopped.
+	FeatureSessionLogs = "session-logs"
+
+	// FeatureBrokerSecurity connects peers to brokers with TLS and
+	// credentials, and starts brokers with TLS.
+	FeatureBrokerSecurity = "broker-security"
+
+	// FeatureNative runs brokers as processes rather than containers.
+	FeatureNative = "native"
+
+	// FeatureTLS means the daemon only accepts TLS connections.
+	FeatureTLS = "tls"
+
+	// FeatureAuth means the daemon requires signed requests.
+	FeatureAuth = "auth"
+
+	// FeatureProgress publishes progress during runs.
+	FeatureProgress = "progress"
+)
+
+// Request contains the fields shared by every request.
+type Request struct {
+	// Version is the protocol version the client speaks. Zero means the
+	// client predates versioning.
+	Version int `json:"version,omitempty"`
+
+	Operation   Operation `json:"operation"`
+	Broker      string    `json:"broker"`
+	Port        string    `json:"port"`
+	NumMessages int       `json:"num_messages"`
+	MessageSize int64     `json:"message_size"`
+	Count       int       `json:"count"`
+	Host        string    `json:"host"`
+
+	// Session identifies the benchmark the request belongs to. Requests
+	// without one share a default session.
+	Session string `json:"session,omitempty"`
+
+	// StartupTimeout is the number of seconds to wait for the broker to
+	// become ready.
+	StartupTimeout int `json:"startup_timeout"`
+
+	// IdleTimeout is the number of seconds a subscriber waits for a message
+	// before completing with the messages it has received. Zero waits
+	// forever.
+	IdleTimeout int `json:"idle_timeout"`
+
+	// Target is where a network impairment is applied, which is either the
+	// daemon's host or the broker node.
+	Target string `json:"target,omitempty"`
+
+	// Kill is the ID of a session to kill with the sessions operation.
+	Kill string `json:"kill,omitempty"`
+}
+
+// Response contains the fields shared by every response.
+type Response struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+
+	// Logs contains the broker's output when it's stopped or fails to
+	// become ready, or the daemon's output when logs are requested.
+	Logs map[string]string `json:"logs,omitempty"`
+}
+
+// HelloResult is the result of the hello operation, which clients use to
+// check that they can work with a daemon before sending it anything else.
+type HelloResult struct {
+	// Version is the protocol version the daemon speaks.
+	Version int `json:"version"`
+
+	// Daemon is the daemon's release.
+	Daemon string `json:"daemon"`
+
+	// Operations and Features contain what the daemon supports, and Brokers
+	// the brokers it can start. Peers can run against any broker.
+	Operations []Operation `json:"operations"`
+	Brokers    []string    `json:"brokers"`
+	Features   []string    `json:"features"`
+
+	// ProgressPort is the port the daemon publishes progress on, if it has
+	// the progress feature.
+	ProgressPort int `json:"progress_port,omitempty"`
+}
+
+// SupportsOperation returns true if the daemon performs the operation.
+func (h *HelloResult) SupportsOperation(op Operation) bool {
+	for _, supported := range h.Operations {
+		if supported == op {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsBroker returns true if the daemon can start the broker.
+func (h *HelloResult) SupportsBroker(broker string) bool {
+	return contains(h.Brokers, broker)
+}
+
+// Supports returns true if the daemon has the feature.
+func (h *HelloResult) Supports(feature string) bool {
+	return contains(h.Features, feature)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import "time"
+
+// PeerState is what a publisher or subscriber is doing.
+type PeerState string
+
+// These are the states of peers.
+const (
+	// PeerIdle peers are waiting for the benchmark to run.
+	PeerIdle PeerState = "idle"
+
+	// PeerRunning peers are sending or receiving messages.
+	PeerRunning PeerState = "running"
+
+	// PeerDone peers have completed and have results.
+	PeerDone PeerState = "done"
+
+	// PeerErrored peers have completed with an error.
+	PeerErrored PeerState = "errored"
+)
+
+// These are the roles of peers.
+const (
+	RolePublisher  = "publisher"
+	RoleSubscriber = "subscriber"
+)
+
+// StatusResult is the result of the status operation, which reports what a
+// daemon is doing.
+type StatusResult struct {
+	// Version is the protocol version the daemon speaks, and Daemon its
+	// release.
+	Version int    `json:"version"`
+	Daemon  string `json:"daemon"`
+
+	// Started is when the daemon started, and Uptime the number of seconds
+	// since.
+	Started time.Time `json:"started"`
+	Uptime  float64   `json:"uptime"`
+
+	// Sessions contains the sessions with a broker or peers.
+	Sessions []*SessionStatus `json:"sessions"`
+}
+
+// SessionStatus describes what a daemon is doing for one session.
+type SessionStatus struct {
+	ID string `json:"id"`
+
+	// Broker is the type of broker the session started, and Containers the
+	// IDs of its containers. Both are empty if the session has no broker.
+	Broker     string   `json:"broker,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+
+	Publishers  int `json:"publishers"`
+	Subscribers int `json:"subscribers"`
+
+	// Peers contains the state of each publisher and subscriber.
+	Peers []*PeerStatus `json:"peers,omitempty"`
+
+	Created time.Time `json:"created"`
+	Active  time.Time `json:"active"`
+}
+
+// PeerStatus describes a publisher or subscriber.
+type PeerStatus struct {
+	// Role is RolePublisher or RoleSubscriber.
+	Role  string    `json:"role"`
+	ID    int       `json:"id"`
+	State PeerState `json:"state"`
+
+	// Messages is the number of messages sent or received so far, out of
+	// Expected.
+	Messages int64 `json:"messages"`
+	Expected int   `json:"expected"`
+
+	// Err is set if the peer errored.
+	Err string `json:"error,omitempty"`
+}